@@ -0,0 +1,99 @@
+package icarus
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var icarusUnsupportedAccept = splitCounterVec(prometheus.CounterOpts{
+	Name: "icarus_unsupported_accept_counter",
+	Help: "How many scrapes asked only for formats icarus cannot serve, so got text anyway, by what they asked for?",
+}, []string{"type"})
+
+func init() {
+	prometheus.MustRegister(icarusUnsupportedAccept)
+}
+
+// The type label values of icarus_unsupported_accept_counter.
+const (
+	// acceptProtobuf: the prometheus protobuf exposition format.
+	acceptProtobuf = "protobuf"
+	// acceptOpenMetrics: the OpenMetrics text format.
+	acceptOpenMetrics = "openmetrics"
+	// acceptOther: anything else.
+	acceptOther = "other"
+)
+
+// acceptsText says whether an Accept header allows the text format. No
+// header at all does.
+func acceptsText(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	return accepts(accept, "text/plain", "text/*", "*/*")
+}
+
+// acceptsOpenMetrics says whether an Accept header asks for OpenMetrics by name.
+func acceptsOpenMetrics(accept string) bool {
+	return accepts(accept, "application/openmetrics-text")
+}
+
+// accepts says whether an Accept header allows one of the media types,
+// rather than refusing it with q=0.
+func accepts(accept string, types ...string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		media := strings.ToLower(strings.TrimSpace(params[0]))
+		allowed := false
+		for _, kind := range types {
+			allowed = allowed || (media == kind)
+		}
+		if !allowed {
+			continue
+		}
+		refused := false
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if (len(kv) == 2) && (strings.ToLower(kv[0]) == "q") {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				refused = (err == nil) && (q <= 0)
+			}
+		}
+		if !refused {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptType is what an Accept header that does not allow text asked for,
+// the type label of icarus_unsupported_accept_counter.
+func acceptType(accept string) string {
+	accept = strings.ToLower(accept)
+	switch {
+	case strings.Contains(accept, "application/vnd.google.protobuf"):
+		return acceptProtobuf
+	case strings.Contains(accept, "application/openmetrics-text"):
+		return acceptOpenMetrics
+	}
+	return acceptOther
+}
+
+// negotiate says whether a scrape gets OpenMetrics, if it asked for it and
+// SetOpenMetrics is on, and counts scrapes asking for a format icarus cannot
+// serve. They are still served the text format with a 200, rather than a
+// 406, so a misconfigured scraper keeps working and the counter shows it.
+func (i *Icarus) negotiate(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if acceptsOpenMetrics(accept) && i.servesOpenMetrics() {
+		return true
+	}
+	if !acceptsText(accept) {
+		kind := acceptType(accept)
+		i.counterVec(icarusUnsupportedAccept).WithLabelValues(kind).Inc()
+	}
+	return false
+}
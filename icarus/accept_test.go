@@ -0,0 +1,66 @@
+package icarus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsText(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                 true,
+		"text/plain":                       true,
+		"text/plain; version=0.0.4":        true,
+		"*/*":                              true,
+		"TEXT/*;q=0.5":                     true,
+		"application/json, */*;q=0.1":      true,
+		"text/plain;q=0":                   false,
+		"application/json":                 false,
+		"application/openmetrics-text":     false,
+		"application/vnd.google.protobuf;": false,
+		"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3": true,
+	} {
+		if g := acceptsText(accept); g != want {
+			t.Error(accept, g)
+		}
+	}
+}
+
+func TestUnsupportedAccept(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.Drain()
+	i.rollup()
+	scrape := func(accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Accept", accept)
+		i.HandleFunc(w, r)
+		return w
+	}
+	counted := func(kind string) float64 { return value(icarusUnsupportedAccept.WithLabelValues(kind)) }
+
+	before := counted(acceptOther)
+	w := scrape("application/x-unknown")
+	if (w.Code != http.StatusOK) || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") ||
+		!strings.Contains(w.Body.String(), "\nft_x{} 1\n") {
+		t.Error(w.Code, w.Header(), w.Body.String())
+	}
+	if g := counted(acceptOther); g != before+1 {
+		t.Error(before, g)
+	}
+
+	before = counted(acceptProtobuf)
+	scrape("application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	if g := counted(acceptProtobuf); g != before+1 {
+		t.Error(before, g)
+	}
+
+	// a scraper happy with text is not counted.
+	before = counted(acceptOther)
+	scrape("text/plain;version=0.0.4")
+	if g := counted(acceptOther); g != before {
+		t.Error(before, g)
+	}
+}
@@ -0,0 +1,71 @@
+package icarus
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// ErrOverBudget is what TryRecord says when a sample would take the bytes in
+// flight past SetMaxInflightBytes.
+var ErrOverBudget = errors.New("icarus ingest byte budget exceeded")
+
+// SetMaxInflightBytes bounds roughly how many bytes of samples, labels and
+// values, can be between Record and the store at once, so a few huge samples
+// hold it up as much as many small ones would. Samples past the budget are
+// dropped and counted. Zero, the default, is no budget. Samples written
+// straight to Chan skip the budget and are never counted against it.
+func (i *Icarus) SetMaxInflightBytes(max int64) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.maxInflight = max
+}
+
+// SetMaxMetricBytes drops samples bigger than max bytes, labels and value,
+// rather than storing them, so a single pathological series with thousands
+// of labels or giant values cannot take over a rollup. Zero, the default, is
+// no limit.
+func (i *Icarus) SetMaxMetricBytes(max int64) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.maxMetric = max
+}
+
+// oversize says if a sample is bigger than SetMaxMetricBytes allows.
+func (i *Icarus) oversize(x util.Metric) bool {
+	i.recordMux.RLock()
+	max := i.maxMetric
+	i.recordMux.RUnlock()
+	return (max > 0) && (metricSize(x) > max)
+}
+
+// metricSize is about how many bytes a sample takes up.
+func metricSize(x util.Metric) int64 {
+	size := int64(16)
+	for key, val := range x.Desc {
+		size += int64(len(key) + len(val))
+	}
+	return size
+}
+
+// admit reserves size bytes of the budget, false means there is no room.
+func (i *Icarus) admit(size int64) bool {
+	i.recordMux.RLock()
+	max := i.maxInflight
+	i.recordMux.RUnlock()
+	// always count, so the tally is right whenever a budget is set.
+	total := atomic.AddInt64(&i.inflight, size)
+	if (max > 0) && (total > max) {
+		atomic.AddInt64(&i.inflight, -size)
+		return false
+	}
+	return true
+}
+
+// release gives size bytes back once a sample is through ingest.
+func (i *Icarus) release(size int64) {
+	atomic.AddInt64(&i.inflight, -size)
+}
@@ -0,0 +1,107 @@
+package icarus
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestByteBudget(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetMaxInflightBytes(2000)
+	big := helper(map[string]string{"__name__": "x", "blob": strings.Repeat("a", 500)}, 1)
+	small := helper(map[string]string{"__name__": "x", "a": "b"}, 1)
+	// nothing gets through ingest while the store is held.
+	i.Store.Lock()
+	admitted := func(x int64) int {
+		count := 0
+		for ii := 0; ii < 10; ii++ {
+			if i.admit(x) {
+				count++
+			}
+		}
+		return count
+	}
+	if g := admitted(metricSize(big)); g != 3 {
+		t.Error(g)
+	}
+	i.release(3 * metricSize(big))
+	if g := admitted(metricSize(small)); g != 10 {
+		t.Error(g)
+	}
+	i.release(10 * metricSize(small))
+	before := value(icarusDroppedCounter.WithLabelValues(dropByteBudget))
+	errs := make(chan error, 5)
+	for ii := 0; ii < 5; ii++ {
+		go func() { errs <- i.TryRecord(copyMetric(big)) }()
+	}
+	// the first few fit, and go into the channel or wait on it.
+	err := <-errs
+	for err == nil {
+		err = <-errs
+	}
+	if err != ErrOverBudget {
+		t.Error(err)
+	}
+	if g := value(icarusDroppedCounter.WithLabelValues(dropByteBudget)); g < before+1 {
+		t.Error(g)
+	}
+	i.Store.Unlock()
+	i.Drain()
+	if g := atomic.LoadInt64(&i.inflight); g != 0 {
+		t.Error(g)
+	}
+}
+
+func TestMaxMetricBytes(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetMaxMetricBytes(200)
+	before := value(icarusDroppedCounter.WithLabelValues(dropOversize))
+	labels := map[string]string{"__name__": "wide"}
+	for ii := 0; ii < 50; ii++ {
+		labels[fmt.Sprintf("label%d", ii)] = "v"
+	}
+	i.Record(helper(labels, 1))
+	i.Record(helper(map[string]string{"__name__": "long", "a": strings.Repeat("a", 300)}, 1))
+	i.Record(helper(map[string]string{"__name__": "normal", "a": "b"}, 1))
+	i.Drain()
+	if g := i.Snapshot(); (len(g) != 1) || (g[0].Desc["__name__"] != "ft_normal") {
+		t.Error(g)
+	}
+	if g := value(icarusDroppedCounter.WithLabelValues(dropOversize)); g != before+2 {
+		t.Error(g)
+	}
+}
+
+func TestByteBudgetChan(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetMaxInflightBytes(2000)
+	negative := int32(0)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if atomic.LoadInt64(&i.inflight) < 0 {
+				atomic.StoreInt32(&negative, 1)
+			}
+		}
+	}()
+	for ii := 0; ii < 100; ii++ {
+		i.Chan <- helper(map[string]string{"__name__": "x", "a": fmt.Sprint(ii)}, 1)
+		i.Record(helper(map[string]string{"__name__": "y", "a": fmt.Sprint(ii)}, 1))
+	}
+	i.Drain()
+	eventually(t, func() bool { return len(i.Snapshot()) == 200 })
+	close(done)
+	if atomic.LoadInt32(&negative) != 0 {
+		t.Error("inflight went below zero")
+	}
+	if g := atomic.LoadInt64(&i.inflight); g != 0 {
+		t.Error(g)
+	}
+}
@@ -0,0 +1,55 @@
+package icarus
+
+import (
+	"strconv"
+
+	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	icarusConfigChanges = splitCounter(prometheus.CounterOpts{
+		Name: "icarus_config_changes_total",
+		Help: "How many times was the configuration changed at runtime?",
+	})
+	icarusConfigChanged = splitGauge(prometheus.GaugeOpts{
+		Name: "icarus_config_last_change_timestamp_seconds",
+		Help: "When was the configuration last changed, in unix seconds?",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(icarusConfigChanges)
+	prometheus.MustRegister(icarusConfigChanged)
+}
+
+// configChanged counts a change made by one of the setters, so behaviour
+// shifts can be lined up with them. Setters called before the first page is
+// rolled up are the startup configuration, not changes, and are not counted.
+func (i *Icarus) configChanged() {
+	if !i.isReady() {
+		return
+	}
+	i.counter(icarusConfigChanges).Inc()
+	i.gauge(icarusConfigChanged).Set(float64(i.now().Unix()))
+}
+
+// configInfo describes the active configuration as an info style metric. The
+// label set is fixed so it never adds to cardinality. Callers hold the icarus lock.
+func (i *Icarus) configInfo() util.Metric {
+	i.Store.Lock()
+	windows := i.Store.Keep
+	i.Store.Unlock()
+	i.recordMux.RLock()
+	defer i.recordMux.RUnlock()
+	return util.Metric{Desc: map[string]string{
+		"__name__":    i.prefix + "icarus_config_info",
+		"windows":     strconv.Itoa(windows),
+		"interval":    i.interval.String(),
+		"pages":       strconv.Itoa(i.pages),
+		"page_policy": i.policy.String(),
+		"prefix_mode": i.prefixMode.String(),
+		"slow_every":  strconv.Itoa(i.lanes.every),
+		"idle":        i.idle.String(),
+	}, Data: util.DataPoint{Val: 1}}
+}
@@ -0,0 +1,50 @@
+package icarus
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigInfo(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.rollup()
+	want := `ft_icarus_config_info{idle="0s",interval="10s",page_policy="oldest",pages="2",prefix_mode="always",slow_every="0",windows="2"} 1`
+	if g := i.servePage().Read(); !strings.Contains(g, "\n"+want+"\n") {
+		t.Error(g)
+	}
+	i.SetWindows(5)
+	i.SetPagePolicy(PageOldest, 3)
+	i.rollup()
+	want = `ft_icarus_config_info{idle="0s",interval="10s",page_policy="oldest",pages="3",prefix_mode="always",slow_every="0",windows="5"} 1`
+	if g := i.servePage().Read(); !strings.Contains(g, "\n"+want+"\n") {
+		t.Error(g)
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.now = func() time.Time { return time.Unix(1500000000, 0) }
+	before := value(icarusConfigChanges)
+	// startup configuration is not a change.
+	i.SetMaxBody(1 << 20)
+	if g := value(icarusConfigChanges); g != before {
+		t.Error(g)
+	}
+	i.rollup()
+	i.SetWindows(3)
+	i.SetIngestRates(true)
+	if g := value(icarusConfigChanges); g != before+2 {
+		t.Error(g)
+	}
+	if g := value(icarusConfigChanged); g != 1500000000 {
+		t.Error(g)
+	}
+	// a change that is refused does not count.
+	if err := i.SetFloatFormat('x'); err == nil {
+		t.Error(err)
+	}
+	if g := value(icarusConfigChanges); g != before+2 {
+		t.Error(g)
+	}
+}
@@ -0,0 +1,113 @@
+package icarus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// Rejected is a sample icarus refused to store, and why.
+type Rejected struct {
+	Desc   map[string]string
+	Value  string
+	Time   int64
+	Reason string
+	At     int64
+}
+
+// DeadLetter is a small ring of the most recently rejected samples.
+type DeadLetter struct {
+	*sync.Mutex
+	Data  []Rejected
+	Index int
+	Full  bool
+}
+
+// NewDeadLetter makes a dead letter ring that holds size samples, at least one.
+func NewDeadLetter(size int) *DeadLetter {
+	if size < 1 {
+		size = 1
+	}
+	var mux sync.Mutex
+	return &DeadLetter{&mux, make([]Rejected, size), 0, false}
+}
+
+// Add puts a rejected sample in the ring, pushing out the oldest if full.
+func (d *DeadLetter) Add(met util.Metric, reason string) {
+	d.add(met, reason)
+}
+
+// add is Add, saying whether it pushed out a sample. The labels are copied
+// since ingest goes on rewriting them in place.
+func (d *DeadLetter) add(met util.Metric, reason string) bool {
+	d.Lock()
+	defer d.Unlock()
+	overflow := d.Full
+	d.Data[d.Index] = Rejected{copyMetric(met).Desc, strconv.FormatFloat(met.Data.Val, 'f', -1, 64),
+		met.Data.Time, reason, time.Now().Unix()}
+	if d.Index+1 == len(d.Data) {
+		d.Full = true
+	}
+	d.Index = (d.Index + 1) % len(d.Data)
+	return overflow
+}
+
+// Dump returns the rejected samples, oldest first.
+func (d *DeadLetter) Dump() []Rejected {
+	d.Lock()
+	defer d.Unlock()
+	count := d.Index
+	start := 0
+	if d.Full {
+		count = len(d.Data)
+		start = d.Index
+	}
+	out := make([]Rejected, count)
+	for ii := 0; ii < count; ii++ {
+		out[ii] = d.Data[(ii+start)%len(d.Data)]
+	}
+	return out
+}
+
+// EnableDeadLetter keeps the last size rejected samples for DeadLetterHandleFunc.
+// It is off until this is called, and holds at least one sample once it is.
+func (i *Icarus) EnableDeadLetter(size int) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.dead = NewDeadLetter(size)
+}
+
+func (i *Icarus) deadLetter() *DeadLetter {
+	i.recordMux.RLock()
+	defer i.recordMux.RUnlock()
+	return i.dead
+}
+
+// reject counts a sample that will not be stored, under one of the drop
+// reasons, and keeps it in the dead letter ring if there is one.
+func (i *Icarus) reject(met util.Metric, reason string) {
+	i.counterVec(icarusDroppedCounter).WithLabelValues(reason).Inc()
+	atomic.AddInt64(&i.rejectedSinceRollup, 1)
+	i.countError(dropKinds[reason])
+	if dead := i.deadLetter(); (dead != nil) && dead.add(met, reason) {
+		i.valves.trip(degradedDeadLetter)
+	}
+}
+
+// DeadLetterHandleFunc dumps the dead letter ring as json.
+func (i *Icarus) DeadLetterHandleFunc(w http.ResponseWriter, r *http.Request) {
+	dead := i.deadLetter()
+	if dead == nil {
+		fmt.Fprint(w, "dead letter buffer is not enabled")
+		return
+	}
+	out, _ := json.Marshal(dead.Dump())
+	fmt.Fprint(w, string(out))
+}
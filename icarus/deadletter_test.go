@@ -0,0 +1,61 @@
+package icarus
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestDeadLetterBounded(t *testing.T) {
+	d := NewDeadLetter(3)
+	for ii := 0; ii < 5; ii++ {
+		d.Add(helper(map[string]string{"__name__": "x"}, float64(ii)), errValidation)
+	}
+	g := d.Dump()
+	if len(g) != 3 {
+		t.Error(g)
+	}
+	for ii, x := range g {
+		if x.Value != []string{"2", "3", "4"}[ii] || x.Reason != errValidation {
+			t.Error(x)
+		}
+	}
+}
+
+func TestDeadLetterSize(t *testing.T) {
+	for _, size := range []int{-1, 0} {
+		d := NewDeadLetter(size)
+		desc := map[string]string{"__name__": "x"}
+		d.Add(helper(desc, 1), errValidation)
+		d.Add(helper(desc, 2), errValidation)
+		desc["__name__"] = "changed"
+		if g := d.Dump(); (len(g) != 1) || (g[0].Value != "2") || (g[0].Desc["__name__"] != "x") {
+			t.Error(size, g)
+		}
+	}
+}
+
+func TestDeadLetterRejects(t *testing.T) {
+	i := NewIcarus("ft_")
+	rw := util.NewHTTPResponseWriter()
+	r := &http.Request{Form: url.Values{}}
+	i.DeadLetterHandleFunc(rw, r)
+	if g := rw.String(); !strings.Contains(g, "not enabled") {
+		t.Error(g)
+	}
+
+	i.EnableDeadLetter(2)
+	i.Record(util.Metric{Data: util.DataPoint{Val: 7}})
+	eventually(t, func() bool { return len(i.dead.Dump()) == 1 })
+	if g := i.dead.Dump(); len(g) != 1 || g[0].Reason != errValidation || g[0].Value != "7" {
+		t.Error(g)
+	}
+	rw = util.NewHTTPResponseWriter()
+	i.DeadLetterHandleFunc(rw, r)
+	if g := rw.String(); !strings.Contains(g, `"Reason":"validation"`) {
+		t.Error(g)
+	}
+}
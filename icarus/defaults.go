@@ -0,0 +1,69 @@
+package icarus
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// defaultsCache holds the rendered default registry section between scrapes.
+type defaultsCache struct {
+	*sync.Mutex
+	ttl  time.Duration
+	page string
+	at   time.Time
+}
+
+// SetDefaultsCache keeps the rendered default registry section for up to ttl,
+// refreshing it on each rollup instead of on every scrape. That trades how
+// fresh those metrics are for CPU under frequent scrapes. Zero, the default,
+// renders it for every scrape.
+func (i *Icarus) SetDefaultsCache(ttl time.Duration) {
+	i.configChanged()
+	i.defaults.Lock()
+	defer i.defaults.Unlock()
+	i.defaults.ttl = ttl
+	i.defaults.page = ""
+	i.defaults.at = time.Time{}
+}
+
+// defaultSection is the default registry section, from the cache if it is
+// fresh enough. It is rendered without the lock, so scrapes gather side by side.
+func (i *Icarus) defaultSection() string {
+	i.defaults.Lock()
+	if (i.defaults.ttl > 0) && !i.defaults.at.IsZero() && (i.now().Sub(i.defaults.at) < i.defaults.ttl) {
+		page := i.defaults.page
+		i.defaults.Unlock()
+		return page
+	}
+	i.defaults.Unlock()
+	page := renderDefaults(i.envLabels)
+	i.cacheDefaults(page)
+	return page
+}
+
+// refreshDefaults re-renders a cached default registry section.
+func (i *Icarus) refreshDefaults() {
+	i.defaults.Lock()
+	caching := i.defaults.ttl > 0
+	i.defaults.Unlock()
+	if caching {
+		i.cacheDefaults(renderDefaults(i.envLabels))
+	}
+}
+
+// cacheDefaults keeps a rendered default registry section, when caching is on.
+func (i *Icarus) cacheDefaults(page string) {
+	i.defaults.Lock()
+	defer i.defaults.Unlock()
+	if i.defaults.ttl > 0 {
+		i.defaults.page, i.defaults.at = page, i.now()
+	}
+}
+
+// renderDefaults renders the default registry section with labels added.
+func renderDefaults(labels map[string]string) string {
+	useBuffer := bytes.NewBufferString("")
+	aggPromDefaults(useBuffer, labels)
+	return useBuffer.String()
+}
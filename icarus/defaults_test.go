@@ -0,0 +1,87 @@
+package icarus
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestDefaultsCache(t *testing.T) {
+	defer func(g prometheus.Gatherer) { gatherer = g }(gatherer)
+	gathers := 0
+	gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		gathers++
+		return nil, nil
+	})
+	scrape := func(i *Icarus) {
+		i.HandleFunc(util.NewHTTPResponseWriter(), &http.Request{Form: url.Values{}})
+	}
+	i := NewIcarus("ft_")
+	scrape(i)
+	scrape(i)
+	if gathers != 2 {
+		t.Error(gathers)
+	}
+
+	gathers = 0
+	now := time.Now()
+	i.now = func() time.Time { return now }
+	i.SetDefaultsCache(time.Minute)
+	scrape(i)
+	scrape(i)
+	if gathers != 1 {
+		t.Error(gathers)
+	}
+	i.rollup()
+	scrape(i)
+	if gathers != 2 {
+		t.Error(gathers)
+	}
+	now = now.Add(2 * time.Minute)
+	scrape(i)
+	if gathers != 3 {
+		t.Error(gathers)
+	}
+}
+
+// blockGathers has the default registry gather wait for release, saying when
+// each one starts on the returned channel.
+func blockGathers(release chan bool) chan bool {
+	inside := make(chan bool, 10)
+	gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		inside <- true
+		<-release
+		return nil, nil
+	})
+	return inside
+}
+
+func TestDefaultsConcurrent(t *testing.T) {
+	defer func(g prometheus.Gatherer) { gatherer = g }(gatherer)
+	release := make(chan bool)
+	inside := blockGathers(release)
+	i := NewIcarus("ft_")
+	done := make(chan bool)
+	for ii := 0; ii < 2; ii++ {
+		go func() {
+			i.defaultSection()
+			done <- true
+		}()
+	}
+	// without the cache, neither gather waits for the other.
+	for ii := 0; ii < 2; ii++ {
+		select {
+		case <-inside:
+		case <-time.After(time.Second):
+			t.Error("gathers waited for each other")
+		}
+	}
+	close(release)
+	<-done
+	<-done
+}
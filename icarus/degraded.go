@@ -0,0 +1,124 @@
+package icarus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// Reasons a rollup reports itself degraded, the reason label of <prefix>degraded.
+// These are the only valves icarus has: it has no circuit breaker and never
+// skips a rollup for size, so neither shows up here.
+const (
+	// degradedCardinality: the series cap turned away new series.
+	degradedCardinality = "cardinality"
+	// degradedDeadLetter: the dead letter ring overflowed and lost rejects.
+	degradedDeadLetter = "dead_letter"
+)
+
+// tripHistory is how many valve trips ValvesHandleFunc remembers.
+const tripHistory = 32
+
+// Trip is a safety valve going off, see ValvesHandleFunc.
+type Trip struct {
+	Reason string
+	// At is when it went off, unix seconds.
+	At int64
+}
+
+// valves remembers which safety valves tripped since the last rollup, and
+// the last few trips.
+type valves struct {
+	*sync.Mutex
+	tripped map[string]bool
+	history []Trip
+	now     func() time.Time
+}
+
+// trip notes a safety valve going off. A valve going off again before the
+// next rollup is the same trip.
+func (v *valves) trip(reason string) {
+	v.Lock()
+	defer v.Unlock()
+	if v.tripped[reason] {
+		return
+	}
+	v.tripped[reason] = true
+	if len(v.history) == tripHistory {
+		v.history = v.history[1:]
+	}
+	v.history = append(v.history, Trip{reason, v.now().Unix()})
+}
+
+// trips is a copy of the last few trips, oldest first.
+func (v *valves) trips() []Trip {
+	v.Lock()
+	defer v.Unlock()
+	return append([]Trip{}, v.history...)
+}
+
+// reset hands back what tripped, sorted, and forgets it.
+func (v *valves) reset() []string {
+	v.Lock()
+	defer v.Unlock()
+	out := make([]string, 0, len(v.tripped))
+	for reason := range v.tripped {
+		out = append(out, reason)
+	}
+	sort.Strings(out)
+	v.tripped = make(map[string]bool)
+	return out
+}
+
+// SetMaxSeries caps how many series a window may hold. Samples that would add
+// a series past the cap are rejected, and the rollup says it is degraded. Zero,
+// the default, is no cap.
+func (i *Icarus) SetMaxSeries(n int) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.maxSeries = n
+}
+
+// insert stores a sample unless the series cap turns it away.
+func (i *Icarus) insert(x util.Metric) bool {
+	i.recordMux.RLock()
+	max := i.maxSeries
+	i.recordMux.RUnlock()
+	if !i.Store.InsertCapped(x, max) {
+		i.valves.trip(degradedCardinality)
+		i.reject(x, dropCardinality)
+		return false
+	}
+	return true
+}
+
+// degraded is <prefix>degraded, 1 with a reason for each valve that tripped
+// since the last rollup or a single 0 if none did. Callers hold the icarus lock.
+func (i *Icarus) degraded() []util.Metric {
+	reasons := i.valves.reset()
+	if len(reasons) == 0 {
+		return []util.Metric{{Desc: map[string]string{"__name__": i.prefix + "degraded"}}}
+	}
+	out := make([]util.Metric, len(reasons))
+	for ii, reason := range reasons {
+		out[ii] = util.Metric{
+			Desc: map[string]string{"__name__": i.prefix + "degraded", "reason": reason},
+			Data: util.DataPoint{Val: 1},
+		}
+	}
+	return out
+}
+
+// ValvesHandleFunc shows the last few safety valve trips as json, oldest
+// first, for working out after the fact what went off when. A valve counts
+// once per rollup however often it goes off.
+func (i *Icarus) ValvesHandleFunc(w http.ResponseWriter, r *http.Request) {
+	out, _ := json.Marshal(i.valves.trips())
+	fmt.Fprint(w, string(out))
+}
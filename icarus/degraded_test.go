@@ -0,0 +1,86 @@
+package icarus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDegraded(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_degraded{} 0\n") {
+		t.Error(g)
+	}
+
+	i.SetMaxSeries(2)
+	rejected := value(icarusErrorCounter.WithLabelValues(errCardinality))
+	for _, name := range []string{"a", "b", "a", "c"} {
+		i.Record(helper(map[string]string{"__name__": name}, 1))
+	}
+	eventually(t, func() bool { return value(icarusErrorCounter.WithLabelValues(errCardinality)) == rejected+1 })
+	if g := len(i.Snapshot()); g != 2 {
+		t.Error(g)
+	}
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_degraded{reason=\"cardinality\"} 1\n") || strings.Contains(g, "ft_degraded{} 0") {
+		t.Error(g)
+	}
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_degraded{} 0\n") {
+		t.Error(g)
+	}
+}
+
+func TestDegradedDeadLetter(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.EnableDeadLetter(1)
+	i.reject(helper(map[string]string{"__name__": "a"}, 1), errValidation)
+	i.reject(helper(map[string]string{"__name__": "b"}, 1), errValidation)
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_degraded{reason=\"dead_letter\"} 1\n") {
+		t.Error(g)
+	}
+}
+
+func TestValvesHistory(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.EnableDeadLetter(1)
+	i.SetMaxSeries(1)
+	i.now = func() time.Time { return time.Unix(100, 0) }
+	i.Record(helper(map[string]string{"__name__": "a"}, 1))
+	i.Record(helper(map[string]string{"__name__": "b"}, 1))
+	i.Drain()
+	i.now = func() time.Time { return time.Unix(200, 0) }
+	// the ring got the first reject, the second overflows it.
+	i.reject(helper(map[string]string{"__name__": "d"}, 1), dropValidation)
+	w := httptest.NewRecorder()
+	i.ValvesHandleFunc(w, httptest.NewRequest("GET", "/valves", nil))
+	var g []Trip
+	if err := json.Unmarshal(w.Body.Bytes(), &g); err != nil {
+		t.Error(err, w.Body.String())
+	}
+	want := []Trip{{degradedCardinality, 100}, {degradedDeadLetter, 200}}
+	if fmt.Sprint(g) != fmt.Sprint(want) {
+		t.Error(g)
+	}
+	// the page is not where it shows.
+	i.rollup()
+	if g := i.servePage().Read(); strings.Contains(g, "\"At\"") {
+		t.Error(g)
+	}
+}
+
+func TestValvesHistoryBounded(t *testing.T) {
+	i := NewIcarus("ft_")
+	for ii := 0; ii < tripHistory+5; ii++ {
+		i.valves.trip(fmt.Sprint(ii))
+	}
+	g := i.valves.trips()
+	if (len(g) != tripHistory) || (g[0].Reason != "5") || (g[len(g)-1].Reason != fmt.Sprint(tripHistory+4)) {
+		t.Error(g)
+	}
+}
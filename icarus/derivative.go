@@ -0,0 +1,127 @@
+package icarus
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// derivatives keeps the last few points of chosen series to work out how
+// fast they change.
+type derivatives struct {
+	*sync.Mutex
+	keep    int
+	names   map[string]bool
+	history map[string]*pointRing
+}
+
+// pointRing is the last points of one series, oldest first.
+type pointRing struct {
+	desc   map[string]string
+	points []util.DataPoint
+}
+
+// SetDerivatives adds a <name>_derivative series, the change per second
+// between the two most recent points, for every series of the given names,
+// given without the prefix. The last keep points of each series are held,
+// at least 2. Points with a timestamp of their own use it, others the time
+// they were stored. A drop in value is taken as a counter reset, the
+// derivative counting up from 0. No names turns it off.
+func (i *Icarus) SetDerivatives(keep int, names ...string) {
+	i.configChanged()
+	i.derivs.Lock()
+	defer i.derivs.Unlock()
+	if keep < 2 {
+		keep = 2
+	}
+	i.derivs.keep = keep
+	i.derivs.names = make(map[string]bool, len(names))
+	for _, name := range names {
+		i.derivs.names[name] = true
+	}
+	i.derivs.history = make(map[string]*pointRing)
+}
+
+// observe notes the point of a stored sample if its name gets a derivative.
+func (i *Icarus) observe(x util.Metric) {
+	i.derivs.Lock()
+	defer i.derivs.Unlock()
+	if !i.derivs.names[i.unprefixed(x.Desc["__name__"])] {
+		return
+	}
+	point := x.Data
+	if point.Time == 0 {
+		point.Time = i.now().Unix()
+	}
+	key := util.MapSSToS(x.Desc)
+	ring, ok := i.derivs.history[key]
+	if !ok {
+		ring = &pointRing{desc: x.Desc}
+		i.derivs.history[key] = ring
+	}
+	ring.points = append(ring.points, point)
+	if len(ring.points) > i.derivs.keep {
+		ring.points = ring.points[len(ring.points)-i.derivs.keep:]
+	}
+}
+
+// derivative is the change per second between the newest point and the one
+// before it in time, false if there is no such pair.
+func (r *pointRing) derivative() (float64, bool) {
+	last := r.points[len(r.points)-1]
+	// points can share a second, so look back for an earlier one.
+	for ii := len(r.points) - 2; ii >= 0; ii-- {
+		prev := r.points[ii]
+		if prev.Time >= last.Time {
+			continue
+		}
+		change := last.Val - prev.Val
+		if change < 0 {
+			change = last.Val
+		}
+		return change / float64(last.Time-prev.Time), true
+	}
+	return 0, false
+}
+
+// flush is the derivative of every series still in the store, forgetting the
+// rest. Each is noted in seen as last updated with the series it is of.
+func (d *derivatives) flush(stored []util.Metric, seen lastSeen) []util.Metric {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.history) == 0 {
+		return nil
+	}
+	present := make(map[string]bool, len(stored))
+	for _, met := range stored {
+		present[util.MapSSToS(met.Desc)] = true
+	}
+	keys := make([]string, 0, len(d.history))
+	for key := range d.history {
+		if present[key] {
+			keys = append(keys, key)
+		} else {
+			delete(d.history, key)
+		}
+	}
+	sort.Strings(keys)
+	out := make([]util.Metric, 0, len(keys))
+	for _, key := range keys {
+		ring := d.history[key]
+		val, ok := ring.derivative()
+		if !ok {
+			continue
+		}
+		desc := make(map[string]string, len(ring.desc))
+		for k, v := range ring.desc {
+			desc[k] = v
+		}
+		desc["__name__"] += "_derivative"
+		if at, ok := seen.of(ring.desc); ok {
+			seen.note(desc, at)
+		}
+		out = append(out, util.Metric{Desc: desc, Data: util.DataPoint{Val: val}})
+	}
+	return out
+}
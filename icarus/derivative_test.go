@@ -0,0 +1,51 @@
+package icarus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestDerivative(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Unix(1500000000, 0)
+	i.now = func() time.Time { return now }
+	i.SetDerivatives(3, "bytes")
+	// 5 a second, however irregular the points.
+	for _, step := range []int64{0, 10, 15, 35} {
+		i.Record(util.Metric{Desc: map[string]string{"__name__": "bytes", "a": "b"},
+			Data: util.DataPoint{Val: float64(100 + 5*step), Time: 1500000000 + step}})
+		i.Record(helper(map[string]string{"__name__": "other"}, float64(step)))
+		i.Drain()
+		i.rollup()
+		g := i.servePage().Read()
+		if (step > 0) && !strings.Contains(g, "\nft_bytes_derivative{a=\"b\"} 5\n") {
+			t.Error(step, g)
+		}
+		if (step == 0) && strings.Contains(g, "_derivative") {
+			t.Error(g)
+		}
+		if strings.Contains(g, "ft_other_derivative") {
+			t.Error(g)
+		}
+	}
+	// a reset counts up from 0.
+	i.Record(util.Metric{Desc: map[string]string{"__name__": "bytes", "a": "b"},
+		Data: util.DataPoint{Val: 20, Time: 1500000039}})
+	i.Drain()
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_bytes_derivative{a=\"b\"} 5\n") {
+		t.Error(g)
+	}
+	// points in the same second look back to an earlier one, without a time they get the clock's.
+	now = time.Unix(1500000043, 0)
+	i.Record(helper(map[string]string{"__name__": "bytes", "a": "b"}, 40))
+	i.Record(helper(map[string]string{"__name__": "bytes", "a": "b"}, 40))
+	i.Drain()
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_bytes_derivative{a=\"b\"} 5\n") {
+		t.Error(g)
+	}
+}
@@ -0,0 +1,101 @@
+package icarus
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+
+	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	icarusSeriesHighWater = splitGauge(prometheus.GaugeOpts{
+		Name: "icarus_series_high_water",
+		Help: "What is the most series the store has held at a rollup?",
+	})
+	icarusSeriesSeen = splitGauge(prometheus.GaugeOpts{
+		Name: "icarus_series_seen_approx",
+		Help: "About how many distinct series has the store ever held?",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(icarusSeriesHighWater)
+	prometheus.MustRegister(icarusSeriesSeen)
+}
+
+// distinctBits picks how many of a hash's bits choose a register, 2^12
+// registers of a byte each give about 1.6% error whatever the churn.
+const distinctBits = 12
+
+// distinct approximately counts the distinct series ever stored, as a
+// HyperLogLog, and remembers the most there were at once.
+type distinct struct {
+	*sync.Mutex
+	registers []uint8
+	high      int
+}
+
+func newDistinct() *distinct {
+	var mux sync.Mutex
+	return &distinct{&mux, make([]uint8, 1<<distinctBits), 0}
+}
+
+// observe notes a stored series.
+func (d *distinct) observe(desc map[string]string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(util.MapSSToS(desc)))
+	h := mix(hash.Sum64())
+	index := h >> (64 - distinctBits)
+	// the rest of the bits, with a stop so the rank is at most 64-distinctBits+1.
+	rank := uint8(bits.LeadingZeros64((h<<distinctBits)|(1<<(distinctBits-1))) + 1)
+	d.Lock()
+	defer d.Unlock()
+	if rank > d.registers[index] {
+		d.registers[index] = rank
+	}
+}
+
+// mix spreads fnv's bits, which are weak for short similar keys, across the hash.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
+
+// estimate is about how many distinct series have been observed.
+func (d *distinct) estimate() float64 {
+	d.Lock()
+	defer d.Unlock()
+	m := float64(len(d.registers))
+	sum, zeros := 0., 0.
+	for _, rank := range d.registers {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// few series leave most registers empty, which counts better.
+	if (estimate <= 2.5*m) && (zeros > 0) {
+		estimate = m * math.Log(m/zeros)
+	}
+	return estimate
+}
+
+// rolledUp notes how many series a rollup found and sets the high water and
+// distinct series gauges.
+func (d *distinct) rolledUp(series int, highWater, seen prometheus.Gauge) {
+	d.Lock()
+	if series > d.high {
+		d.high = series
+	}
+	high := d.high
+	d.Unlock()
+	highWater.Set(float64(high))
+	seen.Set(d.estimate())
+}
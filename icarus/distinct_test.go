@@ -0,0 +1,45 @@
+package icarus
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestDistinct(t *testing.T) {
+	i := NewIcarus("ft_")
+	// 3000 series over time, never more than 1000 at once.
+	for round := 0; round < 3; round++ {
+		for ii := 0; ii < 1000; ii++ {
+			i.Record(helper(map[string]string{"__name__": "x", "round": strconv.Itoa(round), "n": strconv.Itoa(ii)}, 1))
+		}
+		i.Drain()
+		i.rollup()
+		if g := value(icarusSeriesHighWater); g != 1000 {
+			t.Error(round, g)
+		}
+		i.Store.Delete(func(map[string]string) bool { return true })
+	}
+	i.rollup()
+	if g := value(icarusSeriesHighWater); g != 1000 {
+		t.Error(g)
+	}
+	if g := value(icarusSeriesSeen); math.Abs(g-3000) > 300 {
+		t.Error(g)
+	}
+}
+
+func TestDistinctEstimate(t *testing.T) {
+	d := newDistinct()
+	if g := d.estimate(); g != 0 {
+		t.Error(g)
+	}
+	for ii := 0; ii < 20; ii++ {
+		// the same series again changes nothing.
+		d.observe(map[string]string{"a": strconv.Itoa(ii)})
+		d.observe(map[string]string{"a": strconv.Itoa(ii)})
+	}
+	if g := d.estimate(); math.Abs(g-20) > 2 {
+		t.Error(g)
+	}
+}
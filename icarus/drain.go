@@ -0,0 +1,263 @@
+package icarus
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrClosed is what TryRecord says once Close has been called.
+var ErrClosed = errors.New("icarus is closed")
+
+var icarusInlineFlushed = splitCounter(prometheus.CounterOpts{
+	Name: "icarus_inline_flushed_total",
+	Help: "How many samples were ingested by Record itself on finding the channel full?",
+})
+
+func init() {
+	prometheus.MustRegister(icarusInlineFlushed)
+}
+
+// flow keeps track of samples on their way from Record into the store, so
+// Drain can wait for them to land.
+type flow struct {
+	*sync.Mutex
+	cond      *sync.Cond
+	sent      uint64
+	landed    uint64
+	consumers int
+	// closing stops the consumers, drained then stops the rollups.
+	closing   chan bool
+	drained   chan bool
+	closeOnce *sync.Once
+	// closedAt is when Close was called, grace how long the page outlives it.
+	closedAt time.Time
+	grace    time.Duration
+	// gate is held shared around sends on the ingest channel and exclusively
+	// by Close to shut it, after which shut is set.
+	gate *sync.RWMutex
+	shut bool
+	// batches is held shared by ingest requests while they record and
+	// exclusively by Close to refuse any later ones, after which refusing is set.
+	batches  *sync.RWMutex
+	refusing bool
+}
+
+func newFlow() *flow {
+	var mux sync.Mutex
+	var once sync.Once
+	var gate sync.RWMutex
+	var batches sync.RWMutex
+	return &flow{gate: &gate, batches: &batches, Mutex: &mux, cond: sync.NewCond(&mux), closing: make(chan bool),
+		drained: make(chan bool), closeOnce: &once}
+}
+
+// send notes a sample going into the ingest channel.
+func (f *flow) send() {
+	f.Lock()
+	defer f.Unlock()
+	f.sent++
+}
+
+// land notes start being done with a sample, stored or not.
+func (f *flow) land() {
+	f.Lock()
+	defer f.Unlock()
+	f.landed++
+	f.cond.Broadcast()
+}
+
+// consumerDone notes a ConsumeChannel goroutine returning.
+func (f *flow) consumerDone() {
+	f.Lock()
+	defer f.Unlock()
+	f.consumers--
+	f.cond.Broadcast()
+}
+
+// beginBatch holds off Close while an ingest request records a batch, so
+// the batch lands whole. It says false, holding nothing, once Close has
+// started and the batch should be refused instead.
+func (f *flow) beginBatch() bool {
+	f.batches.RLock()
+	if f.refusing {
+		f.batches.RUnlock()
+		return false
+	}
+	return true
+}
+
+// endBatch lets Close go ahead once a batch is recorded.
+func (f *flow) endBatch() {
+	f.batches.RUnlock()
+}
+
+// mark is how many samples have been sent so far, for waitFor.
+func (f *flow) mark() uint64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.sent
+}
+
+// waitFor waits up to timeout for the first target samples sent to land, and
+// says whether they did. It gives up early once Close has drained.
+func (f *flow) waitFor(target uint64, timeout time.Duration) bool {
+	done := make(chan bool)
+	landed := make(chan bool, 1)
+	go func() {
+		f.Lock()
+		defer f.Unlock()
+		for (f.landed < target) && !stopped(done) && !stopped(f.drained) {
+			f.cond.Wait()
+		}
+		landed <- f.landed >= target
+	}()
+	defer f.wake(done)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-landed:
+		return ok
+	case <-timer.C:
+		return false
+	}
+}
+
+// wake closes done and wakes anything waiting on the flow to notice.
+func (f *flow) wake(done chan bool) {
+	close(done)
+	f.Lock()
+	defer f.Unlock()
+	f.cond.Broadcast()
+}
+
+// stopped says whether ch is closed.
+func stopped(ch chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// ConsumeChannel records everything sent on ch until the caller closes it, or
+// until Close. Drain waits for ch to be closed and everything on it recorded.
+func (i *Icarus) ConsumeChannel(ch <-chan util.Metric) {
+	i.flow.Lock()
+	i.flow.consumers++
+	i.flow.Unlock()
+	go func() {
+		defer i.flow.consumerDone()
+		for {
+			select {
+			case x, ok := <-ch:
+				if !ok {
+					return
+				}
+				i.Record(x)
+			case <-i.flow.closing:
+				return
+			}
+		}
+	}()
+}
+
+// Drain waits until every consumed channel is closed and everything recorded
+// so far, by Record or those channels, has made it through ingest.
+func (i *Icarus) Drain() {
+	i.flow.Lock()
+	defer i.flow.Unlock()
+	for i.flow.consumers > 0 {
+		i.flow.cond.Wait()
+	}
+	target := i.flow.sent
+	for i.flow.landed < target {
+		i.flow.cond.Wait()
+	}
+}
+
+// Close stops consuming channels, waits for ingest requests part way through
+// recording their batch and refuses later ones with a 503, drains what was
+// already recorded, shuts ingest so later records are dropped and stops the
+// rollup ticker after a final rollup. The last page keeps being
+// served, see SetCloseGrace.
+func (i *Icarus) Close() {
+	i.flow.closeOnce.Do(func() {
+		i.flow.Lock()
+		i.flow.closedAt = i.now()
+		i.flow.Unlock()
+		close(i.flow.closing)
+		i.flow.batches.Lock()
+		i.flow.refusing = true
+		i.flow.batches.Unlock()
+		i.Drain()
+		i.flow.gate.Lock()
+		i.flow.shut = true
+		close(i.Chan)
+		i.flow.gate.Unlock()
+		close(i.flow.drained)
+		i.flow.Lock()
+		i.flow.cond.Broadcast()
+		i.flow.Unlock()
+	})
+	<-i.stopped
+}
+
+// SetCloseGrace keeps serving the last page for grace after Close, so a final
+// scrape can collect it, then answers scrapes with a 503. Zero, the default,
+// serves the last page for as long as the process lives.
+func (i *Icarus) SetCloseGrace(grace time.Duration) {
+	i.configChanged()
+	i.flow.Lock()
+	defer i.flow.Unlock()
+	i.flow.grace = grace
+}
+
+// closedFor says whether Close was called and, if so, whether the grace is up.
+func (i *Icarus) closedFor() (closed, expired bool) {
+	i.flow.Lock()
+	defer i.flow.Unlock()
+	if i.flow.closedAt.IsZero() {
+		return false, false
+	}
+	return true, (i.flow.grace > 0) && (i.now().Sub(i.flow.closedAt) > i.flow.grace)
+}
+
+// SetInlineFlush has a Record that finds the channel full ingest what is
+// waiting in it itself, then go on, rather than wait for the ingest goroutine
+// to make room. Nothing is dropped and Record's latency stays bounded, at the
+// cost of the odd Record doing some ingest work. Off by default.
+func (i *Icarus) SetInlineFlush(on bool) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.inlineFlush = on
+}
+
+// inline says if SetInlineFlush is on.
+func (i *Icarus) inline() bool {
+	i.recordMux.RLock()
+	defer i.recordMux.RUnlock()
+	return i.inlineFlush
+}
+
+// flushInline ingests whatever is waiting in the channel, on the caller's
+// goroutine. Callers hold the gate, so Close cannot close the channel under it.
+func (i *Icarus) flushInline() {
+	for {
+		select {
+		case x, ok := <-i.Chan:
+			if !ok {
+				return
+			}
+			i.counter(icarusInlineFlushed).Inc()
+			i.consume(x)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package icarus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestConsumeChannel(t *testing.T) {
+	i := NewIcarus("ft_")
+	ch := make(chan util.Metric)
+	i.ConsumeChannel(ch)
+	done := make(chan bool)
+	go func() {
+		i.Drain()
+		close(done)
+	}()
+	for ii := 0; ii < 50; ii++ {
+		ch <- helper(map[string]string{"__name__": fmt.Sprintf("x%v", ii)}, 1)
+	}
+	select {
+	case <-done:
+		t.Error("drained before the channel closed")
+	default:
+	}
+	close(ch)
+	<-done
+	if g := len(i.Snapshot()); g != 50 {
+		t.Error(g)
+	}
+}
+
+func TestClose(t *testing.T) {
+	i := NewIcarus("ft_")
+	ch := make(chan util.Metric)
+	i.ConsumeChannel(ch)
+	ch <- helper(map[string]string{"__name__": "x"}, 1)
+	i.Record(helper(map[string]string{"__name__": "y"}, 2))
+	i.Close()
+	if g := len(i.Snapshot()); g != 2 {
+		t.Error(g)
+	}
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_x{} 1\n") || !strings.Contains(g, "\nft_y{} 2\n") {
+		t.Error(g)
+	}
+	// Closing again is harmless, and the caller's channel is no longer read.
+	i.Close()
+	select {
+	case ch <- helper(map[string]string{"__name__": "z"}, 1):
+		t.Error("still consuming")
+	default:
+	}
+}
+
+func TestWaitForGivesUp(t *testing.T) {
+	f := newFlow()
+	before := runtime.NumGoroutine()
+	if f.waitFor(1, time.Millisecond) {
+		t.Error("nothing was sent")
+	}
+	// the waiting goroutine goes with the timeout.
+	eventually(t, func() bool { return runtime.NumGoroutine() <= before })
+
+	i := NewIcarus("ft_")
+	waited := make(chan bool)
+	go func() { waited <- i.flow.waitFor(i.flow.mark()+1, time.Hour) }()
+	i.Close()
+	select {
+	case ok := <-waited:
+		if ok {
+			t.Error("nothing landed")
+		}
+	case <-time.After(time.Second):
+		t.Error("still waiting after Close")
+	}
+}
+
+func TestCloseGrace(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Now()
+	i.now = func() time.Time { return now }
+	i.SetCloseGrace(time.Minute)
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.Close()
+	scrape := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		i.HandleFunc(rw, httptest.NewRequest("GET", "/metrics", nil))
+		return rw
+	}
+	now = now.Add(30 * time.Second)
+	rw := scrape()
+	if g := rw.Body.String(); (rw.Code != http.StatusOK) || !strings.Contains(g, "\nft_x{} 1\n") || !strings.Contains(g, "# icarus is closed") {
+		t.Error(rw.Code, g)
+	}
+	now = now.Add(time.Minute)
+	if rw := scrape(); rw.Code != http.StatusServiceUnavailable {
+		t.Error(rw.Code)
+	}
+}
+
+// TestRecordWhileClosing is meant for go test -race.
+func TestRecordWhileClosing(t *testing.T) {
+	i := NewIcarus("ft_")
+	standby := NewIcarus("ft_")
+	i.Mirror(standby)
+	var wg sync.WaitGroup
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func(ii int) {
+			defer wg.Done()
+			for jj := 0; jj < 200; jj++ {
+				i.Record(helper(map[string]string{"__name__": "x", "n": fmt.Sprint(ii)}, 1))
+			}
+		}(ii)
+	}
+	go standby.Close()
+	i.Close()
+	wg.Wait()
+	if err := i.TryRecord(helper(map[string]string{"__name__": "x"}, 1)); err != ErrClosed {
+		t.Error(err)
+	}
+}
+
+func TestInlineFlush(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetInlineFlush(true)
+	before := value(icarusInlineFlushed)
+	// the ingest goroutine gets stuck on the first sample and the second fills the channel.
+	i.Store.Lock()
+	i.Record(helper(map[string]string{"__name__": "x", "n": "1"}, 1))
+	eventually(t, func() bool { return len(i.Chan) == 0 })
+	i.Record(helper(map[string]string{"__name__": "x", "n": "2"}, 1))
+	done := make(chan bool)
+	go func() {
+		i.Record(helper(map[string]string{"__name__": "x", "n": "3"}, 1))
+		close(done)
+	}()
+	eventually(t, func() bool { return value(icarusInlineFlushed) == before+1 })
+	i.Store.Unlock()
+	<-done
+	i.Drain()
+	if g := len(i.Snapshot()); g != 3 {
+		t.Error(g)
+	}
+}
+
+func TestIngestDuringClose(t *testing.T) {
+	i := NewIcarus("ft_")
+	const batches, size = 40, 20
+	codes := make([]int, batches)
+	var wg sync.WaitGroup
+	for b := 0; b < batches; b++ {
+		var mets []string
+		for ii := 0; ii < size; ii++ {
+			mets = append(mets, fmt.Sprintf(`{"Desc": {"__name__": "x", "batch": "%v", "n": "%v"}, "Data": {"Val": 1}}`, b, ii))
+		}
+		body := "[" + strings.Join(mets, ",") + "]"
+		wg.Add(1)
+		go func(b int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			i.IngestHandleFunc(w, httptest.NewRequest("POST", "/ingest", strings.NewReader(body)))
+			codes[b] = w.Code
+		}(b)
+		if b == batches/2 {
+			go i.Close()
+		}
+	}
+	wg.Wait()
+	i.Close()
+	landed := map[string]int{}
+	for _, met := range i.Snapshot() {
+		landed[met.Desc["batch"]]++
+	}
+	for b, code := range codes {
+		got := landed[fmt.Sprint(b)]
+		if ((code == http.StatusOK) && (got != size)) || ((code == http.StatusServiceUnavailable) && (got != 0)) ||
+			((code != http.StatusOK) && (code != http.StatusServiceUnavailable)) {
+			t.Error(b, code, got)
+		}
+	}
+	w := httptest.NewRecorder()
+	i.IngestHandleFunc(w, httptest.NewRequest("POST", "/ingest", strings.NewReader(`[{"Desc": {"__name__": "late"}}]`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error(w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,84 @@
+package icarus
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	icarusDroppedCounter = splitCounterVec(prometheus.CounterOpts{
+		Name: "icarus_dropped_total",
+		Help: "How many samples were thrown away, or left off a page, by reason?",
+	}, []string{"reason"})
+	icarusRejectRatio = splitGauge(prometheus.GaugeOpts{
+		Name: "icarus_reject_ratio",
+		Help: "How many samples were thrown away for each one stored, over the last rollup interval?",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(icarusDroppedCounter)
+	prometheus.MustRegister(icarusRejectRatio)
+}
+
+// The reason label values of icarus_dropped_total. Every sample icarus throws
+// away counts under exactly one of these, whichever path dropped it. There is
+// no rate limiter, so nothing drops for rate.
+const (
+	// dropClosed: the sample was recorded after Close.
+	dropClosed = "closed"
+	// dropChannelFull: a mirrored sample found the standby's channel full.
+	dropChannelFull = "channel_full"
+	// dropByteBudget: the sample would have gone past SetMaxInflightBytes.
+	dropByteBudget = "byte_budget"
+	// dropOversize: the sample was bigger than SetMaxMetricBytes.
+	dropOversize = "oversize"
+	// dropCardinality: the sample would have created a series past SetMaxSeries.
+	dropCardinality = "cardinality"
+	// dropValidation: the sample was malformed, had an empty key under
+	// SetRejectEmptyKeys or a timestamp outside SetTimestampBounds.
+	dropValidation = "validation"
+	// dropUnnamed: the sample had no name and SetUnnamed said to drop it.
+	dropUnnamed = "unnamed"
+	// dropMissingLabel: the sample lacked one of the labels NewIcarus requires.
+	dropMissingLabel = "missing_label"
+	// dropNaN: a stored series was left off a page for being NaN, counted at
+	// every rollup that leaves it off. It stays in the store.
+	dropNaN = "nan"
+)
+
+// dropKinds is the icarus_error_counter type each drop reason counts under.
+// A NaN left off a page is not an error.
+var dropKinds = map[string]string{
+	dropClosed:       errDropped,
+	dropChannelFull:  errDropped,
+	dropByteBudget:   errDropped,
+	dropOversize:     errValidation,
+	dropCardinality:  errCardinality,
+	dropValidation:   errValidation,
+	dropUnnamed:      errValidation,
+	dropMissingLabel: errMissingLabel,
+}
+
+// countNaN counts a NaN series left off a page. It is not a reject: the
+// series is still stored, so it neither reaches the dead letter ring nor the
+// reject ratio.
+func (i *Icarus) countNaN() {
+	i.counterVec(icarusDroppedCounter).WithLabelValues(dropNaN).Inc()
+}
+
+// rejectRatio sets icarus_reject_ratio from how many samples were stored
+// and thrown away since the last rollup. Throwing samples away while storing
+// none is an infinite ratio, an interval with neither is zero.
+func (i *Icarus) rejectRatio(stored, rejected int64) {
+	ratio := i.gauge(icarusRejectRatio)
+	switch {
+	case stored > 0:
+		ratio.Set(float64(rejected) / float64(stored))
+	case rejected > 0:
+		ratio.Set(math.Inf(1))
+	default:
+		ratio.Set(0)
+	}
+}
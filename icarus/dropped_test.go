@@ -0,0 +1,89 @@
+package icarus
+
+import (
+	"math"
+	"testing"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestDropped(t *testing.T) {
+	dropped := func(reason string) float64 { return value(icarusDroppedCounter.WithLabelValues(reason)) }
+
+	i := NewIcarus("ft_", "team")
+	i.SetMaxSeries(1)
+	before := dropped(dropValidation)
+	i.Record(util.Metric{})
+	i.Drain()
+	if g := dropped(dropValidation); g != before+1 {
+		t.Error(g)
+	}
+	before = dropped(dropMissingLabel)
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.Drain()
+	if g := dropped(dropMissingLabel); g != before+1 {
+		t.Error(g)
+	}
+	before = dropped(dropCardinality)
+	i.Record(helper(map[string]string{"__name__": "x", "team": "a"}, 1))
+	i.Record(helper(map[string]string{"__name__": "x", "team": "b"}, 1))
+	i.Drain()
+	if g := dropped(dropCardinality); g != before+1 {
+		t.Error(g)
+	}
+	before = dropped(dropNaN)
+	i.Record(helper(map[string]string{"__name__": "x", "team": "a"}, math.NaN()))
+	i.Drain()
+	i.rollup()
+	if g := dropped(dropNaN); g != before+1 {
+		t.Error(g)
+	}
+	before = dropped(dropClosed)
+	i.Close()
+	i.Record(helper(map[string]string{"__name__": "x", "team": "a"}, 1))
+	if g := dropped(dropClosed); g != before+1 {
+		t.Error(g)
+	}
+
+	primary := NewIcarus("ft_")
+	standby := NewIcarus("ft_")
+	primary.Mirror(standby)
+	before = dropped(dropChannelFull)
+	standby.Store.Lock()
+	for _, val := range []string{"1", "2", "3", "4"} {
+		primary.Record(helper(map[string]string{"__name__": "x", "a": val}, 1))
+	}
+	primary.Drain()
+	standby.Store.Unlock()
+	if g := dropped(dropChannelFull); g <= before {
+		t.Error(g)
+	}
+}
+
+func TestRejectRatio(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.rollup()
+	for ii := 0; ii < 4; ii++ {
+		i.Record(helper(map[string]string{"__name__": "x", "n": string(rune('a' + ii))}, 1))
+	}
+	i.Record(util.Metric{})
+	i.Record(util.Metric{})
+	i.Drain()
+	i.rollup()
+	if g := value(icarusRejectRatio); g != 0.5 {
+		t.Error(g)
+	}
+	// only the last interval counts.
+	i.Record(helper(map[string]string{"__name__": "x", "n": "a"}, 2))
+	i.Drain()
+	i.rollup()
+	if g := value(icarusRejectRatio); g != 0 {
+		t.Error(g)
+	}
+	i.Record(util.Metric{})
+	i.Drain()
+	i.rollup()
+	if g := value(icarusRejectRatio); !math.IsInf(g, 1) {
+		t.Error(g)
+	}
+}
@@ -0,0 +1,94 @@
+package icarus
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var icarusDuplicateKeyCounter = splitCounterVec(prometheus.CounterOpts{
+	Name: "icarus_duplicate_label_key_counter",
+	Help: "How many ingested samples gave a label key more than once, and what happened to them?",
+}, []string{"action"})
+
+func init() {
+	prometheus.MustRegister(icarusDuplicateKeyCounter)
+}
+
+// DuplicateKeys decides what IngestHandleFunc does with a sample whose json
+// gives the same label key more than once.
+type DuplicateKeys int
+
+const (
+	// DuplicateKeepLast keeps the last value given, as encoding/json does.
+	DuplicateKeepLast DuplicateKeys = iota
+	// DuplicateKeepFirst keeps the first value given.
+	DuplicateKeepFirst
+	// DuplicateReject refuses the sample.
+	DuplicateReject
+)
+
+func (d DuplicateKeys) String() string {
+	switch d {
+	case DuplicateKeepFirst:
+		return "kept_first"
+	case DuplicateReject:
+		return "rejected"
+	}
+	return "kept_last"
+}
+
+// SetDuplicateKeys picks what happens to ingested samples with a label key
+// given twice. Either way they are counted.
+func (i *Icarus) SetDuplicateKeys(policy DuplicateKeys) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.duplicateKeys = policy
+}
+
+// firstDesc is the labels of a sample as first given, and how many keys repeated.
+type firstDesc struct {
+	labels     map[string]string
+	duplicates int
+}
+
+// UnmarshalJSON walks the keys as they come, which a map cannot.
+func (f *firstDesc) UnmarshalJSON(data []byte) error {
+	f.labels = make(map[string]string)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); (err != nil) || (tok != json.Delim('{')) {
+		// not an object, the plain decode has the error to report.
+		return nil
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var val string
+		if err := dec.Decode(&val); err != nil {
+			return err
+		}
+		key := tok.(string)
+		if _, ok := f.labels[key]; ok {
+			f.duplicates++
+			continue
+		}
+		f.labels[key] = val
+	}
+	return nil
+}
+
+// firstLabels is the labels of each sample in an ingest body as first given.
+// Bodies that decode as metrics decode as this too.
+func firstLabels(body []byte) []firstDesc {
+	var out []struct{ Desc firstDesc }
+	json.Unmarshal(body, &out)
+	descs := make([]firstDesc, len(out))
+	for ii := range out {
+		descs[ii] = out[ii].Desc
+	}
+	return descs
+}
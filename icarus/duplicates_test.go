@@ -0,0 +1,48 @@
+package icarus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDuplicateKeys(t *testing.T) {
+	body := `[{"Desc":{"__name__":"x","a":"first","a":"last"},"Data":{"Val":2}},` +
+		`{"Desc":{"__name__":"y","a":"b"},"Data":{"Val":3}}]`
+	for _, test := range []struct {
+		policy DuplicateKeys
+		want   string
+	}{
+		{DuplicateKeepLast, "last"},
+		{DuplicateKeepFirst, "first"},
+		{DuplicateReject, ""},
+	} {
+		i := NewIcarus("ft_")
+		i.EnableDeadLetter(2)
+		i.SetDuplicateKeys(test.policy)
+		before := value(icarusDuplicateKeyCounter.WithLabelValues(test.policy.String()))
+		rw := httptest.NewRecorder()
+		i.IngestHandleFunc(rw, httptest.NewRequest("POST", "/ingest", strings.NewReader(body)))
+		i.Drain()
+		got := map[string]string{}
+		for _, met := range i.Snapshot() {
+			got[met.Desc["__name__"]] = met.Desc["a"]
+		}
+		if (got["ft_x"] != test.want) || (got["ft_y"] != "b") {
+			t.Error(test.policy, got)
+		}
+		if g := value(icarusDuplicateKeyCounter.WithLabelValues(test.policy.String())); g != before+1 {
+			t.Error(test.policy, g)
+		}
+		if g := len(i.dead.Dump()); (test.policy == DuplicateReject) != (g == 1) {
+			t.Error(test.policy, g)
+		}
+	}
+}
+
+func TestFirstLabels(t *testing.T) {
+	g := firstLabels([]byte(`[{"desc":{"a":"1","b":"2","a":"3","a":"4"}},{}]`))
+	if (len(g) != 2) || (g[0].labels["a"] != "1") || (g[0].duplicates != 2) || (len(g[1].labels) != 0) {
+		t.Error(g)
+	}
+}
@@ -0,0 +1,49 @@
+package icarus
+
+import "github.com/luuphu25/data-sidecar/util"
+
+// EmptyMode decides what a rollup serves when the store holds no series.
+type EmptyMode int
+
+const (
+	// EmptyNothing serves an empty icarus section.
+	EmptyNothing EmptyMode = iota
+	// EmptySentinel serves <prefix>up 0, so an idle sidecar can be told apart
+	// from a broken one.
+	EmptySentinel
+	// EmptyComment serves a comment saying the store is empty.
+	EmptyComment
+)
+
+func (m EmptyMode) String() string {
+	switch m {
+	case EmptySentinel:
+		return "sentinel"
+	case EmptyComment:
+		return "comment"
+	}
+	return "nothing"
+}
+
+// SetEmptyMode picks what is served while the store is empty.
+func (i *Icarus) SetEmptyMode(mode EmptyMode) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.empty = mode
+}
+
+// emptySection is what the empty mode adds to a rollup with no series.
+// Callers hold the icarus lock.
+func (i *Icarus) emptySection() string {
+	switch i.empty {
+	case EmptySentinel:
+		if len(i.envLabels) > 0 {
+			return i.format.metric(i.withEnvLabels(util.Metric{Desc: map[string]string{"__name__": i.prefix + "up"}}))
+		}
+		return i.prefix + "up 0\n"
+	case EmptyComment:
+		return "# icarus store is empty\n"
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package icarus
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmptyMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode EmptyMode
+		want string
+	}{
+		{EmptyNothing, ""},
+		{EmptySentinel, "\nft_up 0\n"},
+		{EmptyComment, "\n# icarus store is empty\n"},
+	} {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			i := NewIcarus("ft_")
+			i.SetEmptyMode(tc.mode)
+			i.rollup()
+			page := i.servePage().Read()
+			if (tc.want != "") && !strings.Contains(page, tc.want) {
+				t.Error(page)
+			}
+			if (tc.mode != EmptySentinel) && strings.Contains(page, "ft_up") {
+				t.Error(page)
+			}
+			if (tc.mode != EmptyComment) && strings.Contains(page, "empty") {
+				t.Error(page)
+			}
+
+			i.Record(helper(map[string]string{"__name__": "x"}, 1))
+			eventually(t, func() bool { return len(i.Snapshot()) == 1 })
+			i.rollup()
+			page = i.servePage().Read()
+			if strings.Contains(page, "ft_up") || strings.Contains(page, "empty") {
+				t.Error(page)
+			}
+		})
+	}
+}
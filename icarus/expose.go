@@ -0,0 +1,195 @@
+package icarus
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	icarusNameTruncatedCounter = splitCounter(prometheus.CounterOpts{
+		Name: "icarus_name_truncated_counter",
+		Help: "How many served metrics had their name truncated for length?",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(icarusNameTruncatedCounter)
+}
+
+// invalidNameChars are the characters not allowed in a prometheus metric name.
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// prefixRoute exposes metrics carrying label=value under another prefix.
+type prefixRoute struct {
+	label  string
+	value  string
+	prefix string
+}
+
+// AddPrefixRoute exposes metrics whose label has the given value under prefix
+// rather than the default one. Routes are tried in the order they were added
+// and only change what is served, not what is stored.
+func (i *Icarus) AddPrefixRoute(label, value, prefix string) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.routes = append(i.routes, prefixRoute{label, value, prefix})
+}
+
+// nameTemplate composes an exposed name from a base name and label values.
+type nameTemplate struct {
+	labels []string
+	drop   bool
+}
+
+// AddNameTemplate exposes metrics named name (without the prefix) under the
+// name joined with the values of labels by underscores, so name=requests with
+// verb=GET becomes requests_GET. Missing labels are skipped and the result is
+// sanitized; if it still is not a valid name the metric is served unchanged.
+// With drop the source labels are left out of the served series.
+func (i *Icarus) AddNameTemplate(name string, drop bool, labels ...string) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.templates[name] = nameTemplate{labels, drop}
+}
+
+// templated applies a name template to met, which it may modify.
+func (i *Icarus) templated(met util.Metric) util.Metric {
+	tmpl, ok := i.templates[i.unprefixed(met.Desc["__name__"])]
+	if !ok {
+		return met
+	}
+	parts := []string{met.Desc["__name__"]}
+	for _, label := range tmpl.labels {
+		if val, ok := met.Desc[label]; ok && (val != "") {
+			parts = append(parts, val)
+		}
+	}
+	name := invalidNameChars.ReplaceAllString(strings.Join(parts, "_"), "_")
+	if (name == "") || ((name[0] >= '0') && (name[0] <= '9')) {
+		return met
+	}
+	met = copyMetric(met)
+	met.Desc["__name__"] = name
+	if tmpl.drop {
+		for _, label := range tmpl.labels {
+			delete(met.Desc, label)
+		}
+	}
+	return met
+}
+
+// expose rewrites a stored metric into what gets served. The stored labels are
+// never touched. Callers hold the icarus lock.
+func (i *Icarus) expose(met util.Metric) util.Metric {
+	// templates are keyed by the name under the default prefix and may drop
+	// the label a route matches, so routes look at the stored labels and
+	// swap the prefix of the templated name.
+	stored := met
+	met = i.templated(met)
+	for _, route := range i.routes {
+		if val, ok := stored.Desc[route.label]; ok && (val == route.value) {
+			met = copyMetric(met)
+			met.Desc["__name__"] = route.prefix + i.unprefixed(met.Desc["__name__"])
+			break
+		}
+	}
+	met = i.withEnvLabels(met)
+	if name := met.Desc["__name__"]; (i.maxName > 0) && (len(name) > i.maxName) {
+		met = copyMetric(met)
+		met.Desc["__name__"] = truncateName(name, i.maxName)
+		i.counter(icarusNameTruncatedCounter).Inc()
+	}
+	return met
+}
+
+// envLabelsVar is the environment variable an icarus reads its environment
+// labels from when it is made: comma separated VARIABLE=label pairs, e.g.
+// HOSTNAME=host,ZONE=zone. Each adds a constant label to every served metric,
+// the default registry's too, valued as the variable was then. Unset or empty
+// variables, and malformed pairs, add no label. A metric already carrying the
+// label keeps its own value.
+const envLabelsVar = "ICARUS_ENV_LABELS"
+
+// readEnvLabels is the environment labels envLabelsVar asks for.
+func readEnvLabels() map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(envLabelsVar), ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if (len(parts) != 2) || (labelName.FindString(parts[1]) != parts[1]) {
+			continue
+		}
+		if val, ok := os.LookupEnv(parts[0]); ok && (val != "") {
+			labels[parts[1]] = val
+		}
+	}
+	return labels
+}
+
+// withEnvLabels adds the environment labels to met, which it may modify.
+func (i *Icarus) withEnvLabels(met util.Metric) util.Metric {
+	if len(i.envLabels) == 0 {
+		return met
+	}
+	met = copyMetric(met)
+	for label, val := range i.envLabels {
+		if _, ok := met.Desc[label]; !ok {
+			met.Desc[label] = val
+		}
+	}
+	return met
+}
+
+// hashSuffix is the length of the hash a truncated name ends in, underscore included.
+const hashSuffix = 17
+
+// SetMaxNameLength caps how long a served name may be. Longer names keep as
+// much of their start as fits before a hash of the whole name, so the same name
+// always turns into the same shorter one. Caps shorter than the hash are raised to fit it; zero,
+// the default, is no cap.
+func (i *Icarus) SetMaxNameLength(max int) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	if (max > 0) && (max <= hashSuffix) {
+		max = hashSuffix + 1
+	}
+	i.maxName = max
+}
+
+// truncateName shortens name to max, ending it in a hash of the whole name.
+func truncateName(name string, max int) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return name[:max-hashSuffix] + fmt.Sprintf("_%016x", hash.Sum64())
+}
+
+// SetMinValue leaves series named name (without the prefix) out of rollups
+// while their absolute value is below min, to cut noise like near zero
+// rates. Only what is served changes, not what is stored. Zero min removes
+// the threshold.
+func (i *Icarus) SetMinValue(name string, min float64) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	if min == 0 {
+		delete(i.minValues, name)
+		return
+	}
+	i.minValues[name] = math.Abs(min)
+}
+
+// belowMin says if a series is too small to serve, see SetMinValue. Callers
+// hold the icarus lock.
+func (i *Icarus) belowMin(met util.Metric) bool {
+	min, ok := i.minValues[i.unprefixed(met.Desc["__name__"])]
+	return ok && (math.Abs(met.Data.Val) < min)
+}
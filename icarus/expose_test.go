@@ -0,0 +1,163 @@
+package icarus
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrefixRoute(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.AddPrefixRoute("env", "prod", "prod_")
+	i.AddPrefixRoute("env", "dev", "dev_")
+	for _, env := range []string{"prod", "dev", "qa"} {
+		i.Record(helper(map[string]string{"__name__": "x", "env": env}, 1))
+	}
+	eventually(t, func() bool { return len(i.Snapshot()) == 3 })
+	i.rollup()
+	page := i.servePage().Read()
+	for _, want := range []string{`prod_x{env="prod"} 1`, `dev_x{env="dev"} 1`, `ft_x{env="qa"} 1`} {
+		if !strings.Contains(page, "\n"+want+"\n") {
+			t.Error(want, page)
+		}
+	}
+	for _, met := range i.Snapshot() {
+		if met.Desc["__name__"] != "ft_x" {
+			t.Error(met)
+		}
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.AddNameTemplate("requests", false, "verb")
+	i.AddNameTemplate("latency", true, "verb", "code")
+	i.Record(helper(map[string]string{"__name__": "requests", "verb": "GET"}, 1))
+	i.Record(helper(map[string]string{"__name__": "latency", "verb": "GET", "code": "2-xx"}, 2))
+	i.Record(helper(map[string]string{"__name__": "other", "verb": "PUT"}, 3))
+	eventually(t, func() bool { return len(i.Snapshot()) == 3 })
+	i.rollup()
+	page := i.servePage().Read()
+	for _, want := range []string{`ft_requests_GET{verb="GET"} 1`, `ft_latency_GET_2_xx{} 2`, `ft_other{verb="PUT"} 3`} {
+		if !strings.Contains(page, "\n"+want+"\n") {
+			t.Error(want, page)
+		}
+	}
+	for _, met := range i.Snapshot() {
+		if _, ok := met.Desc["verb"]; !ok {
+			t.Error(met)
+		}
+	}
+}
+
+func TestPrefixRouteTemplate(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.AddPrefixRoute("env", "prod", "prod_")
+	i.AddNameTemplate("requests", false, "verb")
+	i.AddNameTemplate("latency", true, "env")
+	i.Record(helper(map[string]string{"__name__": "requests", "verb": "GET", "env": "prod"}, 1))
+	i.Record(helper(map[string]string{"__name__": "requests", "verb": "PUT", "env": "qa"}, 2))
+	i.Record(helper(map[string]string{"__name__": "latency", "env": "prod"}, 3))
+	eventually(t, func() bool { return len(i.Snapshot()) == 3 })
+	i.rollup()
+	page := i.servePage().Read()
+	for _, want := range []string{`prod_requests_GET{env="prod",verb="GET"} 1`, `ft_requests_PUT{env="qa",verb="PUT"} 2`, `prod_latency_prod{} 3`} {
+		if !strings.Contains(page, "\n"+want+"\n") {
+			t.Error(want, page)
+		}
+	}
+}
+
+func TestMaxNameLength(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	if g := truncateName("ft_"+long, 30); (len(g) != 30) || (g != truncateName("ft_"+long, 30)) || !strings.HasPrefix(g, "ft_aaaaaaaaaa_") {
+		t.Error(g)
+	}
+	if truncateName("ft_"+long, 30) == truncateName("ft_"+long+"b", 30) {
+		t.Error("names collide")
+	}
+
+	i := NewIcarus("ft_")
+	i.SetMaxNameLength(30)
+	i.Record(helper(map[string]string{"__name__": long}, 1))
+	i.Record(helper(map[string]string{"__name__": "short"}, 2))
+	eventually(t, func() bool { return len(i.Snapshot()) == 2 })
+	truncated := value(icarusNameTruncatedCounter)
+	i.rollup()
+	page := i.servePage().Read()
+	for _, want := range []string{truncateName("ft_"+long, 30) + "{} 1", "ft_short{} 2"} {
+		if !strings.Contains(page, "\n"+want+"\n") {
+			t.Error(want, page)
+		}
+	}
+	if g := value(icarusNameTruncatedCounter); g != truncated+1 {
+		t.Error(g)
+	}
+}
+
+func TestMinValue(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Unix(1500000000, 0)
+	i.now = func() time.Time { return now }
+	i.SetMinValue("x", 0.5)
+	i.SetIngestRates(true)
+	i.SetMinValue("x_ingest_rate", 1)
+	for val, label := range map[float64]string{0.1: "small", -0.2: "negative", 2: "big", -3: "big_negative"} {
+		i.Record(helper(map[string]string{"__name__": "x", "a": label}, val))
+	}
+	i.Record(helper(map[string]string{"__name__": "y"}, 0.1))
+	i.Drain()
+	now = now.Add(10 * time.Second)
+	i.rollup()
+	g := i.servePage().Read()
+	for _, want := range []string{"\nft_x{a=\"big\"} 2\n", "\nft_x{a=\"big_negative\"} -3\n", "\nft_y{} 0.1\n"} {
+		if !strings.Contains(g, want) {
+			t.Error(want, g)
+		}
+	}
+	if strings.Contains(g, "small") || strings.Contains(g, "\"negative\"") || strings.Contains(g, "ft_x_ingest_rate") {
+		t.Error(g)
+	}
+	if g := len(i.Snapshot()); g != 5 {
+		t.Error(g)
+	}
+}
+
+func TestEnvLabels(t *testing.T) {
+	os.Setenv("ICARUS_TEST_HOST", "box1")
+	defer os.Unsetenv("ICARUS_TEST_HOST")
+	os.Unsetenv("ICARUS_TEST_MISSING")
+	os.Setenv(envLabelsVar, "ICARUS_TEST_HOST=host, ICARUS_TEST_MISSING=zone,malformed,ICARUS_TEST_HOST=bad-label")
+	defer os.Unsetenv(envLabelsVar)
+	i := NewIcarus("ft_")
+	// read once: later changes to the environment are not picked up.
+	os.Setenv("ICARUS_TEST_HOST", "box2")
+	i.Record(helper(map[string]string{"__name__": "x", "a": "b"}, 1))
+	i.Record(helper(map[string]string{"__name__": "y", "host": "own"}, 2))
+	i.Drain()
+	i.rollup()
+	g := i.servePage().Read()
+	for _, want := range []string{"\nft_x{a=\"b\",host=\"box1\"} 1\n", "\nft_y{host=\"own\"} 2\n",
+		"\nft_heartbeat{host=\"box1\"} 1\n", "\nft_degraded{host=\"box1\"} 0\n", "\nft_ready{host=\"box1\"} 1\n"} {
+		if !strings.Contains(g, want) {
+			t.Error(want, g)
+		}
+	}
+	if strings.Contains(g, "zone") || strings.Contains(g, "box2") {
+		t.Error(g)
+	}
+	if !strings.Contains(g, `ft_icarus_config_info{host="box1",idle="0s",`) {
+		t.Error("config info", g)
+	}
+	// the store keeps the labels it was given.
+	for _, met := range i.Snapshot() {
+		if met.Desc["host"] == "box1" {
+			t.Error(met)
+		}
+	}
+	// and the default registry gets them too.
+	if g := i.scrapeOutput(); !strings.Contains(g, "\ngo_goroutines{host=\"box1\"} ") {
+		t.Error(g)
+	}
+}
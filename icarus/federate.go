@@ -0,0 +1,193 @@
+package icarus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errSelector = errors.New("invalid series selector")
+
+// labelMatcher is one label condition of a series selector.
+type labelMatcher struct {
+	label string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// matches says if a value meets the condition, a missing label being empty.
+func (m labelMatcher) matches(val string) bool {
+	switch m.op {
+	case "!=":
+		return val != m.value
+	case "=~":
+		return m.re.MatchString(val)
+	case "!~":
+		return !m.re.MatchString(val)
+	}
+	return val == m.value
+}
+
+// labelName is a label name at the start of a selector.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+
+// metricNameStart is a metric name at the start of a selector.
+var metricNameStart = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+
+// parseSelector reads a prometheus series selector, like
+// up{job="x",instance=~"a.*"}, into the conditions a series has to meet.
+func parseSelector(selector string) ([]labelMatcher, error) {
+	rest := strings.TrimSpace(selector)
+	out := make([]labelMatcher, 0)
+	if name := metricNameStart.FindString(rest); name != "" {
+		out = append(out, labelMatcher{label: "__name__", op: "=", value: name})
+		rest = strings.TrimSpace(rest[len(name):])
+	}
+	if rest == "" {
+		if len(out) == 0 {
+			return nil, errSelector
+		}
+		return out, nil
+	}
+	if rest[0] != '{' {
+		return nil, errSelector
+	}
+	rest = strings.TrimSpace(rest[1:])
+	for !strings.HasPrefix(rest, "}") {
+		label := labelName.FindString(rest)
+		if label == "" {
+			return nil, errSelector
+		}
+		rest = strings.TrimSpace(rest[len(label):])
+		op := ""
+		for _, try := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(rest, try) {
+				op = try
+				break
+			}
+		}
+		if op == "" {
+			return nil, errSelector
+		}
+		rest = strings.TrimSpace(rest[len(op):])
+		quoted, err := quotedPrefix(rest)
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, errSelector
+		}
+		m := labelMatcher{label: label, op: op, value: value}
+		if (op == "=~") || (op == "!~") {
+			if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, m)
+		rest = strings.TrimSpace(rest[len(quoted):])
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "}") {
+			return nil, errSelector
+		}
+	}
+	if (strings.TrimSpace(rest[1:]) != "") || (len(out) == 0) {
+		return nil, errSelector
+	}
+	return out, nil
+}
+
+// quotedPrefix is the double quoted string at the start of s, quotes included.
+func quotedPrefix(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", errSelector
+	}
+	for ii := 1; ii < len(s); ii++ {
+		switch s[ii] {
+		case '\\':
+			ii++
+		case '"':
+			return s[:ii+1], nil
+		}
+	}
+	return "", errSelector
+}
+
+// FederateHandleFunc serves, like prometheus's /federate, the series matching
+// any of the match[] selectors, as they are exposed, so another prometheus
+// can federate from icarus. Each is stamped with when the window holding its
+// latest value started, and is left out as HandleFunc would leave it out: NaN,
+// below its minimum or older than max_age. Names in selectors carry the
+// prefix. Selectors that match nothing, or none at all, give an empty body.
+func (i *Icarus) FederateHandleFunc(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxAge, err := i.maxAgeFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selectors := make([][]labelMatcher, 0)
+	for _, selector := range r.Form["match[]"] {
+		matchers, err := parseSelector(selector)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %s", err, selector), http.StatusBadRequest)
+			return
+		}
+		selectors = append(selectors, matchers)
+	}
+	cut := int64(0)
+	if maxAge > 0 {
+		cut = i.now().Add(-maxAge).Unix()
+	}
+	entries := i.Store.entries()
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]string, 0)
+	i.Lock()
+	for _, key := range keys {
+		entry := entries[key]
+		if math.IsNaN(entry.Metric.Data.Val) || i.belowMin(entry.Metric) || (entry.Seen < cut) {
+			continue
+		}
+		met := i.expose(entry.Metric)
+		if !federated(met.Desc, selectors) {
+			continue
+		}
+		line := strings.TrimSuffix(i.format.metric(met), "\n")
+		out = append(out, line+" "+strconv.FormatInt(entry.Start*1000, 10)+"\n")
+	}
+	i.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, strings.Join(out, ""))
+}
+
+// federated says if a series meets every condition of any of the selectors.
+func federated(desc map[string]string, selectors [][]labelMatcher) bool {
+	for _, matchers := range selectors {
+		all := true
+		for _, m := range matchers {
+			if !m.matches(desc[m.label]) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package icarus
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseSelector(t *testing.T) {
+	for _, test := range []struct {
+		selector string
+		desc     map[string]string
+		want     bool
+	}{
+		{`up`, map[string]string{"__name__": "up"}, true},
+		{`up`, map[string]string{"__name__": "down"}, false},
+		{`{job="a"}`, map[string]string{"__name__": "up", "job": "a"}, true},
+		{`up{job!="a", zone=~"us-.*"}`, map[string]string{"__name__": "up", "job": "b", "zone": "us-east"}, true},
+		{`up{zone!~"us-.*"}`, map[string]string{"__name__": "up", "zone": "us-east"}, false},
+		{`up{job=""}`, map[string]string{"__name__": "up"}, true},
+		{`up{job="say \"hi\""}`, map[string]string{"__name__": "up", "job": `say "hi"`}, true},
+	} {
+		matchers, err := parseSelector(test.selector)
+		if err != nil {
+			t.Error(test.selector, err)
+			continue
+		}
+		if g := federated(test.desc, [][]labelMatcher{matchers}); g != test.want {
+			t.Error(test.selector, g)
+		}
+	}
+	for _, bad := range []string{``, `{}`, `up{`, `up{job}`, `up{job="a"`, `up{job=a}`, `up{job=~"("}`, `up{job="a"} x`} {
+		if _, err := parseSelector(bad); err == nil {
+			t.Error(bad)
+		}
+	}
+}
+
+func TestFederateHandleFunc(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Unix(1500000000, 0)
+	i.now = func() time.Time { return now }
+	i.SetMinValue("small", 1)
+	i.Record(helper(map[string]string{"__name__": "x", "a": "1"}, 1))
+	i.Record(helper(map[string]string{"__name__": "x", "a": "2"}, 2))
+	i.Record(helper(map[string]string{"__name__": "y"}, 3))
+	i.Record(helper(map[string]string{"__name__": "z"}, 4))
+	i.Record(helper(map[string]string{"__name__": "small"}, 0.5))
+	i.Record(helper(map[string]string{"__name__": "nan"}, math.NaN()))
+	i.Drain()
+	federate := func(query url.Values) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		i.FederateHandleFunc(rw, httptest.NewRequest("GET", "/federate?"+query.Encode(), nil))
+		return rw
+	}
+	matching := func(selectors ...string) url.Values { return url.Values{"match[]": selectors} }
+	// stamped with the start of the window, not when they came in.
+	at := " " + strconv.FormatInt(i.Store.Current()*1000, 10) + "\n"
+	rw := federate(matching(`ft_x{a="1"}`, `ft_y`, `{a="1"}`))
+	want := "ft_x{a=\"1\"} 1" + at + "ft_y{} 3" + at
+	if g := rw.Body.String(); (rw.Code != http.StatusOK) || (g != want) {
+		t.Error(rw.Code, g)
+	}
+	// what HandleFunc leaves out, federation does too.
+	if g := federate(matching(`ft_small`, `ft_nan`)).Body.String(); g != "" {
+		t.Error(g)
+	}
+	if err := i.SetFloatFormat('e'); err != nil {
+		t.Error(err)
+	}
+	if g := federate(matching(`ft_z`)).Body.String(); g != "ft_z{} 4e+00"+at {
+		t.Error(g)
+	}
+	now = now.Add(time.Hour)
+	if g := federate(url.Values{"match[]": {`ft_z`}, "max_age": {"1m"}}).Body.String(); g != "" {
+		t.Error(g)
+	}
+	if rw := federate(matching(`nothing`)); (rw.Code != http.StatusOK) || (rw.Body.String() != "") {
+		t.Error(rw.Code, rw.Body.String())
+	}
+	if rw := federate(matching(`ft_x{`)); rw.Code != http.StatusBadRequest {
+		t.Error(rw.Code)
+	}
+}
@@ -0,0 +1,151 @@
+package icarus
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+var errFloatFormat = errors.New("float format must be one of 'f', 'g' or 'e'")
+
+// promFormat is how a rollup writes metrics into the text exposition.
+type promFormat struct {
+	// labelOrder are label keys written first, in this order. The rest follow
+	// alphabetically.
+	labelOrder []string
+	// float is the strconv.FormatFloat style for values, 'f' when unset.
+	float byte
+	// custom replaces the prometheus text format when set.
+	custom func(util.Metric) string
+}
+
+// SetLabelOrder writes the given label keys first, in that order, ahead of the
+// rest which stay alphabetical. Some diff tools expect e.g. job and instance
+// to lead. No keys means plain alphabetical, the default.
+func (i *Icarus) SetLabelOrder(keys ...string) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.format.labelOrder = keys
+}
+
+// SetSortByValue has rollups write the series of each of the given names,
+// without the prefix, largest value first, for dashboards showing the top few.
+// A single * sorts every name. Series of a name are then written together,
+// names in order. NaNs are never written anyway. No names turns it off.
+func (i *Icarus) SetSortByValue(names ...string) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.byValue = make(map[string]bool, len(names))
+	for _, name := range names {
+		i.byValue[name] = true
+	}
+}
+
+// ordered sorts series for a rollup as SetSortByValue asked, by name and then
+// by value or labels. Callers hold the icarus lock.
+func (i *Icarus) ordered(mets []util.Metric) {
+	if len(i.byValue) == 0 {
+		return
+	}
+	keys := make([]string, len(mets))
+	for ii, met := range mets {
+		keys[ii] = util.MapSSToS(met.Desc)
+	}
+	sort.Sort(byValue{mets, keys, func(name string) bool {
+		return i.byValue["*"] || i.byValue[i.unprefixed(name)]
+	}})
+}
+
+// byValue sorts series by name, then those of sorted names largest value
+// first and the rest by their labels.
+type byValue struct {
+	mets   []util.Metric
+	keys   []string
+	sorted func(string) bool
+}
+
+func (b byValue) Len() int { return len(b.mets) }
+
+func (b byValue) Swap(x, y int) {
+	b.mets[x], b.mets[y] = b.mets[y], b.mets[x]
+	b.keys[x], b.keys[y] = b.keys[y], b.keys[x]
+}
+
+func (b byValue) Less(x, y int) bool {
+	name, other := b.mets[x].Desc["__name__"], b.mets[y].Desc["__name__"]
+	if name != other {
+		return name < other
+	}
+	val, otherVal := b.mets[x].Data.Val, b.mets[y].Data.Val
+	if b.sorted(name) && (val != otherVal) && !(math.IsNaN(val) && math.IsNaN(otherVal)) {
+		return math.IsNaN(otherVal) || (val > otherVal)
+	}
+	return b.keys[x] < b.keys[y]
+}
+
+// SetFloatFormat picks how values are written: 'f' never uses an exponent and
+// is the default, 'e' always does and 'g' uses one only for large exponents.
+func (i *Icarus) SetFloatFormat(style byte) error {
+	switch style {
+	case 'f', 'g', 'e':
+	default:
+		return errFloatFormat
+	}
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.format.float = style
+	return nil
+}
+
+// SetFormatter has rollups write each metric with formatter rather than in the
+// prometheus text format, for downstream systems with a format of their own.
+// The label order and float format settings do not apply to it. nil goes back
+// to the prometheus format.
+func (i *Icarus) SetFormatter(formatter func(util.Metric) string) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.format.custom = formatter
+}
+
+// metric changes a map into a string.
+func (f promFormat) metric(met util.Metric) string {
+	if f.custom != nil {
+		return f.custom(met)
+	}
+	name := met.Desc["__name__"]
+	kvprune := make(map[string]string)
+	for key, val := range met.Desc {
+		if (key == "") || (key == "_hash") || (key == "__name__") || (val == "") || (key == "ft_target") {
+			continue
+		}
+		kvprune[key] = val
+	}
+	out := make([]string, 0, len(kvprune))
+	for _, key := range f.labelOrder {
+		if val, ok := kvprune[key]; ok {
+			out = append(out, key+"=\""+val+"\"")
+			delete(kvprune, key)
+		}
+	}
+	sorted := make([]string, 0, len(kvprune))
+	for key := range kvprune {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		out = append(out, key+"=\""+kvprune[key]+"\"")
+	}
+	style := f.float
+	if style == 0 {
+		style = 'f'
+	}
+	return name + "{" + strings.Join(out, ",") + "} " + strconv.FormatFloat(met.Data.Val, style, -1, 32) + "\n"
+}
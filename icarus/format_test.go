@@ -0,0 +1,127 @@
+package icarus
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestLabelOrder(t *testing.T) {
+	met := helper(map[string]string{"__name__": "x", "b": "1", "instance": "i", "a": "2", "job": "j"}, 1)
+	if g := (promFormat{}).metric(met); g != `x{a="2",b="1",instance="i",job="j"} 1`+"\n" {
+		t.Error(g)
+	}
+	if g := (promFormat{labelOrder: []string{"job", "instance", "missing"}}).metric(met); g != `x{job="j",instance="i",a="2",b="1"} 1`+"\n" {
+		t.Error(g)
+	}
+
+	i := NewIcarus("ft_")
+	i.SetLabelOrder("job")
+	i.Record(met)
+	eventually(t, func() bool { return len(i.Snapshot()) == 1 })
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\n"+`ft_x{job="j",a="2",b="1",instance="i"} 1`+"\n") {
+		t.Error(g)
+	}
+}
+
+func TestFloatFormat(t *testing.T) {
+	for _, tc := range []struct {
+		style byte
+		want  []string
+	}{
+		{0, []string{"0.000000001", "1.5", "100000000000000000000"}},
+		{'f', []string{"0.000000001", "1.5", "100000000000000000000"}},
+		{'g', []string{"1e-09", "1.5", "1e+20"}},
+		{'e', []string{"1e-09", "1.5e+00", "1e+20"}},
+	} {
+		for ii, val := range []float64{1e-9, 1.5, 1e20} {
+			if g := (promFormat{float: tc.style}).metric(helper(map[string]string{"__name__": "x"}, val)); g != "x{} "+tc.want[ii]+"\n" {
+				t.Error(string(tc.style), g)
+			}
+		}
+	}
+
+	i := NewIcarus("ft_")
+	if err := i.SetFloatFormat('x'); err != errFloatFormat {
+		t.Error(err)
+	}
+	if err := i.SetFloatFormat('e'); err != nil {
+		t.Error(err)
+	}
+	i.Record(helper(map[string]string{"__name__": "x"}, 2))
+	eventually(t, func() bool { return len(i.Snapshot()) == 1 })
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_x{} 2e+00\n") {
+		t.Error(g)
+	}
+}
+
+func TestFormatter(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.Record(helper(map[string]string{"__name__": "x", "a": "b"}, 2))
+	i.Drain()
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\n"+`ft_x{a="b"} 2`+"\n") {
+		t.Error(g)
+	}
+	i.SetFormatter(func(met util.Metric) string {
+		return fmt.Sprintf("%s,%s,%v\n", met.Desc["__name__"], met.Desc["a"], met.Data.Val)
+	})
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_x,b,2\n") || strings.Contains(g, `ft_x{a="b"}`) {
+		t.Error(g)
+	}
+	i.SetFormatter(nil)
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\n"+`ft_x{a="b"} 2`+"\n") {
+		t.Error(g)
+	}
+}
+
+func TestSortByValue(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetSortByValue("x")
+	for val, label := range map[float64]string{3: "a", -1: "b", 10: "c", 5: "d"} {
+		i.Record(helper(map[string]string{"__name__": "x", "n": label}, val))
+		i.Record(helper(map[string]string{"__name__": "y", "n": label}, val))
+	}
+	i.Record(helper(map[string]string{"__name__": "x", "n": "nan"}, math.NaN()))
+	i.Drain()
+	i.rollup()
+	page := i.servePage().Read()
+	order := func(name string) string {
+		got := ""
+		for _, line := range strings.Split(page, "\n") {
+			if strings.HasPrefix(line, name+"{") {
+				got += strings.Split(line, `"`)[1]
+			}
+		}
+		return got
+	}
+	// y is left in label order.
+	if g := order("ft_x"); g != "cdab" {
+		t.Error(g, page)
+	}
+	if g := order("ft_y"); g != "abcd" {
+		t.Error(g, page)
+	}
+	mets := []util.Metric{
+		helper(map[string]string{"__name__": "ft_y", "n": "a"}, 1),
+		helper(map[string]string{"__name__": "ft_x", "n": "nan"}, math.NaN()),
+		helper(map[string]string{"__name__": "ft_y", "n": "b"}, 2),
+		helper(map[string]string{"__name__": "ft_x", "n": "a"}, 1),
+	}
+	i.SetSortByValue("*")
+	i.ordered(mets)
+	got := ""
+	for _, met := range mets {
+		got += met.Desc["__name__"] + met.Desc["n"] + " "
+	}
+	if got != "ft_xa ft_xnan ft_yb ft_ya " {
+		t.Error(got)
+	}
+}
@@ -0,0 +1,120 @@
+package icarus
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// errMaxAge is what a scrape asking for a max_age that is no duration gets.
+var errMaxAge = errors.New("max_age must be a duration that is not negative, e.g. 30s")
+
+// SetScrapeMaxAge has HandleFunc leave out series from the store that have not
+// been updated for maxAge, though they stay in the store and in Snapshot until
+// they age out. Series made from stored ones, merged histograms, quantiles,
+// rates and derivatives, go with the newest series they are made from. A
+// scraper can ask for its own cut with ?max_age=30s. Zero, the default,
+// serves everything in the store.
+func (i *Icarus) SetScrapeMaxAge(maxAge time.Duration) {
+	i.configChanged()
+	i.scrapes.Lock()
+	defer i.scrapes.Unlock()
+	i.scrapes.maxAge = maxAge
+}
+
+// maxAgeFor is the freshness cut a scrape asked for, or the configured one.
+func (i *Icarus) maxAgeFor(r *http.Request) (time.Duration, error) {
+	if asked := r.FormValue("max_age"); asked != "" {
+		maxAge, err := time.ParseDuration(asked)
+		if (err != nil) || (maxAge < 0) {
+			return 0, errMaxAge
+		}
+		return maxAge, nil
+	}
+	i.scrapes.Lock()
+	defer i.scrapes.Unlock()
+	return i.scrapes.maxAge, nil
+}
+
+// lastSeen is when the series a rollup renders were last updated, unix
+// seconds, by util.MapSSToS of their labels. Series made from stored ones
+// are noted as they are made.
+type lastSeen map[string]int64
+
+// of is when the series with labels desc was last updated, if known.
+func (l lastSeen) of(desc map[string]string) (int64, bool) {
+	at, ok := l[util.MapSSToS(desc)]
+	return at, ok
+}
+
+// note says a series was last updated at, unless it is known to be newer.
+func (l lastSeen) note(desc map[string]string, at int64) {
+	key := util.MapSSToS(desc)
+	if known, ok := l[key]; !ok || (at > known) {
+		l[key] = at
+	}
+}
+
+// pageRow is a span of a page rendering one series, and when that series
+// was last updated, unix seconds.
+type pageRow struct {
+	start, end int
+	seen       int64
+}
+
+// agedBuffer puts a page together, keeping track of the rows rendering
+// series so scrapes can leave out the stale ones. Anything else written
+// to it is always served.
+type agedBuffer struct {
+	*bytes.Buffer
+	rows []pageRow
+}
+
+func newAgedBuffer(start string) *agedBuffer {
+	return &agedBuffer{Buffer: bytes.NewBufferString(start)}
+}
+
+// row writes the rendering of a series last updated at seen.
+func (b *agedBuffer) row(text string, seen int64) {
+	start := b.Len()
+	b.WriteString(text)
+	b.rows = append(b.rows, pageRow{start, b.Len(), seen})
+}
+
+// append writes a page put together earlier along with its rows.
+func (b *agedBuffer) append(page string, rows []pageRow) {
+	offset := b.Len()
+	b.WriteString(page)
+	for _, row := range rows {
+		b.rows = append(b.rows, pageRow{row.start + offset, row.end + offset, row.seen})
+	}
+}
+
+// since is page without the rows of series last updated before cut.
+func since(page string, rows []pageRow, cut int64) string {
+	var out strings.Builder
+	last := 0
+	for _, row := range rows {
+		if row.seen < cut {
+			out.WriteString(page[last:row.start])
+			last = row.end
+		}
+	}
+	out.WriteString(page[last:])
+	return out.String()
+}
+
+// freshOutput is the response to a scrape leaving out the series not
+// updated for maxAge. It is put together for each scrape, never cached.
+func (i *Icarus) freshOutput(maxAge time.Duration) string {
+	i.counter(icarusScrapeAssemblies).Inc()
+	output := i.defaultSection() + i.servePage().ReadSince(i.now().Add(-maxAge).Unix())
+	if !i.isReady() {
+		output += i.notReady()
+	}
+	return output
+}
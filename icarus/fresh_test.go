@@ -0,0 +1,107 @@
+package icarus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestScrapeMaxAge(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Unix(1500000000, 0)
+	i.now = func() time.Time { return now }
+	i.Record(helper(map[string]string{"__name__": "old"}, 1))
+	i.Drain()
+	now = now.Add(time.Minute)
+	i.Record(helper(map[string]string{"__name__": "new"}, 2))
+	i.Drain()
+	i.rollup()
+	scrape := func(url string) string {
+		rw := httptest.NewRecorder()
+		i.HandleFunc(rw, httptest.NewRequest("GET", url, nil))
+		return rw.Body.String()
+	}
+	if g := scrape("/metrics"); !strings.Contains(g, "\nft_old{} 1\n") || !strings.Contains(g, "\nft_new{} 2\n") {
+		t.Error(g)
+	}
+	i.SetScrapeMaxAge(30 * time.Second)
+	if g := scrape("/metrics"); strings.Contains(g, "ft_old") || !strings.Contains(g, "\nft_new{} 2\n") {
+		t.Error(g)
+	}
+	// each scraper can make its own cut.
+	if g := scrape("/metrics?max_age=2m"); !strings.Contains(g, "\nft_old{} 1\n") {
+		t.Error(g)
+	}
+	if g := len(i.Snapshot()); g != 2 {
+		t.Error(g)
+	}
+}
+
+func TestScrapeMaxAgeMadeSeries(t *testing.T) {
+	i := NewIcarus("ft_")
+	start := time.Unix(1500000000, 0)
+	now := start
+	i.now = func() time.Time { return now }
+	i.SetHistogramMerge("h", "pod")
+	i.SetQuantiles("q", []float64{0.5})
+	i.SetIngestRates(true)
+	i.SetDerivatives(2, "d")
+	i.SetSlowLane(2, "s")
+	i.SetMaxNameLength(30)
+	for _, pod := range []string{"a", "b"} {
+		for _, le := range []string{"1", "+Inf"} {
+			i.Record(helper(map[string]string{"__name__": "h_bucket", "pod": pod, "le": le}, 1))
+			i.Record(helper(map[string]string{"__name__": "q_bucket", "pod": pod, "le": le}, 1))
+		}
+	}
+	for step := int64(0); step < 2; step++ {
+		i.Record(util.Metric{Desc: map[string]string{"__name__": "d"}, Data: util.DataPoint{Val: float64(step), Time: start.Unix() + step}})
+	}
+	i.Record(helper(map[string]string{"__name__": "s"}, 1))
+	i.Record(helper(map[string]string{"__name__": "a_name_long_enough_to_be_truncated"}, 1))
+	i.Drain()
+	now = now.Add(time.Minute)
+	i.Record(helper(map[string]string{"__name__": "new"}, 2))
+	i.Drain()
+	i.rollup()
+	// the slow lane is served from the last time it was rendered.
+	now = now.Add(time.Second)
+	i.rollup()
+	// what is served no longer matches how the series would render now.
+	if err := i.SetFloatFormat('e'); err != nil {
+		t.Error(err)
+	}
+	scrape := func(url string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		i.HandleFunc(rw, httptest.NewRequest("GET", url, nil))
+		return rw
+	}
+	all := scrape("/metrics").Body.String()
+	for _, want := range []string{"ft_h_bucket{le=", "ft_q_quantile{", "ft_d_derivative{}", "ft_s{}", "ft_h_bucket_ingest_rate{}", "ft_a_name_lon"} {
+		if !strings.Contains(all, want) {
+			t.Error(want, all)
+		}
+	}
+	truncated := value(icarusNameTruncatedCounter)
+	g := scrape("/metrics?max_age=30s").Body.String()
+	for _, stale := range []string{"ft_h_", "ft_q_", "ft_d{", "ft_d_", "ft_s{}", "ft_a_name_lon"} {
+		if strings.Contains(g, stale) {
+			t.Error(stale, g)
+		}
+	}
+	if !strings.Contains(g, "\nft_new{} 2\n") || !strings.Contains(g, "ft_new_ingest_rate{}") || !strings.Contains(g, "ft_heartbeat{}") {
+		t.Error(g)
+	}
+	if g := value(icarusNameTruncatedCounter); g != truncated {
+		t.Error(truncated, g)
+	}
+	for _, bad := range []string{"soon", "-1s"} {
+		if g := scrape("/metrics?max_age=" + bad); g.Code != http.StatusBadRequest {
+			t.Error(bad, g.Code, g.Body.String())
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package icarus
+
+import (
+	"github.com/luuphu25/data-sidecar/icarus/icaruspb"
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// metricsServer streams the store to gRPC clients, see icaruspb.
+type metricsServer struct {
+	*Icarus
+}
+
+// MetricsServer is a gRPC service sending the store to each client on every
+// rollup, for consumers that would rather not scrape. Register it with
+// icaruspb.RegisterMetricsServer.
+func (i *Icarus) MetricsServer() icaruspb.MetricsServer {
+	return metricsServer{i}
+}
+
+// Stream sends the store on every rollup until the client goes away. A slow
+// client holds up only its own stream: of the rollups that come while it is
+// still taking the last one, it gets only the latest after, like SSE.
+func (s metricsServer) Stream(_ *icaruspb.StreamRequest, stream icaruspb.Metrics_StreamServer) error {
+	pages := s.subscribe()
+	defer s.unsubscribe(pages)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-pages:
+			snapshot := s.Snapshot()
+			rollup := &icaruspb.Rollup{Metrics: make([]*icaruspb.Metric, len(snapshot))}
+			for ii, met := range snapshot {
+				rollup.Metrics[ii] = metricToProto(met)
+			}
+			if err := stream.Send(rollup); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// metricToProto is met as an icaruspb.Metric.
+func metricToProto(met util.Metric) *icaruspb.Metric {
+	return &icaruspb.Metric{
+		Desc:        met.Desc,
+		Data:        &icaruspb.DataPoint{Val: met.Data.Val, Time: met.Data.Time},
+		OneShot:     met.OneShot,
+		Annotations: met.Annotations,
+	}
+}
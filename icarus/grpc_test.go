@@ -0,0 +1,56 @@
+package icarus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/icarus/icaruspb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestMetricsServer(t *testing.T) {
+	i := newIcarus("ft_", time.NewTicker(time.Hour), make(chan time.Time))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	icaruspb.RegisterMetricsServer(server, i.MetricsServer())
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := icaruspb.NewMetricsClient(conn).Stream(ctx, &icaruspb.StreamRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribed := func(want int) func() bool {
+		return func() bool {
+			i.Lock()
+			defer i.Unlock()
+			return len(i.subscribers) == want
+		}
+	}
+	eventually(t, subscribed(1))
+	i.Record(helper(map[string]string{"__name__": "x", "a": "b"}, 2))
+	i.Drain()
+	i.rollup()
+	rollup, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(rollup.Metrics) != 1) || (rollup.Metrics[0].Desc["__name__"] != "ft_x") || (rollup.Metrics[0].Desc["a"] != "b") || (rollup.Metrics[0].Data.Val != 2) {
+		t.Error(rollup)
+	}
+
+	// a client going away ends its stream.
+	cancel()
+	eventually(t, subscribed(0))
+}
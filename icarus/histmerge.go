@@ -0,0 +1,188 @@
+package icarus
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var icarusHistogramMergeFailures = splitCounter(prometheus.CounterOpts{
+	Name: "icarus_histogram_merge_failures_total",
+	Help: "How many histogram merges were refused for bucket boundaries that did not line up?",
+})
+
+func init() {
+	prometheus.MustRegister(icarusHistogramMergeFailures)
+}
+
+// SetHistogramMerge makes rollups merge the stored <name>_bucket, <name>_sum
+// and <name>_count histogram series across the given labels, which are left
+// out: bucket counts are summed bucket by bucket, as are sums and counts.
+// Histograms being merged must have the same bucket boundaries, or they are
+// served unmerged and the failure counted. Names are given without the prefix;
+// no labels stops merging the name. Only what is served changes.
+func (i *Icarus) SetHistogramMerge(name string, drop ...string) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	if len(drop) == 0 {
+		delete(i.merges, i.prefix+name)
+		return
+	}
+	i.merges[i.prefix+name] = drop
+}
+
+// histogramParts are the suffixes of the series making up a histogram.
+var histogramParts = []string{"_bucket", "_sum", "_count"}
+
+// mergedHistogram is the histogram series being merged into one.
+type mergedHistogram struct {
+	name   string
+	labels map[string]string
+	// buckets are each merged histogram's bucket counts by upper bound.
+	buckets    map[string]map[float64]float64
+	bounds     map[float64]string
+	sum, count float64
+	parts      map[string]bool
+	originals  []util.Metric
+	broken     bool
+	// seen is when the newest histogram in the merge was last updated.
+	seen  int64
+	known bool
+}
+
+// mergeHistograms merges the histograms SetHistogramMerge asked for, leaving
+// the rest of mets alone. Merged series are noted in seen as last updated
+// with the newest series merged into them. Callers hold the icarus lock.
+func (i *Icarus) mergeHistograms(mets []util.Metric, seen lastSeen) []util.Metric {
+	if len(i.merges) == 0 {
+		return mets
+	}
+	out := make([]util.Metric, 0, len(mets))
+	groups := make(map[string]*mergedHistogram)
+	for _, met := range mets {
+		name, part := "", ""
+		for _, suffix := range histogramParts {
+			if trimmed := strings.TrimSuffix(met.Desc["__name__"], suffix); trimmed != met.Desc["__name__"] {
+				if _, ok := i.merges[trimmed]; ok {
+					name, part = trimmed, suffix
+				}
+			}
+		}
+		if name == "" {
+			out = append(out, met)
+			continue
+		}
+		labels := make(map[string]string, len(met.Desc))
+		for key, val := range met.Desc {
+			if (key != "__name__") && (key != "le") {
+				labels[key] = val
+			}
+		}
+		// each histogram being merged is told apart by its labels before the drop.
+		member := util.MapSSToS(labels)
+		for _, label := range i.merges[name] {
+			delete(labels, label)
+		}
+		key := name + util.MapSSToS(labels)
+		group, ok := groups[key]
+		if !ok {
+			group = &mergedHistogram{name: name, labels: labels,
+				buckets: make(map[string]map[float64]float64), bounds: make(map[float64]string),
+				parts: make(map[string]bool)}
+			groups[key] = group
+		}
+		group.originals = append(group.originals, met)
+		if at, ok := seen.of(met.Desc); ok && (!group.known || (at > group.seen)) {
+			group.seen, group.known = at, true
+		}
+		group.parts[part] = true
+		switch part {
+		case "_sum":
+			group.sum += met.Data.Val
+		case "_count":
+			group.count += met.Data.Val
+		default:
+			upper, err := strconv.ParseFloat(met.Desc["le"], 64)
+			if err != nil {
+				group.broken = true
+				continue
+			}
+			if group.buckets[member] == nil {
+				group.buckets[member] = make(map[float64]float64)
+			}
+			group.buckets[member][upper] = met.Data.Val
+			group.bounds[upper] = met.Desc["le"]
+		}
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		group := groups[key]
+		if !group.aligned() {
+			i.counter(icarusHistogramMergeFailures).Inc()
+			out = append(out, group.originals...)
+			continue
+		}
+		for _, met := range group.series() {
+			if group.known {
+				seen.note(met.Desc, group.seen)
+			}
+			out = append(out, met)
+		}
+	}
+	return out
+}
+
+// aligned says if every histogram in the merge has the same bucket boundaries.
+func (m *mergedHistogram) aligned() bool {
+	if m.broken {
+		return false
+	}
+	for _, buckets := range m.buckets {
+		if len(buckets) != len(m.bounds) {
+			return false
+		}
+	}
+	return true
+}
+
+// series is the merged histogram, cumulative buckets in order then sum and count.
+func (m *mergedHistogram) series() []util.Metric {
+	bounds := make([]float64, 0, len(m.bounds))
+	for upper := range m.bounds {
+		bounds = append(bounds, upper)
+	}
+	sort.Float64s(bounds)
+	out := make([]util.Metric, 0, len(bounds)+2)
+	with := func(name string, extra map[string]string, val float64) util.Metric {
+		desc := map[string]string{"__name__": name}
+		for key, val := range m.labels {
+			desc[key] = val
+		}
+		for key, val := range extra {
+			desc[key] = val
+		}
+		return util.Metric{Desc: desc, Data: util.DataPoint{Val: val}}
+	}
+	for _, upper := range bounds {
+		total := 0.
+		for _, buckets := range m.buckets {
+			total += buckets[upper]
+		}
+		out = append(out, with(m.name+"_bucket", map[string]string{"le": m.bounds[upper]}, total))
+	}
+	if m.parts["_sum"] {
+		out = append(out, with(m.name+"_sum", nil, m.sum))
+	}
+	if m.parts["_count"] {
+		out = append(out, with(m.name+"_count", nil, m.count))
+	}
+	return out
+}
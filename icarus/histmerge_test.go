@@ -0,0 +1,59 @@
+package icarus
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHistogramMerge(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetHistogramMerge("latency", "host")
+	record := func(host string, buckets map[string]float64, sum, count float64) {
+		for le, val := range buckets {
+			i.Record(helper(map[string]string{"__name__": "latency_bucket", "host": host, "path": "/", "le": le}, val))
+		}
+		i.Record(helper(map[string]string{"__name__": "latency_sum", "host": host, "path": "/"}, sum))
+		i.Record(helper(map[string]string{"__name__": "latency_count", "host": host, "path": "/"}, count))
+	}
+	record("a", map[string]float64{"0.1": 1, "1": 3, "+Inf": 4}, 2.5, 4)
+	record("b", map[string]float64{"0.1": 2, "1": 2, "+Inf": 6}, 7, 6)
+	i.Record(helper(map[string]string{"__name__": "other", "host": "a"}, 1))
+	i.Drain()
+	i.rollup()
+	g := i.servePage().Read()
+	for _, want := range []string{
+		`ft_latency_bucket{le="0.1",path="/"} 3`,
+		`ft_latency_bucket{le="1",path="/"} 5`,
+		`ft_latency_bucket{le="+Inf",path="/"} 10`,
+		`ft_latency_sum{path="/"} 9.5`,
+		`ft_latency_count{path="/"} 10`,
+		`ft_other{host="a"} 1`,
+	} {
+		if !strings.Contains(g, "\n"+want+"\n") {
+			t.Error(want, g)
+		}
+	}
+	if strings.Contains(g, `ft_latency_bucket{host=`) {
+		t.Error(g)
+	}
+	if !(strings.Index(g, `le="0.1"`) < strings.Index(g, `le="1"`)) || !(strings.Index(g, `le="1"`) < strings.Index(g, `le="+Inf"`)) {
+		t.Error(g)
+	}
+}
+
+func TestHistogramMergeMismatch(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetHistogramMerge("latency", "host")
+	before := value(icarusHistogramMergeFailures)
+	i.Record(helper(map[string]string{"__name__": "latency_bucket", "host": "a", "le": "1"}, 1))
+	i.Record(helper(map[string]string{"__name__": "latency_bucket", "host": "b", "le": "2"}, 1))
+	i.Drain()
+	i.rollup()
+	g := i.servePage().Read()
+	if !strings.Contains(g, `ft_latency_bucket{host="a",le="1"} 1`) || !strings.Contains(g, `ft_latency_bucket{host="b",le="2"} 1`) {
+		t.Error(g)
+	}
+	if g := value(icarusHistogramMergeFailures); g != before+1 {
+		t.Error(g)
+	}
+}
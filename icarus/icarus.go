@@ -7,39 +7,90 @@ package icarus
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/luuphu25/data-sidecar/util"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 )
 
 var (
-	icarusReturnSize = prometheus.NewSummary(prometheus.SummaryOpts{
+	icarusReturnSize = splitSummary(prometheus.SummaryOpts{
 		Name: "icarus_return_size_summary",
 		Help: "How much is being served",
 	})
-	icarusReturnMetrics = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+	icarusReturnMetrics = splitSummaryVec(prometheus.SummaryOpts{
 		Name: "icarus_return_metrics_summary",
 		Help: "How many metrics being served",
 	}, []string{"type"})
-	icarusRequestCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	icarusRequestCounter = splitCounter(prometheus.CounterOpts{
 		Name: "icarus_request_counter",
 		Help: "How many requests are coming in?",
 	})
-	icarusErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	icarusErrorCounter = splitCounterVec(prometheus.CounterOpts{
 		Name: "icarus_error_counter",
 		Help: "How many processing errors in icarus?",
 	}, []string{"type"})
+	icarusSamplesObserved = splitCounter(prometheus.CounterOpts{
+		Name: "icarus_samples_observed_total",
+		Help: "How many samples made it into the store?",
+	})
+	icarusRetainedWindows = splitGauge(prometheus.GaugeOpts{
+		Name: "icarus_retained_windows",
+		Help: "How many windows in the store are holding data?",
+	})
+	icarusOldestWindowAge = splitGauge(prometheus.GaugeOpts{
+		Name: "icarus_oldest_window_age_seconds",
+		Help: "How long ago did the oldest window holding data start, as of the last roll or rollup?",
+	})
+	icarusScrapesInProgress = splitGauge(prometheus.GaugeOpts{
+		Name: "icarus_scrapes_in_progress",
+		Help: "How many scrapes are being served right now?",
+	})
+	icarusRollupBytes = splitGauge(prometheus.GaugeOpts{
+		Name: "icarus_rollup_bytes",
+		Help: "How big was the last page icarus rolled up, without the default registry?",
+	})
+	icarusNameMismatchCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "icarus_name_mismatch_counter",
+		Help: "How many metrics carry a name label that disagrees with __name__?",
+	})
 	errRead = errors.New("Not found")
+
+	// cheats and hacks; named instances count in registries of their own.
+	gatherer prometheus.Gatherer = prometheus.Gatherers{prometheus.DefaultGatherer, instances}
+)
+
+// The type label values of icarus_error_counter. Every error path in icarus
+// counts under exactly one of these.
+const (
+	// errGather: the default registry failed to gather.
+	errGather = "gather"
+	// errEncode: a gathered metric family could not be rendered as text.
+	errEncode = "encode"
+	// errParse: an ingested payload could not be decoded.
+	errParse = "parse"
+	// errDropped: a sample was thrown away before it reached the store.
+	errDropped = "dropped"
+	// errCardinality: a sample would have created a series past a series cap.
+	errCardinality = "cardinality"
+	// errValidation: a sample was malformed, e.g. it had no labels at all.
+	errValidation = "validation"
+	// errMissingLabel: a sample lacked one of the required labels.
+	errMissingLabel = "missing_label"
+	// errPersist: the counter file could not be read or written.
+	errPersist = "persist"
 )
 
 func init() {
@@ -47,172 +98,901 @@ func init() {
 	prometheus.MustRegister(icarusReturnMetrics)
 	prometheus.MustRegister(icarusReturnSize)
 	prometheus.MustRegister(icarusErrorCounter)
+	prometheus.MustRegister(icarusNameMismatchCounter)
+	prometheus.MustRegister(icarusSamplesObserved)
+	prometheus.MustRegister(icarusRetainedWindows)
+	prometheus.MustRegister(icarusOldestWindowAge)
+	prometheus.MustRegister(icarusScrapesInProgress)
+	prometheus.MustRegister(icarusRollupBytes)
+}
+
+// nameLabel is where a metric's name is looked for when it has no __name__,
+// unless SetNameLabel says otherwise.
+const nameLabel = "name"
+
+// metricName works out what a metric is called, looking in the default name label.
+func metricName(desc map[string]string) string {
+	return metricNameFrom(desc, nameLabel)
+}
+
+// metricNameFrom works out what a metric is called. __name__ always wins.
+// Without one the name label is used and dropped, since it has become the
+// name, and without either the metric is an unnamed_metric. A name label that
+// disagrees with __name__ is left in place but counted.
+func metricNameFrom(desc map[string]string, label string) string {
+	name, other := desc["__name__"], desc[label]
+	switch {
+	case name != "":
+		if (other != "") && (other != name) {
+			icarusNameMismatchCounter.Inc()
+		}
+		return name
+	case other != "":
+		delete(desc, label)
+		return other
+	}
+	return defaultUnnamed
 }
 
 // ServePage holds a linked list of pages to serve over http.
+//
+// Every page in the ring has its own lock, which covers both its Page and its
+// Link. Write, Read, Next and AddPage are all safe to call at once from any
+// number of goroutines; the ring can grow while it is being walked and read.
 type ServePage struct {
 	*sync.RWMutex
 	Page string
 	Link *ServePage
+	// rows are the spans of Page rendering series, see ReadSince.
+	rows []pageRow
+	// window is when the store window the page was rolled up in started,
+	// unix seconds, see SetOpenMetrics.
+	window int64
 }
 
 // NewServePage generates a linked list of pages to serve.
 func NewServePage() *ServePage {
 	var mux sync.RWMutex
-	out := ServePage{&mux, "", nil}
+	out := ServePage{&mux, "", nil, nil, 0}
 	out.Link = &out
 	return &out
 }
 
 // AddPage adds another page to serve.
 func (s *ServePage) AddPage() {
+	other := NewServePage()
 	s.Lock()
 	defer s.Unlock()
-	other := NewServePage()
-	sNext := s.Link
+	other.Link = s.Link
 	s.Link = other
-	other.Link = sNext
 }
 
 // Next advances the servepage list.
 func (s *ServePage) Next() *ServePage {
+	s.RLock()
+	defer s.RUnlock()
 	return s.Link
 }
 
+// Write replaces what the page says.
 func (s *ServePage) Write(inp string) {
+	s.writeRows(inp, nil, 0)
+}
+
+// writeRows replaces what the page says, along with where it renders series
+// and the store window it was rolled up in.
+func (s *ServePage) writeRows(inp string, rows []pageRow, window int64) {
 	s.Lock()
 	defer s.Unlock()
-	s.Page = inp
+	s.Page, s.rows, s.window = inp, rows, window
 }
 
+// Read says what the page says.
 func (s *ServePage) Read() string {
 	s.RLock()
 	defer s.RUnlock()
 	return s.Page
 }
 
+// ReadSince says what the page says, leaving out series last updated before
+// cut, unix seconds.
+func (s *ServePage) ReadSince(cut int64) string {
+	s.RLock()
+	defer s.RUnlock()
+	return since(s.Page, s.rows, cut)
+}
+
+// readWindow is ReadSince along with the store window the page was rolled
+// up in. A cut of zero leaves nothing out.
+func (s *ServePage) readWindow(cut int64) (string, int64) {
+	s.RLock()
+	defer s.RUnlock()
+	return since(s.Page, s.rows, cut), s.window
+}
+
+// PagePolicy decides which page of the serve ring a rollup writes into.
+type PagePolicy int
+
+const (
+	// PageOldest writes into the oldest page and only serves it once it is
+	// written, so readers always get the newest page and never share it with
+	// the writer. This is the default.
+	PageOldest PagePolicy = iota
+	// PageInPlace rewrites the page being served, readers wait on the writer.
+	PageInPlace
+)
+
+func (p PagePolicy) String() string {
+	if p == PageInPlace {
+		return "in_place"
+	}
+	return "oldest"
+}
+
 // Icarus is like a prometheus store except it's easy to hurt yourself with.
 type Icarus struct {
+	// lastRecord is when Record was last called in unix nanoseconds. It is
+	// used atomically so it goes first to keep it 64 bit aligned.
+	lastRecord int64
+	// sinceRollup counts samples stored since the last rollup, atomically.
+	sinceRollup int64
+	// rejectedSinceRollup counts samples thrown away since the last rollup, atomically.
+	rejectedSinceRollup int64
+	// inflight is about how many bytes of samples are between Record and
+	// the store, atomically, see SetMaxInflightBytes.
+	inflight int64
+	// ready is 1 once the first page is rolled up, see ReadyzHandleFunc.
+	ready int32
 	*sync.Mutex
-	Store  *IcarusStore
-	Ticker *time.Ticker
-	Chan   chan util.Metric
-	prefix string
-	serve  *ServePage
+	Store   *IcarusStore
+	Ticker  *time.Ticker
+	Chan    chan util.Metric
+	prefix  string
+	pageMux *sync.RWMutex
+	serve   *ServePage
+	writing *ServePage
+	policy  PagePolicy
+	pages   int
+	// subscribers get every new page, see SSEHandleFunc.
+	subscribers map[chan string]bool
+	// recordMux guards the settings used on the way into the store.
+	recordMux *sync.RWMutex
+	standby   *Icarus
+	dead      *DeadLetter
+	maxFuture time.Duration
+	maxAge    time.Duration
+	clamp     bool
+	// rejectEmptyKeys refuses samples with an empty label key rather than fixing them.
+	rejectEmptyKeys  bool
+	maxSeries        int
+	trimValues       bool
+	slowInsert       time.Duration
+	transforms       map[string]func(string) string
+	required         []string
+	self             *instanceMetrics
+	ack              time.Duration
+	ingestTimestamps bool
+	lineage          bool
+	duplicateKeys    DuplicateKeys
+	unnamed          UnnamedMode
+	unnamedName      string
+	nameLabel        string
+	// rollupCount stored samples bring a rollup forward, see SetRollupCount.
+	rollupCount int64
+	early       chan bool
+	maxInflight int64
+	maxMetric   int64
+	inlineFlush bool
+	// insertionOrder has Snapshot keep series in the order they arrived.
+	insertionOrder bool
+	logFields      LogFields
+	// counterFile is where the self-metric counters are saved, see SetCounterFile.
+	counterFile string
+	maxBody     int64
+	// prefixMode says what to do with names already carrying the prefix.
+	prefixMode PrefixMode
+	quantiles  map[string][]float64
+	merges     map[string][]string
+	routes     []prefixRoute
+	templates  map[string]nameTemplate
+	maxName    int
+	minValues  map[string]float64
+	// envLabels are read from the environment when the icarus is made and
+	// never change.
+	envLabels map[string]string
+	byValue   map[string]bool
+	metadata  map[string]Metadata
+	heartbeat uint64
+	empty     EmptyMode
+	format    promFormat
+	lanes     lanes
+	defaults  *defaultsCache
+	scrapes   *scrapeCache
+	rates     *ingestRates
+	derivs    *derivatives
+	distinct  *distinct
+	valves    *valves
+	flow      *flow
+	samples   *reservoir
+	// interval is how often the ticker rolls up.
+	interval time.Duration
+	// now is the clock, swappable for testing.
+	now func() time.Time
+	// idle is how long ingest may be quiet before the rollup ticker stops.
+	idle        time.Duration
+	idleChanged chan bool
+	stopped     chan bool
+}
+
+// NewIcarus builds and starts an icarus process. Samples missing any of the
+// required labels are rejected. The labels ICARUS_ENV_LABELS maps environment
+// variables to are read here and added to everything it serves.
+func NewIcarus(prefix string, required ...string) *Icarus {
+	ticker := time.NewTicker(10 * time.Second)
+	i := newIcarus(prefix, ticker, ticker.C)
+	i.recordMux.Lock()
+	i.required = required
+	i.recordMux.Unlock()
+	return i
 }
 
-// NewIcarus builds and starts an icarus process.
-func NewIcarus(prefix string) *Icarus {
+// newIcarus starts an icarus process that rolls up on ticks, which need not
+// come from ticker, so tests can tick by hand.
+func newIcarus(prefix string, ticker *time.Ticker, ticks <-chan time.Time) *Icarus {
 	var mux sync.Mutex
+	var pageMux sync.RWMutex
+	var recordMux sync.RWMutex
+	var scrapesMux sync.Mutex
+	var defaultsMux sync.Mutex
+	var ratesMux sync.Mutex
+	var derivsMux sync.Mutex
+	var valvesMux sync.Mutex
+	var samplesMux sync.Mutex
 	// Only really need two pages.
 	sp := NewServePage()
 	sp.AddPage()
-	ticker := time.NewTicker(10 * time.Second)
-	i := Icarus{&mux, NewRollingStore(2), ticker,
-		make(chan util.Metric, 1), prefix, sp}
+	interval := 10 * time.Second
+	i := Icarus{
+		Mutex:   &mux,
+		Store:   NewRollingStore(2),
+		Ticker:  ticker,
+		Chan:    make(chan util.Metric, 1),
+		prefix:  prefix,
+		pageMux: &pageMux,
+		serve:   sp,
+		pages:   2,
+
+		subscribers: make(map[chan string]bool),
+		recordMux:   &recordMux,
+		nameLabel:   nameLabel,
+		unnamedName: defaultUnnamed,
+		maxBody:     defaultMaxBody,
+		quantiles:   make(map[string][]float64),
+		merges:      make(map[string][]string),
+		templates:   make(map[string]nameTemplate),
+		minValues:   make(map[string]float64),
+		logFields:   defaultLogFields,
+		metadata:    make(map[string]Metadata),
+		envLabels:   readEnvLabels(),
+		transforms:  make(map[string]func(string) string),
+		defaults:    &defaultsCache{Mutex: &defaultsMux},
+		scrapes:     &scrapeCache{Mutex: &scrapesMux},
+		rates:       &ingestRates{Mutex: &ratesMux},
+		derivs:      &derivatives{Mutex: &derivsMux},
+		distinct:    newDistinct(),
+		valves:      &valves{Mutex: &valvesMux, tripped: make(map[string]bool)},
+		flow:        newFlow(),
+		samples:     &reservoir{Mutex: &samplesMux},
+		interval:    interval,
+		now:         time.Now,
+		idleChanged: make(chan bool, 1),
+		early:       make(chan bool, 1),
+		stopped:     make(chan bool),
+	}
+	i.Store.now = func() time.Time { return i.now() }
+	i.valves.now = i.Store.now
 	go (&i).start()
-	go (&i).rollStore()
+	go func() {
+		(&i).rollStore(ticks)
+		ticker.Stop()
+	}()
 	return &i
 }
 
+// SetPagePolicy swaps the serve ring for one of the given size and picks how
+// rollups write into it. PageOldest needs at least two pages.
+func (i *Icarus) SetPagePolicy(policy PagePolicy, pages int) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	if pages < 1 || (policy == PageOldest && pages < 2) {
+		pages = 2
+	}
+	sp := NewServePage()
+	for ii := 1; ii < pages; ii++ {
+		sp.AddPage()
+	}
+	i.pageMux.Lock()
+	defer i.pageMux.Unlock()
+	sp.Write(i.serve.Read())
+	i.serve = sp
+	i.policy, i.pages = policy, pages
+}
+
+// writePage picks the page a rollup should write into and marks it as being written.
+func (i *Icarus) writePage() *ServePage {
+	i.pageMux.Lock()
+	defer i.pageMux.Unlock()
+	i.writing = i.serve.Next()
+	if i.policy == PageInPlace {
+		i.writing = i.serve
+	}
+	return i.writing
+}
+
+// publish serves a freshly written page.
+func (i *Icarus) publish(page *ServePage) {
+	i.pageMux.Lock()
+	defer i.pageMux.Unlock()
+	i.serve = page
+	i.writing = nil
+}
+
+// servePage is the page readers should get.
+func (i *Icarus) servePage() *ServePage {
+	i.pageMux.RLock()
+	defer i.pageMux.RUnlock()
+	return i.serve
+}
+
 // startIcarus makes and reads from the channel that will run the whole operation
 func (i *Icarus) start() {
 	for x := range i.Chan {
-		name := "unnamed_metric"
-		if val, ok := x.Desc["__name__"]; ok && (len(val) > 0) {
-			name = val
-		}
-		x.Desc["__name__"] = i.prefix + name
-		i.Store.Insert(x)
+		i.consume(x)
 	}
 }
 
+// consume ingests a sample taken off the channel.
+func (i *Icarus) consume(x util.Metric) {
+	size := x.Admitted
+	x.Admitted = 0
+	i.timed(x)
+	i.release(size)
+	i.flow.land()
+}
+
+// ingest validates a sample and stores it.
+func (i *Icarus) ingest(x util.Metric) {
+	if (x.Desc == nil) || !i.checkTime(&x) || !i.checkKeys(&x) {
+		i.reject(x, dropValidation)
+		return
+	}
+	if !i.named(&x) {
+		i.reject(x, dropUnnamed)
+		return
+	}
+	if i.oversize(x) {
+		i.reject(x, dropOversize)
+		return
+	}
+	original := x.Desc["__name__"]
+	if original == "" {
+		original = x.Desc[i.nameSource()]
+	}
+	i.trim(x.Desc)
+	i.transform(x.Desc)
+	x.Desc["__name__"] = i.prefixed(metricNameFrom(x.Desc, i.nameSource()))
+	i.trace(&x, original)
+	if !i.complete(x.Desc) {
+		i.reject(x, dropMissingLabel)
+		return
+	}
+	i.samples.observe(x.Desc)
+	i.stamp(&x)
+	if !i.insert(x) {
+		return
+	}
+	i.rates.count(x.Desc["__name__"], i.now().Unix())
+	i.observe(x)
+	i.distinct.observe(x.Desc)
+	i.countSample()
+	i.countTowardsRollup()
+}
+
 // Record puts things into the icarus channel.
 func (i *Icarus) Record(x util.Metric) {
+	i.TryRecord(x)
+}
+
+// TryRecord is Record, except it says when the sample was dropped because
+// the icarus is closed or over its byte budget.
+func (i *Icarus) TryRecord(x util.Metric) (err error) {
+	atomic.StoreInt64(&i.lastRecord, time.Now().UnixNano())
+	i.recordMux.RLock()
+	standby := i.standby
+	i.recordMux.RUnlock()
+	if standby != nil {
+		standby.offer(copyMetric(x))
+	}
+	i.flow.gate.RLock()
+	defer i.flow.gate.RUnlock()
+	if i.flow.shut {
+		i.reject(x, dropClosed)
+		return ErrClosed
+	}
+	size := metricSize(x)
+	if !i.admit(size) {
+		i.reject(x, dropByteBudget)
+		return ErrOverBudget
+	}
+	x.Admitted = size
+	// Chan is exported, so it can still be closed from outside.
+	defer func() {
+		if recover() != nil {
+			i.release(size)
+			i.reject(x, dropClosed)
+			err = ErrClosed
+		}
+	}()
+	if i.inline() {
+		select {
+		case i.Chan <- x:
+			i.flow.send()
+			return nil
+		default:
+			i.flushInline()
+		}
+	}
 	i.Chan <- x
+	i.flow.send()
+	return nil
+}
+
+// Checksum changes whenever what is in the store does, see IcarusStore.Checksum.
+func (i *Icarus) Checksum() uint64 {
+	return i.Store.Checksum()
+}
+
+// Snapshot returns a copy of everything currently in the store.
+func (i *Icarus) Snapshot() []util.Metric {
+	i.Lock()
+	ordered := i.insertionOrder
+	i.Unlock()
+	var out []util.Metric
+	if ordered {
+		out = i.Store.DumpOrdered()
+	} else {
+		out = i.Store.Dump()
+	}
+	for ii := range out {
+		out[ii] = copyMetric(out[ii])
+		if ts, ok := out[ii].Annotations[ingestTimestamp]; ok {
+			out[ii].Desc[ingestTimestamp] = ts
+			delete(out[ii].Annotations, ingestTimestamp)
+		}
+	}
+	return out
+}
+
+// SetInsertionOrder has Snapshot, and so the debug handlers, return series in
+// the order they were first recorded rather than in no order, which helps
+// trace what a producer sent. The exposition page keeps its own order.
+func (i *Icarus) SetInsertionOrder(ordered bool) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.insertionOrder = ordered
+}
+
+// LatestByName is the value of whichever series called name, given without
+// the prefix, was updated last, whatever its labels. It is NaN if there is no
+// such series. Meant for quick threshold checks in app code.
+func (i *Icarus) LatestByName(name string) float64 {
+	met, ok := i.Store.Latest(i.prefix + name)
+	if !ok {
+		return math.NaN()
+	}
+	return met.Data.Val
+}
+
+// SnapshotPage is up to limit series of the Snapshot starting at offset, and
+// how many series there are in all. Series are sorted by their labels, so
+// pages of an unchanged store line up with no gaps or repeats.
+func (i *Icarus) SnapshotPage(offset, limit int) ([]util.Metric, int) {
+	out := i.Snapshot()
+	keys := make([]string, len(out))
+	for ii, met := range out {
+		keys[ii] = util.MapSSToS(met.Desc)
+	}
+	sort.Sort(byKey{keys, out})
+	total := len(out)
+	if offset < 0 {
+		offset = 0
+	}
+	if (offset >= total) || (limit <= 0) {
+		return []util.Metric{}, total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return out[offset:end], total
+}
+
+// byKey sorts metrics along with their keys.
+type byKey struct {
+	keys []string
+	mets []util.Metric
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(x, y int) bool { return b.keys[x] < b.keys[y] }
+func (b byKey) Swap(x, y int) {
+	b.keys[x], b.keys[y] = b.keys[y], b.keys[x]
+	b.mets[x], b.mets[y] = b.mets[y], b.mets[x]
+}
+
+// Range is the samples from the retained windows that overlap from to to, see
+// IcarusStore.Range. Asking for more than is retained gets what there is.
+func (i *Icarus) Range(from, to time.Time) []util.Metric {
+	out := i.Store.Range(from.Unix(), to.Unix())
+	for ii := range out {
+		out[ii] = copyMetric(out[ii])
+	}
+	return out
+}
+
+// SnapshotHandleFunc dumps the store as json, annotations included.
+func (i *Icarus) SnapshotHandleFunc(w http.ResponseWriter, r *http.Request) {
+	out, _ := json.Marshal(i.Snapshot())
+	fmt.Fprint(w, string(out))
 }
 
 // Finish does nothing
 func (u *Icarus) Finish() {}
 
+// SetAggregation picks how repeated records of a metric name combine
+// within a window. Names are given without the prefix; the default is AggLast.
+func (i *Icarus) SetAggregation(name string, agg Aggregation) {
+	i.configChanged()
+	i.Store.SetAggregation(i.prefix+name, agg)
+}
+
 // rollStore moves the metric store to the old metric store after obliterating the latter
-func (i *Icarus) rollStore() {
-	ii := 0
-	for _ = range i.Ticker.C {
-		//10 seconds -> minute
-		ii = (ii + 1) % 6
+// It stops after a last rollup once ingest has been idle too long, see SetIdleTimeout.
+// Rollups run on their own goroutine, so a slow one never holds up a roll and
+// the windows keep their length; ticks that come while a rollup runs are skipped.
+func (i *Icarus) rollStore(ticks <-chan time.Time) {
+	defer close(i.stopped)
+	rollups := make(chan bool, 1)
+	rolledUp := make(chan bool)
+	go func() {
+		defer close(rolledUp)
+		for range rollups {
+			i.rollup()
+		}
+	}()
+	finish := func() {
+		close(rollups)
+		<-rolledUp
 		i.rollup()
-		if ii == 0 {
-			i.rollStoreBusiness()
+	}
+	var idle <-chan time.Time
+	var timer *time.Timer
+	ii := 0
+	for {
+		select {
+		case <-ticks:
+			//10 seconds -> minute
+			ii = (ii + 1) % 6
+			select {
+			case rollups <- true:
+			default:
+			}
+			if ii == 0 {
+				i.rollStoreBusiness()
+			}
+		case <-i.early:
+			select {
+			case rollups <- true:
+			default:
+			}
+		case <-i.idleChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+			idle = nil
+			if timeout := i.idleTimeout(); timeout > 0 {
+				timer = time.NewTimer(timeout)
+				idle = timer.C
+			}
+		case <-idle:
+			since := time.Since(time.Unix(0, atomic.LoadInt64(&i.lastRecord)))
+			if timeout := i.idleTimeout(); since < timeout {
+				timer = time.NewTimer(timeout - since)
+				idle = timer.C
+				continue
+			}
+			finish()
+			return
+		case <-i.flow.drained:
+			finish()
+			return
+		}
+	}
+}
+
+// SetRollupCount brings the next rollup forward once count samples have been
+// stored since the last one, so bursts show up without waiting for the tick.
+// The ticker keeps going as before. Zero, the default, only rolls up on ticks.
+func (i *Icarus) SetRollupCount(count int) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.rollupCount = int64(count)
+}
+
+// countTowardsRollup counts a stored sample and asks for a rollup once there are enough.
+func (i *Icarus) countTowardsRollup() {
+	since := atomic.AddInt64(&i.sinceRollup, 1)
+	i.recordMux.RLock()
+	count := i.rollupCount
+	i.recordMux.RUnlock()
+	if (count > 0) && (since >= count) {
+		select {
+		case i.early <- true:
+		default:
 		}
 	}
 }
 
+// SetIdleTimeout stops the rollup ticker, after one last rollup, once nothing
+// has been recorded for the timeout. The last page keeps being served. Zero,
+// the default, never stops.
+func (i *Icarus) SetIdleTimeout(timeout time.Duration) {
+	i.configChanged()
+	i.recordMux.Lock()
+	i.idle = timeout
+	i.recordMux.Unlock()
+	atomic.StoreInt64(&i.lastRecord, time.Now().UnixNano())
+	select {
+	case i.idleChanged <- true:
+	default:
+	}
+}
+
+func (i *Icarus) idleTimeout() time.Duration {
+	i.recordMux.RLock()
+	defer i.recordMux.RUnlock()
+	return i.idle
+}
+
+// rollStoreBusiness rolls the store. It only needs the store's own lock, so it
+// never waits on a rollup.
 func (i *Icarus) rollStoreBusiness() {
+	now := i.now().Unix()
+	i.Store.RollAt(now)
+	i.windowGauges(now)
+}
+
+// windowGauges sets the gauges describing the store's windows as of now,
+// unix seconds.
+func (i *Icarus) windowGauges(now int64) {
+	i.gauge(icarusRetainedWindows).Set(float64(i.Store.Retained()))
+	i.gauge(icarusOldestWindowAge).Set(float64(now - i.Store.Oldest()))
+}
+
+// SetLateGrace has a sample timestamped up to grace before the window the
+// store is filling started go into the one before, so a sample that arrives
+// just after a roll counts in the window it belongs to. It needs samples with
+// explicit timestamps; zero, the default, turns it off.
+func (i *Icarus) SetLateGrace(grace time.Duration) {
+	i.configChanged()
+	i.Store.SetLateGrace(grace)
+}
+
+// errWindows is what SetWindows says to fewer than one window.
+var errWindows = errors.New("the store needs at least one window")
+
+// SetWindows changes how many windows, each a minute of rollups, the store
+// keeps. It needs at least one.
+func (i *Icarus) SetWindows(windows int) error {
+	if windows < 1 {
+		return errWindows
+	}
+	i.configChanged()
 	i.Lock()
 	defer i.Unlock()
-	i.Store.Roll()
+	i.Store.Resize(windows)
+	i.windowGauges(i.now().Unix())
+	return nil
 }
 
 // MetricToProm changes a map into a string.
 func MetricToProm(met util.Metric) string {
-	name := met.Desc["__name__"]
-	kvprune := make(map[string]string)
-	for key, val := range met.Desc {
-		if (key == "_hash") || (key == "__name__") || (val == "") || (key == "ft_target") {
-			continue
-		}
-		kvprune[key] = val
-	}
-	sorted := make([]string, len(kvprune))
-	index := 0
-	for key := range kvprune {
-		sorted[index] = key
-		index++
-	}
-	out := make([]string, len(sorted))
-	sort.Strings(sorted)
-	for ii, xx := range sorted {
-		out[ii] = xx + "=\"" + met.Desc[xx] + "\""
-	}
-	return name + "{" + strings.Join(out, ",") + "} " + strconv.FormatFloat(met.Data.Val, 'f', -1, 32) + "\n"
+	return promFormat{}.metric(met)
 }
 
 // rollup prepares the local store for emission.
 func (i *Icarus) rollup() {
 	i.Lock()
 	defer i.Unlock()
-	useBuffer := bytes.NewBuffer([]byte("\n# These metrics generated by icarus.\n"))
-	useMets := i.Store.Dump()
-	metrics := 0
-	// whatever the work item level is, the metric name, the anomalies
-	for _, val := range useMets {
-		if !math.IsNaN(val.Data.Val) {
+	i.rejectRatio(atomic.SwapInt64(&i.sinceRollup, 0), atomic.SwapInt64(&i.rejectedSinceRollup, 0))
+	useBuffer := newAgedBuffer("\n# These metrics generated by icarus.\n")
+	slowBuffer := newAgedBuffer("")
+	window := i.Store.Current()
+	stored, storedSeen := i.Store.DumpSeen()
+	seen := lastSeen(storedSeen)
+	i.distinct.rolledUp(len(stored), i.gauge(icarusSeriesHighWater), i.gauge(icarusSeriesSeen))
+	useMets := i.mergeHistograms(stored, seen)
+	i.ordered(useMets)
+	refreshSlow := i.lanes.tick()
+	// icarus's own series carry the environment labels like the stored ones.
+	synthetic := func(val util.Metric) {
+		useBuffer.WriteString(i.format.metric(i.withEnvLabels(val)))
+	}
+	synthetic(i.configInfo())
+	// the heartbeat moves on every rollup, data or not, to show the loop is alive.
+	i.heartbeat++
+	synthetic(util.Metric{
+		Desc: map[string]string{"__name__": i.prefix + "heartbeat"},
+		Data: util.DataPoint{Val: float64(i.heartbeat)},
+	})
+	for _, val := range i.degraded() {
+		synthetic(val)
+	}
+	metrics, slowMetrics := 0, 0
+	// render writes a series to the page, or says it did not.
+	render := func(val util.Metric) bool {
+		if i.belowMin(val) {
+			return false
+		}
+		buffer := useBuffer
+		if !i.lanes.slow(i.unprefixed(val.Desc["__name__"])) {
 			metrics++
-			useBuffer.Write([]byte(MetricToProm(val)))
+		} else if refreshSlow {
+			slowMetrics++
+			buffer = slowBuffer
+		} else {
+			return false
+		}
+		text := i.format.metric(i.expose(val))
+		if at, ok := seen.of(val.Desc); ok {
+			buffer.row(text, at)
+		} else {
+			buffer.WriteString(text)
+		}
+		return true
+	}
+	// whatever the work item level is, the metric name, the anomalies.
+	// One-shots are forgotten once they make it onto a page, or straight
+	// away if they never can, being NaN or below their minimum.
+	oneShots := make([]util.Metric, 0)
+	for _, val := range useMets {
+		unservable := math.IsNaN(val.Data.Val) || i.belowMin(val)
+		if math.IsNaN(val.Data.Val) {
+			i.countNaN()
+		}
+		if (unservable || render(val)) && val.OneShot {
+			oneShots = append(oneShots, val)
 		}
 	}
-	icarusReturnMetrics.WithLabelValues("metrics").Observe(float64(metrics))
-	i.serve.Next().Write(useBuffer.String())
-	i.serve = i.serve.Next()
+	i.Store.Forget(oneShots)
+	for _, val := range i.histogramQuantiles(useMets, seen) {
+		render(val)
+	}
+	for _, val := range i.rates.flush(i.now(), seen) {
+		render(val)
+	}
+	for _, val := range i.derivs.flush(stored, seen) {
+		render(val)
+	}
+	if refreshSlow {
+		i.lanes.page, i.lanes.rows, i.lanes.count = slowBuffer.String(), slowBuffer.rows, slowMetrics
+	}
+	useBuffer.append(i.lanes.page, i.lanes.rows)
+	metrics += i.lanes.count
+	if metrics == 0 {
+		useBuffer.WriteString(i.emptySection())
+	}
+	i.summaryVec(icarusReturnMetrics).WithLabelValues("metrics").Observe(float64(metrics))
+	synthetic(i.readyMetric(true))
+	page := i.writePage()
+	page.writeRows(useBuffer.String(), useBuffer.rows, window)
+	atomic.StoreInt32(&i.ready, 1)
+	i.gauge(icarusRollupBytes).Set(float64(useBuffer.Len()))
+	i.windowGauges(i.now().Unix())
+	i.publish(page)
+	i.notify(useBuffer.String())
+	i.refreshDefaults()
+	i.expireScrapes()
+	i.saveCounters()
 }
 
 // aggPromDefaults gets everything out of the prometheus
-// default registry and preps it for sending.
-func aggPromDefaults(useBuffer *bytes.Buffer) {
-	mfs, _ := prometheus.DefaultGatherer.Gather()
+// default registry and preps it for sending, adding labels to every series
+// that does not have them.
+func aggPromDefaults(useBuffer *bytes.Buffer, labels map[string]string) {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		icarusErrorCounter.WithLabelValues(errGather).Inc()
+	}
 	useBuffer.Write([]byte("# Prometheus default registry metrics\n"))
+	family := bytes.NewBuffer([]byte{})
 	for _, mf := range mfs {
-		expfmt.MetricFamilyToText(useBuffer, mf)
+		for _, m := range mf.Metric {
+			m.Label = withLabelPairs(m.Label, labels)
+		}
+		// only keep families that render completely.
+		family.Reset()
+		if _, err := expfmt.MetricFamilyToText(family, mf); err != nil {
+			icarusErrorCounter.WithLabelValues(errEncode).Inc()
+			continue
+		}
+		useBuffer.Write(family.Bytes())
+	}
+}
+
+// withLabelPairs is pairs with labels added, sorted by name, leaving alone
+// those pairs already has.
+func withLabelPairs(pairs []*dto.LabelPair, labels map[string]string) []*dto.LabelPair {
+	if len(labels) == 0 {
+		return pairs
+	}
+	have := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		have[pair.GetName()] = true
+	}
+	for name, val := range labels {
+		if !have[name] {
+			name, val := name, val
+			pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &val})
+		}
 	}
+	sort.Slice(pairs, func(a, b int) bool { return pairs[a].GetName() < pairs[b].GetName() })
+	return pairs
 }
 
 //HandleFunc is an http handlefunc function. Apes a prometheus endpoint.
 func (i *Icarus) HandleFunc(w http.ResponseWriter, r *http.Request) {
-	useBuffer := bytes.NewBufferString("")
-	aggPromDefaults(useBuffer)
-	output := useBuffer.String() + i.serve.Read()
-	icarusRequestCounter.Inc()
-	icarusReturnSize.Observe(float64(len(output)))
-	fmt.Fprint(w, output)
+	inProgress := i.gauge(icarusScrapesInProgress)
+	inProgress.Inc()
+	defer inProgress.Dec()
+	closed, expired := i.closedFor()
+	if expired {
+		http.Error(w, "icarus is closed", http.StatusServiceUnavailable)
+		return
+	}
+	openMetrics := i.negotiate(r)
+	maxAge, err := i.maxAgeFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	contentType := "text/plain; version=0.0.4"
+	var output string
+	switch {
+	case openMetrics:
+		// OpenMetrics has no room for comments, so says nothing of closing.
+		contentType = openMetricsType
+		output = i.openMetricsOutput(maxAge)
+	case maxAge > 0:
+		output = i.freshOutput(maxAge)
+	default:
+		output = i.scrapeOutput()
+	}
+	if closed && !openMetrics {
+		output += "# icarus is closed, this is its last page.\n"
+	}
+	i.countRequest()
+	i.observer(icarusReturnSize).Observe(float64(len(output)))
+	// Say up front how much is coming and push it all out, rather than
+	// leaning on HTTP/1 connection close semantics to end the response.
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	io.WriteString(w, output)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	i.scraped()
 }
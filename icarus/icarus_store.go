@@ -1,50 +1,392 @@
 package icarus
 
 import (
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+var (
+	icarusHashCollisions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "icarus_hash_collisions_total",
+		Help: "How many samples had the same store key as a different label set?",
+	})
+	icarusStoreLockWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "icarus_store_lock_wait_seconds",
+		Help:    "How long do store operations wait for the store lock, sampled?",
+		Buckets: prometheus.ExponentialBuckets(0.000001, 10, 8),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(icarusHashCollisions)
+	prometheus.MustRegister(icarusStoreLockWait)
+}
+
+// lockSample is how often a store operation times its wait for the lock,
+// one in lockSample, so the timing costs next to nothing.
+const lockSample = 16
+
+// storeLocks counts store lock acquisitions to pick the ones to time.
+var storeLocks uint32
+
+// Aggregation says how repeated samples of one series combine within a window.
+type Aggregation int
+
+const (
+	// AggLast keeps the most recent sample. This is the default.
+	AggLast Aggregation = iota
+	// AggSum adds the samples together, e.g. for event counts.
+	AggSum
+	// AggAvg keeps the mean of the samples.
+	AggAvg
+	// AggMin keeps the smallest sample.
+	AggMin
+	// AggMax keeps the largest sample.
+	AggMax
+)
+
+// combine folds a new sample into the current one; count includes the new sample.
+func (a Aggregation) combine(old, met util.Metric, count int) util.Metric {
+	switch a {
+	case AggSum:
+		met.Data.Val += old.Data.Val
+	case AggAvg:
+		met.Data.Val = old.Data.Val + (met.Data.Val-old.Data.Val)/float64(count)
+	case AggMin:
+		met.Data.Val = math.Min(old.Data.Val, met.Data.Val)
+	case AggMax:
+		met.Data.Val = math.Max(old.Data.Val, met.Data.Val)
+	}
+	return met
+}
+
+// entryStats is what the store keeps about a series in a window besides
+// the metric itself.
+type entryStats struct {
+	// Count is how many samples made the metric.
+	Count int
+	// Seq orders entries by when they were last updated.
+	Seq uint64
+	// First orders entries by when the series was first inserted, carried
+	// over from older windows, see DumpOrdered.
+	First uint64
+	// Seen is when the entry was last updated, unix seconds.
+	Seen int64
+}
+
+// storeEntry is a metric in a window along with its entryStats.
+type storeEntry struct {
+	Metric util.Metric
+	entryStats
+}
+
+// windowEntry is a storeEntry and when its window started, unix seconds.
+type windowEntry struct {
+	storeEntry
+	Start int64
+}
+
 // IcarusStore holds sets of metrics and retires them as necessary.
 type IcarusStore struct {
 	*sync.Mutex
 	Keep    int
 	Index   int
 	Metrics []map[string]util.Metric
+	// stats runs alongside Metrics, window for window and key for key.
+	stats []map[string]entryStats
+	// Starts is when each window started filling, unix seconds, 0 if never.
+	Starts []int64
+	aggs   map[string]Aggregation
+	// key identifies a series, util.MapSSToS unless SetKeyFunc says otherwise.
+	key           func(map[string]string) string
+	logCollisions bool
+	// seq counts inserts, see storeEntry.Seq.
+	seq uint64
+	// now is the clock storeEntry.Seen is read from.
+	now func() time.Time
+	// grace is how many seconds back a late sample still goes into the window
+	// before, see SetLateGrace.
+	grace int64
+	// dict shares label sets between windows, nil unless SetLabelDictionary.
+	dict *labelDict
 }
 
 // Get back a new implementation of the rolling store
 func NewRollingStore(lookback int) *IcarusStore {
 	var mux sync.Mutex
 	out := IcarusStore{&mux, lookback,
-		0, make([]map[string]util.Metric, lookback, lookback)}
+		0, make([]map[string]util.Metric, lookback, lookback),
+		make([]map[string]entryStats, lookback, lookback),
+		make([]int64, lookback, lookback), make(map[string]Aggregation),
+		util.MapSSToS, false, 0, time.Now, 0, nil}
 	for ii := range out.Metrics {
 		out.Metrics[ii] = make(map[string]util.Metric)
+		out.stats[ii] = make(map[string]entryStats)
 	}
+	out.Starts[0] = time.Now().Unix()
 	return &out
 }
 
+// SetAggregation picks how samples for a metric name combine within a window.
+func (r *IcarusStore) SetAggregation(name string, agg Aggregation) {
+	r.lock()
+	defer r.Unlock()
+	r.aggs[name] = agg
+}
+
+// SetKeyFunc swaps how series are keyed, e.g. for a shorter hash. Keys that
+// collide, different label sets with the same key, are counted and, with debug,
+// logged; the samples still merge. nil goes back to the full label set, which
+// never collides.
+func (r *IcarusStore) SetKeyFunc(key func(map[string]string) string, debug bool) {
+	r.lock()
+	defer r.Unlock()
+	if key == nil {
+		key = util.MapSSToS
+	}
+	r.key, r.logCollisions = key, debug
+}
+
+// hashKey keys a series by its _hash label, the identity hash it came with,
+// or by its full label set if it has none.
+func hashKey(desc map[string]string) string {
+	if hash, ok := desc["_hash"]; ok {
+		return "_hash=" + hash
+	}
+	return util.MapSSToS(desc)
+}
+
+// SetHashKeys has the store key series by their _hash label, which is
+// cheaper than the full label set, counting under
+// icarus_hash_collisions_total the samples whose _hash matches a series with
+// other labels and, with debug, logging them. Colliding samples merge into the
+// series. Off, the default, series are keyed by their full label set and
+// never collide.
+func (i *Icarus) SetHashKeys(on, debug bool) {
+	i.configChanged()
+	if !on {
+		i.Store.SetKeyFunc(nil, debug)
+		return
+	}
+	i.Store.SetKeyFunc(hashKey, debug)
+}
+
+// sameLabels compares label sets.
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, val := range a {
+		if other, ok := b[key]; !ok || (other != val) {
+			return false
+		}
+	}
+	return true
+}
+
+// lock takes the store lock, timing the wait now and then for
+// icarus_store_lock_wait_seconds.
+func (r *IcarusStore) lock() {
+	if atomic.AddUint32(&storeLocks, 1)%lockSample != 0 {
+		r.Lock()
+		return
+	}
+	start := time.Now()
+	r.Lock()
+	icarusStoreLockWait.Observe(time.Since(start).Seconds())
+}
+
 // Roll the rolling store
 func (r *IcarusStore) Roll() {
-	r.Lock()
+	r.RollAt(time.Now().Unix())
+}
+
+// RollAt rolls the store, the new window starting at now in unix seconds.
+func (r *IcarusStore) RollAt(now int64) {
+	r.lock()
 	defer r.Unlock()
 	r.Index = (r.Index + 1) % r.Keep
 	r.Metrics[r.Index] = make(map[string]util.Metric)
+	r.stats[r.Index] = make(map[string]entryStats)
+	r.Starts[r.Index] = now
+	r.pruneDict()
+}
+
+// Resize changes how many windows the store keeps, holding on to the newest
+// ones. It always keeps at least one.
+func (r *IcarusStore) Resize(keep int) {
+	if keep < 1 {
+		keep = 1
+	}
+	r.lock()
+	defer r.Unlock()
+	metrics := make([]map[string]util.Metric, keep, keep)
+	stats := make([]map[string]entryStats, keep, keep)
+	starts := make([]int64, keep, keep)
+	for ii := range metrics {
+		metrics[ii] = make(map[string]util.Metric)
+		stats[ii] = make(map[string]entryStats)
+	}
+	// the current window goes to 0, older ones count back from the end.
+	for ii := 0; (ii < keep) && (ii < r.Keep); ii++ {
+		metrics[(keep-ii)%keep] = r.Metrics[(r.Index-ii+r.Keep)%r.Keep]
+		stats[(keep-ii)%keep] = r.stats[(r.Index-ii+r.Keep)%r.Keep]
+		starts[(keep-ii)%keep] = r.Starts[(r.Index-ii+r.Keep)%r.Keep]
+	}
+	r.Keep, r.Index, r.Metrics, r.stats, r.Starts = keep, 0, metrics, stats, starts
+	r.pruneDict()
+}
+
+// Retained counts the windows holding data, always including the one being filled.
+func (r *IcarusStore) Retained() int {
+	r.lock()
+	defer r.Unlock()
+	count := 1
+	for ii, window := range r.Metrics {
+		if (ii != r.Index) && (len(window) > 0) {
+			count++
+		}
+	}
+	return count
+}
+
+// Current is when the window being filled started, unix seconds.
+func (r *IcarusStore) Current() int64 {
+	r.lock()
+	defer r.Unlock()
+	return r.Starts[r.Index]
+}
+
+// Oldest is when the oldest window Retained counts started, unix seconds.
+func (r *IcarusStore) Oldest() int64 {
+	r.lock()
+	defer r.Unlock()
+	oldest := r.Starts[r.Index]
+	for ii, window := range r.Metrics {
+		if (len(window) > 0) && (r.Starts[ii] != 0) && (r.Starts[ii] < oldest) {
+			oldest = r.Starts[ii]
+		}
+	}
+	return oldest
 }
 
 // Insert something into the current store in the rolling store
 func (r *IcarusStore) Insert(met util.Metric) {
-	r.Lock()
+	r.InsertCapped(met, 0)
+}
+
+// InsertCapped inserts unless that would put more than max series in the
+// current window, false means it did not. Zero max is no cap.
+func (r *IcarusStore) InsertCapped(met util.Metric, max int) bool {
+	r.lock()
 	defer r.Unlock()
-	label := util.MapSSToS(met.Desc)
-	r.Metrics[r.Index][label] = met
+	label := r.key(met.Desc)
+	loc := r.window(met.Data.Time)
+	entry, ok := r.entry(loc, label)
+	if !ok {
+		if (max > 0) && (len(r.Metrics[loc]) >= max) {
+			return false
+		}
+		r.seq++
+		met.Desc = r.shared(label, met.Desc)
+		r.put(loc, label, storeEntry{met, entryStats{Count: 1, Seq: r.seq, First: r.first(label, r.seq), Seen: r.now().Unix()}})
+		return true
+	}
+	// the sample's labels are its own even with the label dictionary on, so
+	// they are compared one by one.
+	if !sameLabels(entry.Metric.Desc, met.Desc) {
+		icarusHashCollisions.Inc()
+		if r.logCollisions {
+			log.Printf("icarus store key %s collides for %v and %v", label, entry.Metric.Desc, met.Desc)
+		}
+	}
+	entry.Count++
+	entry.Metric = r.aggs[met.Desc["__name__"]].combine(entry.Metric, met, entry.Count)
+	entry.Metric.Desc = r.shared(label, entry.Metric.Desc)
+	r.seq++
+	entry.Seq = r.seq
+	entry.Seen = r.now().Unix()
+	r.put(loc, label, entry)
+	return true
 }
 
-// Dump all the []Metrics in the rolling store.
-func (r *IcarusStore) Dump() []util.Metric {
-	r.Lock()
+// entry is the series under label in window loc. Callers hold the lock.
+func (r *IcarusStore) entry(loc int, label string) (storeEntry, bool) {
+	met, ok := r.Metrics[loc][label]
+	return storeEntry{met, r.stats[loc][label]}, ok
+}
+
+// put stores entry under label in window loc. Callers hold the lock.
+func (r *IcarusStore) put(loc int, label string, entry storeEntry) {
+	r.Metrics[loc][label] = entry.Metric
+	r.stats[loc][label] = entry.entryStats
+}
+
+// remove drops the series under label from window loc. Callers hold the lock.
+func (r *IcarusStore) remove(loc int, label string) {
+	delete(r.Metrics[loc], label)
+	delete(r.stats[loc], label)
+}
+
+// SetLateGrace has samples timestamped up to grace before the current window
+// started go into the window before it, so a sample that missed the roll by
+// a little still counts where it belongs. Zero, the default, puts every
+// sample in the current window.
+func (r *IcarusStore) SetLateGrace(grace time.Duration) {
+	r.lock()
 	defer r.Unlock()
+	r.grace = int64(grace / time.Second)
+}
+
+// window is the index of the window a sample timestamped at ts goes into.
+// Callers hold the lock.
+func (r *IcarusStore) window(ts int64) int {
+	start := r.Starts[r.Index]
+	prev := (r.Index - 1 + r.Keep) % r.Keep
+	if (r.grace > 0) && (ts != 0) && (ts < start) && (ts >= start-r.grace) && (prev != r.Index) && (r.Starts[prev] != 0) {
+		return prev
+	}
+	return r.Index
+}
+
+// first is when the series under label was first inserted into any retained
+// window, or seq if it is new. Callers hold the lock.
+func (r *IcarusStore) first(label string, seq uint64) uint64 {
+	for loc := range r.Metrics {
+		if entry, ok := r.entry(loc, label); ok && (entry.First < seq) {
+			seq = entry.First
+		}
+	}
+	return seq
+}
+
+// Latest is the most recently updated series called name, if there is one.
+func (r *IcarusStore) Latest(name string) (util.Metric, bool) {
+	r.lock()
+	defer r.Unlock()
+	var latest storeEntry
+	found := false
+	for loc, window := range r.Metrics {
+		for key, met := range window {
+			if stats := r.stats[loc][key]; (met.Desc["__name__"] == name) && (!found || (stats.Seq > latest.Seq)) {
+				latest, found = storeEntry{met, stats}, true
+			}
+		}
+	}
+	return latest.Metric, found
+}
+
+// merged is every series in the store, newer windows winning. Callers hold the lock.
+func (r *IcarusStore) merged() map[string]util.Metric {
 	temp := make(map[string]util.Metric)
 	for ii := 1; ii <= r.Keep; ii++ {
 		loc := (r.Index + ii) % r.Keep
@@ -52,6 +394,126 @@ func (r *IcarusStore) Dump() []util.Metric {
 			temp[key] = val
 		}
 	}
+	return temp
+}
+
+// entries is the newest entry of every series in the store, with the start
+// of its window.
+func (r *IcarusStore) entries() map[string]windowEntry {
+	r.lock()
+	defer r.Unlock()
+	newest := make(map[string]windowEntry)
+	for ii := 1; ii <= r.Keep; ii++ {
+		loc := (r.Index + ii) % r.Keep
+		for key := range r.Metrics[loc] {
+			entry, _ := r.entry(loc, key)
+			newest[key] = windowEntry{entry, r.Starts[loc]}
+		}
+	}
+	return newest
+}
+
+// DumpSeen is Dump along with when each series was last updated, unix
+// seconds, by util.MapSSToS of its labels.
+func (r *IcarusStore) DumpSeen() ([]util.Metric, map[string]int64) {
+	newest := r.entries()
+	out := make([]util.Metric, 0, len(newest))
+	seen := make(map[string]int64, len(newest))
+	for _, val := range newest {
+		out = append(out, val.Metric)
+		seen[util.MapSSToS(val.Metric.Desc)] = val.Seen
+	}
+	return out, seen
+}
+
+// Checksum is a hash of everything Dump would return. It only changes when
+// the series or their values do, no matter what order they went in.
+func (r *IcarusStore) Checksum() uint64 {
+	r.lock()
+	defer r.Unlock()
+	temp := r.merged()
+	keys := make([]string, 0, len(temp))
+	for key := range temp {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := fnv.New64a()
+	bits := make([]byte, 8)
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		binary.LittleEndian.PutUint64(bits, math.Float64bits(temp[key].Data.Val))
+		hash.Write(bits)
+	}
+	return hash.Sum64()
+}
+
+// sameData compares datapoints, counting NaN as equal to itself.
+func sameData(a, b util.DataPoint) bool {
+	return (a.Time == b.Time) && (math.Float64bits(a.Val) == math.Float64bits(b.Val))
+}
+
+// Forget removes metrics from every window, unless they have been
+// recorded again since, in which case the newer sample stays.
+func (r *IcarusStore) Forget(mets []util.Metric) {
+	r.lock()
+	defer r.Unlock()
+	for _, met := range mets {
+		label := r.key(met.Desc)
+		for loc, window := range r.Metrics {
+			if entry, ok := window[label]; ok && sameData(entry.Data, met.Data) {
+				r.remove(loc, label)
+			}
+		}
+	}
+}
+
+// Delete removes every series whose labels match from every window, and
+// says how many series went, each once however many windows held it.
+func (r *IcarusStore) Delete(match func(map[string]string) bool) int {
+	r.lock()
+	defer r.Unlock()
+	gone := make(map[string]bool)
+	for loc, window := range r.Metrics {
+		for label, met := range window {
+			if match(met.Desc) {
+				r.remove(loc, label)
+				gone[label] = true
+			}
+		}
+	}
+	return len(gone)
+}
+
+// Range is every sample in the windows that overlap from to to, unix seconds
+// inclusive, oldest window first. A series shows up once per window it is in.
+// The current window runs on forever, the others until the next one started.
+func (r *IcarusStore) Range(from, to int64) []util.Metric {
+	r.lock()
+	defer r.Unlock()
+	out := make([]util.Metric, 0)
+	for ii := 1; ii <= r.Keep; ii++ {
+		loc := (r.Index + ii) % r.Keep
+		start := r.Starts[loc]
+		if (start == 0) || (start > to) {
+			continue
+		}
+		if loc != r.Index {
+			if end := r.Starts[(loc+1)%r.Keep]; end <= from {
+				continue
+			}
+		}
+		for _, val := range r.Metrics[loc] {
+			out = append(out, val)
+		}
+	}
+	return out
+}
+
+// Dump all the []Metrics in the rolling store.
+func (r *IcarusStore) Dump() []util.Metric {
+	r.lock()
+	defer r.Unlock()
+	temp := r.merged()
 	out := make([]util.Metric, len(temp), len(temp))
 	index := 0
 	for _, val := range temp {
@@ -60,3 +522,30 @@ func (r *IcarusStore) Dump() []util.Metric {
 	}
 	return out
 }
+
+// DumpOrdered is Dump in the order the series were first inserted, oldest first.
+func (r *IcarusStore) DumpOrdered() []util.Metric {
+	r.lock()
+	defer r.Unlock()
+	firsts := make(map[string]uint64)
+	temp := make(map[string]util.Metric)
+	for ii := 1; ii <= r.Keep; ii++ {
+		loc := (r.Index + ii) % r.Keep
+		for key, val := range r.Metrics[loc] {
+			temp[key] = val
+			if first, ok := firsts[key]; !ok || (r.stats[loc][key].First < first) {
+				firsts[key] = r.stats[loc][key].First
+			}
+		}
+	}
+	keys := make([]string, 0, len(temp))
+	for key := range temp {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool { return firsts[keys[a]] < firsts[keys[b]] })
+	out := make([]util.Metric, len(keys))
+	for ii, key := range keys {
+		out[ii] = temp[key]
+	}
+	return out
+}
@@ -1,9 +1,14 @@
 package icarus
 
 import (
+	"math"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/luuphu25/data-sidecar/util"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func SuiteTestStore(t *testing.T, x *IcarusStore, cap int) {
@@ -35,3 +40,299 @@ func TestRollingStore(t *testing.T) {
 	g := NewRollingStore(2)
 	SuiteTestStore(t, g, 2)
 }
+
+func TestAggregation(t *testing.T) {
+	cases := []struct {
+		name string
+		agg  Aggregation
+		want float64
+	}{
+		{"last", AggLast, 2},
+		{"sum", AggSum, 9},
+		{"avg", AggAvg, 3},
+		{"min", AggMin, 2},
+		{"max", AggMax, 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			x := NewRollingStore(2)
+			x.SetAggregation("hello", c.agg)
+			for _, val := range []float64{3, 4, 2} {
+				x.Insert(util.Metric{Desc: map[string]string{"a": "B", "__name__": "hello"}, Data: util.DataPoint{Val: val}})
+			}
+			if g := x.Dump(); len(g) != 1 || g[0].Data.Val != c.want {
+				t.Error(g)
+			}
+		})
+	}
+	t.Run("per name", func(t *testing.T) {
+		x := NewRollingStore(2)
+		x.SetAggregation("hello", AggSum)
+		for _, val := range []float64{3, 4} {
+			x.Insert(util.Metric{Desc: map[string]string{"__name__": "other"}, Data: util.DataPoint{Val: val}})
+		}
+		if g := x.Dump(); len(g) != 1 || g[0].Data.Val != 4 {
+			t.Error(g)
+		}
+	})
+	t.Run("new window starts over", func(t *testing.T) {
+		x := NewRollingStore(2)
+		x.SetAggregation("hello", AggSum)
+		x.Insert(util.Metric{Desc: map[string]string{"__name__": "hello"}, Data: util.DataPoint{Val: 3}})
+		x.Roll()
+		x.Insert(util.Metric{Desc: map[string]string{"__name__": "hello"}, Data: util.DataPoint{Val: 4}})
+		if g := x.Dump(); len(g) != 1 || g[0].Data.Val != 4 {
+			t.Error(g)
+		}
+	})
+}
+
+func TestResize(t *testing.T) {
+	x := NewRollingStore(3)
+	for _, val := range []float64{1, 2, 3} {
+		x.Roll()
+		x.Insert(util.Metric{Desc: map[string]string{"__name__": "hello"}, Data: util.DataPoint{Val: val}})
+	}
+	x.Resize(2)
+	if g := x.Dump(); len(g) != 1 || g[0].Data.Val != 3 {
+		t.Error(g)
+	}
+	x.Roll()
+	if g := x.Dump(); len(g) != 1 || g[0].Data.Val != 3 {
+		t.Error(g)
+	}
+	x.Roll()
+	if g := x.Dump(); len(g) != 0 {
+		t.Error(g)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	mets := []util.Metric{
+		{Desc: map[string]string{"__name__": "a", "x": "1"}, Data: util.DataPoint{Val: 1}},
+		{Desc: map[string]string{"__name__": "a", "x": "2"}, Data: util.DataPoint{Val: 2}},
+		{Desc: map[string]string{"__name__": "b"}, Data: util.DataPoint{Val: 3}},
+	}
+	x, y := NewRollingStore(2), NewRollingStore(2)
+	for ii := range mets {
+		x.Insert(mets[ii])
+		y.Insert(mets[len(mets)-1-ii])
+	}
+	if x.Checksum() != y.Checksum() {
+		t.Error("order changed the checksum")
+	}
+	y.Insert(util.Metric{Desc: map[string]string{"__name__": "b"}, Data: util.DataPoint{Val: 4}})
+	if x.Checksum() == y.Checksum() {
+		t.Error("value change kept the checksum")
+	}
+	if NewRollingStore(2).Checksum() == x.Checksum() {
+		t.Error("empty store matches")
+	}
+}
+
+func TestForget(t *testing.T) {
+	x := NewRollingStore(2)
+	first := util.Metric{Desc: map[string]string{"__name__": "hello"}, Data: util.DataPoint{Val: 1}}
+	x.Insert(first)
+	x.Roll()
+	x.Insert(first)
+	x.Forget([]util.Metric{first})
+	if g := x.Dump(); len(g) != 0 {
+		t.Error(g)
+	}
+	x.Insert(first)
+	x.Insert(util.Metric{Desc: map[string]string{"__name__": "hello"}, Data: util.DataPoint{Val: 2}})
+	x.Forget([]util.Metric{first})
+	if g := x.Dump(); len(g) != 1 || g[0].Data.Val != 2 {
+		t.Error(g)
+	}
+	nan := util.Metric{Desc: map[string]string{"__name__": "nan"}, Data: util.DataPoint{Val: math.NaN()}}
+	x.Insert(nan)
+	x.Forget([]util.Metric{nan})
+	if g := x.Dump(); len(g) != 1 {
+		t.Error(g)
+	}
+}
+
+func TestRange(t *testing.T) {
+	x := NewRollingStore(3)
+	for ii, val := range []float64{1, 2, 3} {
+		x.RollAt(int64(100 * (ii + 1)))
+		x.Insert(util.Metric{Desc: map[string]string{"__name__": "hello"}, Data: util.DataPoint{Val: val}})
+	}
+	// windows started at 100, 200 and 300, the last still filling.
+	values := func(mets []util.Metric) []float64 {
+		out := make([]float64, len(mets))
+		for ii, met := range mets {
+			out[ii] = met.Data.Val
+		}
+		return out
+	}
+	for _, tc := range []struct {
+		from, to int64
+		want     []float64
+	}{
+		{150, 250, []float64{1, 2}},
+		{200, 200, []float64{2}},
+		{0, 1000, []float64{1, 2, 3}},
+		{1000, 2000, []float64{3}},
+		{0, 50, []float64{}},
+	} {
+		g := values(x.Range(tc.from, tc.to))
+		if len(g) != len(tc.want) {
+			t.Error(tc.from, tc.to, g)
+			continue
+		}
+		for ii := range g {
+			if g[ii] != tc.want[ii] {
+				t.Error(tc.from, tc.to, g)
+			}
+		}
+	}
+}
+
+func TestKeyCollisions(t *testing.T) {
+	x := NewRollingStore(2)
+	a := util.Metric{Desc: map[string]string{"__name__": "hello", "a": "1"}, Data: util.DataPoint{Val: 1}}
+	b := util.Metric{Desc: map[string]string{"__name__": "hello", "a": "2"}, Data: util.DataPoint{Val: 2}}
+	before := value(icarusHashCollisions)
+	x.Insert(a)
+	x.Insert(b)
+	x.Insert(a)
+	if g := value(icarusHashCollisions); g != before {
+		t.Error(g)
+	}
+	// a key that only looks at the name makes every hello collide.
+	x = NewRollingStore(2)
+	x.SetKeyFunc(func(desc map[string]string) string { return desc["__name__"] }, true)
+	x.Insert(a)
+	x.Insert(a)
+	x.Insert(b)
+	if g := value(icarusHashCollisions); g != before+1 {
+		t.Error(g)
+	}
+	if g := x.Dump(); len(g) != 1 {
+		t.Error(g)
+	}
+}
+
+func TestHashKeys(t *testing.T) {
+	i := newIcarus("ft_", time.NewTicker(time.Hour), make(chan time.Time))
+	i.SetHashKeys(true, false)
+	before := value(icarusHashCollisions)
+	i.Record(helper(map[string]string{"__name__": "x", "a": "1", "_hash": "h1"}, 1))
+	i.Record(helper(map[string]string{"__name__": "x", "a": "2", "_hash": "h2"}, 2))
+	i.Record(helper(map[string]string{"__name__": "x", "a": "1", "_hash": "h1"}, 3))
+	i.Drain()
+	if g := value(icarusHashCollisions); g != before {
+		t.Error(g)
+	}
+	// a different label set under a _hash already taken collides.
+	i.Record(helper(map[string]string{"__name__": "x", "a": "3", "_hash": "h1"}, 4))
+	i.Drain()
+	if g := value(icarusHashCollisions); g != before+1 {
+		t.Error(g)
+	}
+	if g := i.Store.Dump(); len(g) != 2 {
+		t.Error(g)
+	}
+}
+
+func TestDumpOrdered(t *testing.T) {
+	store := NewRollingStore(3)
+	for _, name := range []string{"c", "a", "b"} {
+		store.Insert(helper(map[string]string{"__name__": name}, 1))
+	}
+	store.Roll()
+	// a keeps its place after the roll, d is new.
+	store.Insert(helper(map[string]string{"__name__": "d"}, 1))
+	store.Insert(helper(map[string]string{"__name__": "a"}, 2))
+	got := ""
+	for _, met := range store.DumpOrdered() {
+		got += met.Desc["__name__"]
+	}
+	if got != "cabd" {
+		t.Error(got)
+	}
+}
+
+func TestOldest(t *testing.T) {
+	store := NewRollingStore(2)
+	store.RollAt(100)
+	if g := store.Oldest(); g != 100 {
+		t.Error(g)
+	}
+	store.Insert(helper(map[string]string{"__name__": "x"}, 1))
+	store.RollAt(160)
+	if g := store.Oldest(); g != 100 {
+		t.Error(g)
+	}
+	store.RollAt(220)
+	if g := store.Oldest(); g != 220 {
+		t.Error(g)
+	}
+}
+
+func TestLateGrace(t *testing.T) {
+	store := NewRollingStore(3)
+	store.SetLateGrace(10 * time.Second)
+	store.RollAt(100)
+	store.RollAt(160)
+	late := util.Metric{Desc: map[string]string{"__name__": "late"}, Data: util.DataPoint{Val: 1, Time: 155}}
+	tooLate := util.Metric{Desc: map[string]string{"__name__": "too_late"}, Data: util.DataPoint{Val: 1, Time: 140}}
+	store.Insert(late)
+	store.Insert(tooLate)
+	store.Insert(helper(map[string]string{"__name__": "untimed"}, 1))
+	if _, ok := store.Metrics[1][store.key(late.Desc)]; !ok {
+		t.Error(store.Metrics)
+	}
+	if g := len(store.Metrics[2]); g != 2 {
+		t.Error(store.Metrics)
+	}
+}
+
+func TestStoreLockWait(t *testing.T) {
+	var before dto.Metric
+	icarusStoreLockWait.Write(&before)
+	store := NewRollingStore(2)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for ii := 0; ii < 500; ii++ {
+				store.Insert(helper(map[string]string{"__name__": "x", "w": strconv.Itoa(w), "n": strconv.Itoa(ii)}, 1))
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for ii := 0; ii < 50; ii++ {
+				store.Dump()
+			}
+		}()
+	}
+	wg.Wait()
+	var after dto.Metric
+	icarusStoreLockWait.Write(&after)
+	if g := after.Histogram.GetSampleCount() - before.Histogram.GetSampleCount(); g < (4*550)/lockSample {
+		t.Error(g)
+	}
+	if g := after.Histogram.GetSampleSum() - before.Histogram.GetSampleSum(); g <= 0 {
+		t.Error(g)
+	}
+}
+
+func TestResizeInvalid(t *testing.T) {
+	for _, keep := range []int{0, -3} {
+		x := NewRollingStore(3)
+		x.Insert(helper(map[string]string{"__name__": "x"}, 1))
+		x.Resize(keep)
+		if (x.Keep != 1) || (len(x.Dump()) != 1) {
+			t.Error(keep, x.Keep, x.Dump())
+		}
+		x.Roll()
+		if g := len(x.Dump()); g != 0 {
+			t.Error(keep, g)
+		}
+	}
+}
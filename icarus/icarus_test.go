@@ -1,13 +1,23 @@
 package icarus
 
 import (
+	"bytes"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var ()
@@ -15,6 +25,32 @@ var ()
 func helper(kvs map[string]string, val float64) util.Metric {
 	return util.Metric{Desc: kvs, Data: util.DataPoint{Val: val}}
 }
+
+// value reads the current value out of a counter or gauge.
+func value(m prometheus.Metric) float64 {
+	var out dto.Metric
+	m.Write(&out)
+	if out.Counter != nil {
+		return out.Counter.GetValue()
+	}
+	// histograms count their observations.
+	if out.Histogram != nil {
+		return float64(out.Histogram.GetSampleCount())
+	}
+	return out.Gauge.GetValue()
+}
+
+// eventually waits a little while for the icarus goroutines to catch up.
+func eventually(t *testing.T, f func() bool) {
+	t.Helper()
+	for ii := 0; ii < 200; ii++ {
+		if f() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("condition never met")
+}
 func TestBase(t *testing.T) {
 	i := NewIcarus("ft_")
 	i.Record(helper(map[string]string{"a": "b", "__name__": "x", "G": ""}, 1))
@@ -70,3 +106,590 @@ func TestTableDenoising(t *testing.T) {
 		t.Error(g)
 	}
 }
+
+func TestErrorCounter(t *testing.T) {
+	defer func(g prometheus.Gatherer) { gatherer = g }(gatherer)
+	t.Run("gather", func(t *testing.T) {
+		before := value(icarusErrorCounter.WithLabelValues(errGather))
+		gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return nil, errRead
+		})
+		aggPromDefaults(bytes.NewBuffer([]byte{}), nil)
+		if g := value(icarusErrorCounter.WithLabelValues(errGather)); g != before+1 {
+			t.Error(g)
+		}
+	})
+	t.Run("encode", func(t *testing.T) {
+		before := value(icarusErrorCounter.WithLabelValues(errEncode))
+		gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return []*dto.MetricFamily{{Name: proto.String("empty")}}, nil
+		})
+		buf := bytes.NewBuffer([]byte{})
+		aggPromDefaults(buf, nil)
+		if g := value(icarusErrorCounter.WithLabelValues(errEncode)); g != before+1 {
+			t.Error(g)
+		}
+		if strings.Contains(buf.String(), "empty") {
+			t.Error(buf.String())
+		}
+	})
+	t.Run("validation", func(t *testing.T) {
+		before := value(icarusErrorCounter.WithLabelValues(errValidation))
+		i := NewIcarus("ft_")
+		i.Record(util.Metric{})
+		eventually(t, func() bool {
+			return value(icarusErrorCounter.WithLabelValues(errValidation)) == before+1
+		})
+	})
+}
+
+func TestPagePolicy(t *testing.T) {
+	t.Run("readers only see whole pages", func(t *testing.T) {
+		// no ticks, so every rollup is the writer's.
+		i := newIcarus("ft_", time.NewTicker(time.Hour), make(chan time.Time))
+		i.SetPagePolicy(PageOldest, 3)
+		done := make(chan bool)
+		go func() {
+			// each page carries x one behind its heartbeat.
+			for ii := 0; ii < 300; ii++ {
+				i.Record(helper(map[string]string{"__name__": "x"}, float64(ii)))
+				i.Drain()
+				i.rollup()
+			}
+			close(done)
+		}()
+		heartbeat := regexp.MustCompile(`\nft_heartbeat\{\} (\d+)\n`)
+		x := regexp.MustCompile(`\nft_x\{\} (\d+)\n`)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			page := i.servePage().Read()
+			if page == "" {
+				continue
+			}
+			beat, val := heartbeat.FindStringSubmatch(page), x.FindStringSubmatch(page)
+			if (beat == nil) || (val == nil) || !strings.HasSuffix(page, "ft_ready{} 1\n") {
+				t.Fatal("partial page", page)
+			}
+			b, _ := strconv.Atoi(beat[1])
+			v, _ := strconv.Atoi(val[1])
+			if b != v+1 {
+				t.Fatal("page mixes rollups", b, v)
+			}
+		}
+	})
+	t.Run("in place", func(t *testing.T) {
+		i := NewIcarus("ft_")
+		i.SetPagePolicy(PageInPlace, 1)
+		served := i.servePage()
+		i.rollup()
+		if i.servePage() != served || !strings.Contains(served.Read(), "generated by icarus") {
+			t.Error(served.Read())
+		}
+	})
+	t.Run("keeps the served page", func(t *testing.T) {
+		i := NewIcarus("ft_")
+		i.rollup()
+		i.SetPagePolicy(PageOldest, 3)
+		if g := i.servePage().Read(); !strings.Contains(g, "generated by icarus") {
+			t.Error(g)
+		}
+	})
+}
+
+func TestMetricName(t *testing.T) {
+	t.Run("__name__ wins", func(t *testing.T) {
+		before := value(icarusNameMismatchCounter)
+		desc := map[string]string{"__name__": "x", "name": "y"}
+		if g := metricName(desc); g != "x" || desc["name"] != "y" {
+			t.Error(g, desc)
+		}
+		if g := value(icarusNameMismatchCounter); g != before+1 {
+			t.Error(g)
+		}
+	})
+	t.Run("agreeing names", func(t *testing.T) {
+		before := value(icarusNameMismatchCounter)
+		if g := metricName(map[string]string{"__name__": "x", "name": "x"}); g != "x" {
+			t.Error(g)
+		}
+		if g := value(icarusNameMismatchCounter); g != before {
+			t.Error(g)
+		}
+	})
+	t.Run("name label fallback", func(t *testing.T) {
+		desc := map[string]string{"__name__": "", "name": "y", "a": "b"}
+		if g := metricName(desc); g != "y" {
+			t.Error(g)
+		}
+		if _, ok := desc["name"]; ok {
+			t.Error(desc)
+		}
+	})
+	t.Run("unnamed", func(t *testing.T) {
+		if g := metricName(map[string]string{"a": "b"}); g != "unnamed_metric" {
+			t.Error(g)
+		}
+	})
+	t.Run("stored", func(t *testing.T) {
+		i := NewIcarus("ft_")
+		i.Record(helper(map[string]string{"name": "y", "a": "b"}, 1))
+		eventually(t, func() bool { return len(i.Store.Dump()) == 1 })
+		if g := MetricToProm(i.Store.Dump()[0]); g != "ft_y{a=\"b\"} 1\n" {
+			t.Error(g)
+		}
+	})
+}
+
+func TestSamplesObserved(t *testing.T) {
+	i := NewIcarus("ft_")
+	before := value(icarusSamplesObserved)
+	for ii := 0; ii < 5; ii++ {
+		i.Record(helper(map[string]string{"__name__": "x"}, float64(ii)))
+	}
+	i.Record(util.Metric{})
+	i.Record(helper(map[string]string{"__name__": "y"}, 1))
+	eventually(t, func() bool { return value(icarusSamplesObserved) == before+6 })
+	if g := len(i.Snapshot()); g != 2 {
+		t.Error(g)
+	}
+}
+
+func TestHandleFuncHTTP2(t *testing.T) {
+	i := NewIcarus("ft_")
+	for ii := 0; ii < 5000; ii++ {
+		i.Record(helper(map[string]string{"__name__": "x", "a": strconv.Itoa(ii)}, float64(ii)))
+	}
+	eventually(t, func() bool { return len(i.Snapshot()) == 5000 })
+	i.rollup()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(i.HandleFunc))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Error(resp.Proto)
+	}
+	if g := resp.Header.Get("Content-Length"); g != strconv.Itoa(len(body)) {
+		t.Error(g, len(body))
+	}
+	if g := strings.Count(string(body), "\nft_x{"); g != 5000 {
+		t.Error(g)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetIdleTimeout(100 * time.Millisecond)
+	// keep recording for a while, each one puts off the shutdown.
+	for ii := 0; ii < 6; ii++ {
+		i.Record(helper(map[string]string{"__name__": "x"}, float64(ii)))
+		time.Sleep(30 * time.Millisecond)
+	}
+	select {
+	case <-i.stopped:
+		t.Error("stopped while still recording")
+	default:
+	}
+	select {
+	case <-i.stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("never stopped")
+	}
+	rw := util.NewHTTPResponseWriter()
+	i.HandleFunc(rw, &http.Request{Form: url.Values{}})
+	if g := rw.String(); !strings.Contains(g, "ft_x{} 5\n") {
+		t.Error(g)
+	}
+}
+
+func TestRetainedWindows(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetWindows(4)
+	if g := value(icarusRetainedWindows); g != 1 {
+		t.Error(g)
+	}
+	for ii, want := range []float64{2, 3, 4, 4} {
+		i.Record(helper(map[string]string{"__name__": "x", "a": strconv.Itoa(ii)}, 1))
+		eventually(t, func() bool { return len(i.Snapshot()) == ii+1 })
+		i.rollStoreBusiness()
+		if g := value(icarusRetainedWindows); g != want {
+			t.Error(ii, g)
+		}
+	}
+}
+
+func TestOneShot(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.Record(util.Metric{Desc: map[string]string{"__name__": "event"}, Data: util.DataPoint{Val: 1}, OneShot: true})
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	eventually(t, func() bool { return len(i.Snapshot()) == 2 })
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "ft_event{} 1\n") || !strings.Contains(g, "ft_x{} 1\n") {
+		t.Error(g)
+	}
+	i.rollup()
+	if g := i.servePage().Read(); strings.Contains(g, "ft_event") || !strings.Contains(g, "ft_x{} 1\n") {
+		t.Error(g)
+	}
+	if g := i.Snapshot(); len(g) != 1 {
+		t.Error(g)
+	}
+}
+
+func TestOneShotUnserved(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetMinValue("small", 1)
+	if err := i.SetSlowLane(2, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	stored := func(name string) bool {
+		for _, met := range i.Snapshot() {
+			if met.Desc["__name__"] == "ft_"+name {
+				return true
+			}
+		}
+		return false
+	}
+	i.rollup()
+	for name, val := range map[string]float64{"small": 0.5, "nan": math.NaN(), "slow": 1} {
+		i.Record(util.Metric{Desc: map[string]string{"__name__": name}, Data: util.DataPoint{Val: val}, OneShot: true})
+	}
+	eventually(t, func() bool { return len(i.Snapshot()) == 3 })
+	// the slow lane is not due, so only what can never be served goes.
+	i.rollup()
+	if !stored("slow") || stored("small") || stored("nan") {
+		t.Error(i.Snapshot())
+	}
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "ft_slow{} 1\n") {
+		t.Error(g)
+	}
+	if stored("slow") {
+		t.Error(i.Snapshot())
+	}
+}
+
+// TestServePageConcurrency is meant for go test -race.
+func TestServePageConcurrency(t *testing.T) {
+	sp := NewServePage()
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for ii := 0; ii < 100; ii++ {
+			sp.AddPage()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		page := sp
+		for ii := 0; ii < 1000; ii++ {
+			page = page.Next()
+			page.Read()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		page := sp
+		for ii := 0; ii < 1000; ii++ {
+			page.Write(strconv.Itoa(ii))
+			page = page.Next()
+		}
+	}()
+	wg.Wait()
+	count := 1
+	for page := sp.Next(); page != sp; page = page.Next() {
+		count++
+	}
+	if count != 101 {
+		t.Error(count)
+	}
+}
+
+func TestScrapesInProgress(t *testing.T) {
+	defer func(g prometheus.Gatherer) { gatherer = g }(gatherer)
+	release := make(chan bool)
+	gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		<-release
+		return nil, nil
+	})
+	i := NewIcarus("ft_")
+	before := value(icarusScrapesInProgress)
+	var wg sync.WaitGroup
+	for ii := 0; ii < 3; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i.HandleFunc(util.NewHTTPResponseWriter(), &http.Request{Form: url.Values{}})
+		}()
+	}
+	eventually(t, func() bool { return value(icarusScrapesInProgress) == before+3 })
+	close(release)
+	wg.Wait()
+	if g := value(icarusScrapesInProgress); g != before {
+		t.Error(g)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	i := NewIcarus("ft_")
+	met := helper(map[string]string{"__name__": "x"}, 1)
+	met.Annotations = map[string]string{"source_host": "box1"}
+	i.Record(met)
+	eventually(t, func() bool { return len(i.Snapshot()) == 1 })
+	if g := i.Snapshot()[0].Annotations; g["source_host"] != "box1" {
+		t.Error(g)
+	}
+	rw := util.NewHTTPResponseWriter()
+	i.SnapshotHandleFunc(rw, &http.Request{Form: url.Values{}})
+	if g := rw.String(); !strings.Contains(g, `"Annotations":{"source_host":"box1"}`) || strings.Contains(g, "OneShot") {
+		t.Error(g)
+	}
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "ft_x{} 1\n") || strings.Contains(g, "box1") {
+		t.Error(g)
+	}
+}
+
+func TestRollCadence(t *testing.T) {
+	ticks := make(chan time.Time)
+	i := newIcarus("ft_", time.NewTicker(time.Hour), ticks)
+	index := func() int {
+		i.Store.Lock()
+		defer i.Store.Unlock()
+		return i.Store.Index
+	}
+	// Holding the icarus lock stands in for a rollup that takes forever.
+	i.Lock()
+	tick := func(n int) {
+		for ii := 0; ii < n; ii++ {
+			ticks <- time.Now()
+		}
+	}
+	// the tick after a roll only goes through once the roll is done.
+	tick(7)
+	if g := index(); g != 1 {
+		t.Error(g)
+	}
+	tick(6)
+	if g := index(); g != 0 {
+		t.Error(g)
+	}
+	i.Unlock()
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	eventually(t, func() bool { return len(i.Snapshot()) == 1 })
+	tick(1)
+	eventually(t, func() bool { return strings.Contains(i.servePage().Read(), "\nft_x{} 1\n") })
+	i.Close()
+}
+
+func TestIcarusRange(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Now()
+	i.now = func() time.Time { return now }
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.Drain()
+	now = now.Add(time.Minute)
+	i.rollStoreBusiness()
+	i.Record(helper(map[string]string{"__name__": "x"}, 2))
+	i.Drain()
+	if g := i.Range(now.Add(-2*time.Minute), now); len(g) != 2 || g[0].Data.Val != 1 || g[1].Data.Val != 2 {
+		t.Error(g)
+	}
+	if g := i.Range(now, now.Add(time.Hour)); len(g) != 1 || g[0].Data.Val != 2 {
+		t.Error(g)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_heartbeat{} 1\n") {
+		t.Error(g)
+	}
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_heartbeat{} 2\n") {
+		t.Error(g)
+	}
+}
+
+func TestRollupBytes(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.Drain()
+	i.rollup()
+	if g := value(icarusRollupBytes); int(g) != len(i.servePage().Read()) {
+		t.Error(g)
+	}
+}
+
+func TestSnapshotPage(t *testing.T) {
+	i := NewIcarus("ft_")
+	for ii := 0; ii < 23; ii++ {
+		i.Record(helper(map[string]string{"__name__": "x", "n": strconv.Itoa(ii)}, float64(ii)))
+	}
+	i.Drain()
+	seen := make(map[string]bool)
+	for offset := 0; ; offset += 5 {
+		page, total := i.SnapshotPage(offset, 5)
+		if total != 23 {
+			t.Error(total)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, met := range page {
+			if seen[met.Desc["n"]] {
+				t.Error("repeated", met)
+			}
+			seen[met.Desc["n"]] = true
+		}
+	}
+	if len(seen) != 23 {
+		t.Error(len(seen))
+	}
+	if page, total := i.SnapshotPage(-3, 0); len(page) != 0 || total != 23 {
+		t.Error(page, total)
+	}
+}
+
+func TestLatestByName(t *testing.T) {
+	i := NewIcarus("ft_")
+	if g := i.LatestByName("x"); !math.IsNaN(g) {
+		t.Error(g)
+	}
+	for _, tc := range []struct {
+		pod string
+		val float64
+	}{{"a", 5}, {"b", 1}, {"c", 9}, {"b", 3}} {
+		i.Record(helper(map[string]string{"__name__": "x", "pod": tc.pod}, tc.val))
+	}
+	i.Record(helper(map[string]string{"__name__": "y"}, 7))
+	i.Drain()
+	// b was updated last, so its value wins over the bigger and older ones.
+	if g := i.LatestByName("x"); g != 3 {
+		t.Error(g)
+	}
+	i.rollStoreBusiness()
+	i.Record(helper(map[string]string{"__name__": "x", "pod": "a"}, 4))
+	i.Drain()
+	if g := i.LatestByName("x"); g != 4 {
+		t.Error(g)
+	}
+}
+
+func TestRollupCount(t *testing.T) {
+	ticks := make(chan time.Time)
+	i := newIcarus("ft_", time.NewTicker(time.Hour), ticks)
+	defer i.Close()
+	i.SetRollupCount(3)
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.Record(helper(map[string]string{"__name__": "y"}, 1))
+	i.Drain()
+	time.Sleep(10 * time.Millisecond)
+	if g := i.servePage().Read(); strings.Contains(g, "ft_x") {
+		t.Error(g)
+	}
+	i.Record(helper(map[string]string{"__name__": "z"}, 1))
+	eventually(t, func() bool { return strings.Contains(i.servePage().Read(), "\nft_z{} 1\n") })
+}
+
+func TestSnapshotInsertionOrder(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetInsertionOrder(true)
+	names := []string{"z", "m", "a", "q"}
+	for _, name := range names {
+		i.Record(helper(map[string]string{"__name__": name}, 1))
+	}
+	i.Drain()
+	out := i.Snapshot()
+	if len(out) != len(names) {
+		t.Fatal(out)
+	}
+	for ii, met := range out {
+		if met.Desc["__name__"] != "ft_"+names[ii] {
+			t.Error(ii, met)
+		}
+	}
+}
+
+func TestOldestWindowAge(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetWindows(3)
+	clock := time.Unix(1000, 0)
+	i.now = func() time.Time { return clock }
+	// each roll a minute apart, every window getting a sample.
+	for ii, want := range []float64{0, 60, 120, 120} {
+		i.rollStoreBusiness()
+		if g := value(icarusOldestWindowAge); g != want {
+			t.Error(ii, g)
+		}
+		i.Record(helper(map[string]string{"__name__": "x", "a": strconv.Itoa(ii)}, 1))
+		i.Drain()
+		clock = clock.Add(time.Minute)
+	}
+	// rollups between rolls keep it up to date.
+	i.rollup()
+	if g := value(icarusOldestWindowAge); g != 180 {
+		t.Error(g)
+	}
+}
+
+func TestLateSample(t *testing.T) {
+	for _, grace := range []time.Duration{0, 5 * time.Second} {
+		i := NewIcarus("ft_")
+		now := time.Unix(1500000000, 0)
+		i.now = func() time.Time { return now }
+		i.SetLateGrace(grace)
+		i.rollStoreBusiness()
+		before := i.Store.Current()
+		// the window rolls, then a sample from just before it arrives.
+		now = now.Add(time.Minute)
+		i.rollStoreBusiness()
+		i.Record(util.Metric{Desc: map[string]string{"__name__": "x"}, Data: util.DataPoint{Val: 3, Time: now.Unix() - 2}})
+		i.Drain()
+		i.rollup()
+		if g := i.servePage().Read(); !strings.Contains(g, "\nft_x{} 3") {
+			t.Error(grace, g)
+		}
+		// only the grace puts it in the window it belongs to.
+		late := i.Store.Range(before, i.Store.Current()-1)
+		if g := len(late); (grace > 0) != (g == 1) {
+			t.Error(grace, late)
+		}
+		if g := len(i.Store.Metrics[i.Store.Index]); (grace > 0) != (g == 0) {
+			t.Error(grace, g)
+		}
+	}
+}
+
+func TestSetWindowsInvalid(t *testing.T) {
+	i := NewIcarus("ft_")
+	for _, windows := range []int{0, -1} {
+		if err := i.SetWindows(windows); err == nil {
+			t.Error(windows)
+		}
+	}
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.Drain()
+	i.rollStoreBusiness()
+	if g := len(i.Snapshot()); g != 1 {
+		t.Error(g)
+	}
+	if err := i.SetWindows(1); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,5 @@
+// Package icaruspb holds the messages and service icarus streams its store
+// over gRPC with, generated from metrics.proto.
+package icaruspb
+
+//go:generate protoc --go_out=plugins=grpc:. metrics.proto
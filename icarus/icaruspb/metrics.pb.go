@@ -0,0 +1,334 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: metrics.proto
+
+package icaruspb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type DataPoint struct {
+	Val                  float64  `protobuf:"fixed64,1,opt,name=val,proto3" json:"val,omitempty"`
+	Time                 int64    `protobuf:"varint,2,opt,name=time,proto3" json:"time,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DataPoint) Reset()         { *m = DataPoint{} }
+func (m *DataPoint) String() string { return proto.CompactTextString(m) }
+func (*DataPoint) ProtoMessage()    {}
+func (*DataPoint) Descriptor() ([]byte, []int) {
+	return fileDescriptor_metrics_3db8d793552db758, []int{0}
+}
+func (m *DataPoint) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DataPoint.Unmarshal(m, b)
+}
+func (m *DataPoint) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DataPoint.Marshal(b, m, deterministic)
+}
+func (dst *DataPoint) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DataPoint.Merge(dst, src)
+}
+func (m *DataPoint) XXX_Size() int {
+	return xxx_messageInfo_DataPoint.Size(m)
+}
+func (m *DataPoint) XXX_DiscardUnknown() {
+	xxx_messageInfo_DataPoint.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DataPoint proto.InternalMessageInfo
+
+func (m *DataPoint) GetVal() float64 {
+	if m != nil {
+		return m.Val
+	}
+	return 0
+}
+
+func (m *DataPoint) GetTime() int64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
+}
+
+type Metric struct {
+	Desc                 map[string]string `protobuf:"bytes,1,rep,name=desc,proto3" json:"desc,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Data                 *DataPoint        `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	OneShot              bool              `protobuf:"varint,3,opt,name=one_shot,json=oneShot,proto3" json:"one_shot,omitempty"`
+	Annotations          map[string]string `protobuf:"bytes,4,rep,name=annotations,proto3" json:"annotations,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *Metric) Reset()         { *m = Metric{} }
+func (m *Metric) String() string { return proto.CompactTextString(m) }
+func (*Metric) ProtoMessage()    {}
+func (*Metric) Descriptor() ([]byte, []int) {
+	return fileDescriptor_metrics_3db8d793552db758, []int{1}
+}
+func (m *Metric) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Metric.Unmarshal(m, b)
+}
+func (m *Metric) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Metric.Marshal(b, m, deterministic)
+}
+func (dst *Metric) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Metric.Merge(dst, src)
+}
+func (m *Metric) XXX_Size() int {
+	return xxx_messageInfo_Metric.Size(m)
+}
+func (m *Metric) XXX_DiscardUnknown() {
+	xxx_messageInfo_Metric.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Metric proto.InternalMessageInfo
+
+func (m *Metric) GetDesc() map[string]string {
+	if m != nil {
+		return m.Desc
+	}
+	return nil
+}
+
+func (m *Metric) GetData() *DataPoint {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+func (m *Metric) GetOneShot() bool {
+	if m != nil {
+		return m.OneShot
+	}
+	return false
+}
+
+func (m *Metric) GetAnnotations() map[string]string {
+	if m != nil {
+		return m.Annotations
+	}
+	return nil
+}
+
+type Rollup struct {
+	Metrics              []*Metric `protobuf:"bytes,1,rep,name=metrics,proto3" json:"metrics,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *Rollup) Reset()         { *m = Rollup{} }
+func (m *Rollup) String() string { return proto.CompactTextString(m) }
+func (*Rollup) ProtoMessage()    {}
+func (*Rollup) Descriptor() ([]byte, []int) {
+	return fileDescriptor_metrics_3db8d793552db758, []int{2}
+}
+func (m *Rollup) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Rollup.Unmarshal(m, b)
+}
+func (m *Rollup) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Rollup.Marshal(b, m, deterministic)
+}
+func (dst *Rollup) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Rollup.Merge(dst, src)
+}
+func (m *Rollup) XXX_Size() int {
+	return xxx_messageInfo_Rollup.Size(m)
+}
+func (m *Rollup) XXX_DiscardUnknown() {
+	xxx_messageInfo_Rollup.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Rollup proto.InternalMessageInfo
+
+func (m *Rollup) GetMetrics() []*Metric {
+	if m != nil {
+		return m.Metrics
+	}
+	return nil
+}
+
+type StreamRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StreamRequest) Reset()         { *m = StreamRequest{} }
+func (m *StreamRequest) String() string { return proto.CompactTextString(m) }
+func (*StreamRequest) ProtoMessage()    {}
+func (*StreamRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_metrics_3db8d793552db758, []int{3}
+}
+func (m *StreamRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StreamRequest.Unmarshal(m, b)
+}
+func (m *StreamRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StreamRequest.Marshal(b, m, deterministic)
+}
+func (dst *StreamRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StreamRequest.Merge(dst, src)
+}
+func (m *StreamRequest) XXX_Size() int {
+	return xxx_messageInfo_StreamRequest.Size(m)
+}
+func (m *StreamRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_StreamRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StreamRequest proto.InternalMessageInfo
+
+func init() {
+	proto.RegisterType((*DataPoint)(nil), "icaruspb.DataPoint")
+	proto.RegisterType((*Metric)(nil), "icaruspb.Metric")
+	proto.RegisterMapType((map[string]string)(nil), "icaruspb.Metric.AnnotationsEntry")
+	proto.RegisterMapType((map[string]string)(nil), "icaruspb.Metric.DescEntry")
+	proto.RegisterType((*Rollup)(nil), "icaruspb.Rollup")
+	proto.RegisterType((*StreamRequest)(nil), "icaruspb.StreamRequest")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// MetricsClient is the client API for Metrics service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type MetricsClient interface {
+	Stream(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (Metrics_StreamClient, error)
+}
+
+type metricsClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewMetricsClient(cc *grpc.ClientConn) MetricsClient {
+	return &metricsClient{cc}
+}
+
+func (c *metricsClient) Stream(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (Metrics_StreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Metrics_serviceDesc.Streams[0], "/icaruspb.Metrics/Stream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Metrics_StreamClient interface {
+	Recv() (*Rollup, error)
+	grpc.ClientStream
+}
+
+type metricsStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsStreamClient) Recv() (*Rollup, error) {
+	m := new(Rollup)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MetricsServer is the server API for Metrics service.
+type MetricsServer interface {
+	Stream(*StreamRequest, Metrics_StreamServer) error
+}
+
+func RegisterMetricsServer(s *grpc.Server, srv MetricsServer) {
+	s.RegisterService(&_Metrics_serviceDesc, srv)
+}
+
+func _Metrics_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetricsServer).Stream(m, &metricsStreamServer{stream})
+}
+
+type Metrics_StreamServer interface {
+	Send(*Rollup) error
+	grpc.ServerStream
+}
+
+type metricsStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsStreamServer) Send(m *Rollup) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Metrics_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "icaruspb.Metrics",
+	HandlerType: (*MetricsServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _Metrics_Stream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "metrics.proto",
+}
+
+func init() { proto.RegisterFile("metrics.proto", fileDescriptor_metrics_3db8d793552db758) }
+
+var fileDescriptor_metrics_3db8d793552db758 = []byte{
+	// 320 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x92, 0x4f, 0x4b, 0xc3, 0x40,
+	0x10, 0xc5, 0xd9, 0x26, 0xa6, 0xcd, 0x94, 0x62, 0x59, 0x05, 0x63, 0x4e, 0x31, 0x17, 0x83, 0x87,
+	0xa0, 0x55, 0x51, 0x3c, 0x88, 0x7f, 0xea, 0x51, 0x90, 0xed, 0xcd, 0x8b, 0x6c, 0xd3, 0x85, 0x06,
+	0xd3, 0xdd, 0x9a, 0x9d, 0x14, 0xfa, 0xd5, 0xfc, 0x74, 0xd2, 0xdd, 0x36, 0xa9, 0xf5, 0xe4, 0x6d,
+	0xc2, 0xfc, 0xe6, 0xcd, 0x7b, 0xd9, 0x81, 0xde, 0x4c, 0x60, 0x99, 0x67, 0x3a, 0x9d, 0x97, 0x0a,
+	0x15, 0xed, 0xe4, 0x19, 0x2f, 0x2b, 0x3d, 0x1f, 0xc7, 0x17, 0xe0, 0x0f, 0x39, 0xf2, 0x37, 0x95,
+	0x4b, 0xa4, 0x7d, 0x70, 0x16, 0xbc, 0x08, 0x48, 0x44, 0x12, 0xc2, 0x56, 0x25, 0xa5, 0xe0, 0x62,
+	0x3e, 0x13, 0x41, 0x2b, 0x22, 0x89, 0xc3, 0x4c, 0x1d, 0x7f, 0xb7, 0xc0, 0x7b, 0x35, 0x72, 0x34,
+	0x05, 0x77, 0x22, 0x74, 0x16, 0x90, 0xc8, 0x49, 0xba, 0x83, 0x30, 0xdd, 0xc8, 0xa6, 0xb6, 0x9f,
+	0x0e, 0x85, 0xce, 0x5e, 0x24, 0x96, 0x4b, 0x66, 0x38, 0x7a, 0x0a, 0xee, 0x84, 0x23, 0x37, 0x72,
+	0xdd, 0xc1, 0x41, 0xc3, 0xd7, 0x1e, 0x98, 0x01, 0xe8, 0x31, 0x74, 0x94, 0x14, 0x1f, 0x7a, 0xaa,
+	0x30, 0x70, 0x22, 0x92, 0x74, 0x58, 0x5b, 0x49, 0x31, 0x9a, 0x2a, 0xa4, 0xcf, 0xd0, 0xe5, 0x52,
+	0x2a, 0xe4, 0x98, 0x2b, 0xa9, 0x03, 0xd7, 0xac, 0x3e, 0xf9, 0xb3, 0xfa, 0xb1, 0x61, 0xac, 0x83,
+	0xed, 0xa9, 0xf0, 0x06, 0xfc, 0xda, 0xdb, 0x2a, 0xf6, 0xa7, 0x58, 0x9a, 0xd8, 0x3e, 0x5b, 0x95,
+	0xf4, 0x10, 0xf6, 0x16, 0xbc, 0xa8, 0x6c, 0x6e, 0x9f, 0xd9, 0x8f, 0xbb, 0xd6, 0x2d, 0x09, 0xef,
+	0xa1, 0xbf, 0xab, 0xfc, 0x9f, 0xf9, 0xf8, 0x0a, 0x3c, 0xa6, 0x8a, 0xa2, 0x9a, 0xd3, 0x33, 0x68,
+	0xaf, 0x1f, 0x65, 0xfd, 0xfb, 0xfa, 0xbb, 0x19, 0xd8, 0x06, 0x88, 0xf7, 0xa1, 0x37, 0xc2, 0x52,
+	0xf0, 0x19, 0x13, 0x5f, 0x95, 0xd0, 0x38, 0x78, 0x80, 0xb6, 0x65, 0x34, 0xbd, 0x06, 0xcf, 0xf6,
+	0xe8, 0x51, 0x23, 0xf0, 0x8b, 0x0e, 0xb7, 0x94, 0xed, 0xf2, 0x73, 0xf2, 0x04, 0xef, 0xf5, 0x11,
+	0x8c, 0x3d, 0x73, 0x15, 0x97, 0x3f, 0x03, 0x00, 0x8b, 0x23, 0x3d, 0x9b, 0x26, 0x02, 0x00, 0x00,
+}
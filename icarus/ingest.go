@@ -0,0 +1,504 @@
+package icarus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errNoMatchers = errors.New("at least one label value is needed")
+
+var (
+	icarusTimestampCounter = splitCounterVec(prometheus.CounterOpts{
+		Name: "icarus_timestamp_bounds_counter",
+		Help: "How many samples had timestamps out of bounds, and what happened to them?",
+	}, []string{"action"})
+	icarusEmptyKeyCounter = splitCounterVec(prometheus.CounterOpts{
+		Name: "icarus_empty_label_key_counter",
+		Help: "How many samples had a label with an empty key, and what happened to them?",
+	}, []string{"action"})
+	icarusIngestSourceCounter = splitCounterVec(prometheus.CounterOpts{
+		Name: "icarus_ingest_source_counter",
+		Help: "How many samples came in over http, by who sent them? Past the first few senders the rest count as other.",
+	}, []string{"source"})
+	icarusInsertDuration = splitHistogram(prometheus.HistogramOpts{
+		Name:    "icarus_insert_duration_seconds",
+		Help:    "How long does ingest take over each sample?",
+		Buckets: prometheus.ExponentialBuckets(0.000001, 10, 8),
+	})
+	icarusSlowInsertCounter = splitCounter(prometheus.CounterOpts{
+		Name: "icarus_slow_insert_counter",
+		Help: "How many samples took longer than the slow insert threshold to ingest?",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(icarusTimestampCounter)
+	prometheus.MustRegister(icarusEmptyKeyCounter)
+	prometheus.MustRegister(icarusIngestSourceCounter)
+	prometheus.MustRegister(icarusInsertDuration)
+	prometheus.MustRegister(icarusSlowInsertCounter)
+}
+
+// SetTimestampBounds limits how far into the future and the past an explicit
+// sample timestamp (unix seconds) may be. Out of bounds samples are rejected,
+// or pulled back to the nearest bound when clamp is set. A zero bound is no bound.
+func (i *Icarus) SetTimestampBounds(maxFuture, maxAge time.Duration, clamp bool) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.maxFuture, i.maxAge, i.clamp = maxFuture, maxAge, clamp
+}
+
+// checkTime keeps explicit timestamps in bounds, false means the sample should go.
+// Samples without a timestamp are left alone.
+func (i *Icarus) checkTime(x *util.Metric) bool {
+	if x.Data.Time == 0 {
+		return true
+	}
+	i.recordMux.RLock()
+	maxFuture, maxAge, clamp := i.maxFuture, i.maxAge, i.clamp
+	i.recordMux.RUnlock()
+	now := i.now()
+	bound := x.Data.Time
+	if (maxFuture > 0) && (x.Data.Time > now.Add(maxFuture).Unix()) {
+		bound = now.Add(maxFuture).Unix()
+	}
+	if (maxAge > 0) && (x.Data.Time < now.Add(-maxAge).Unix()) {
+		bound = now.Add(-maxAge).Unix()
+	}
+	if bound == x.Data.Time {
+		return true
+	}
+	if !clamp {
+		i.counterVec(icarusTimestampCounter).WithLabelValues("rejected").Inc()
+		return false
+	}
+	i.counterVec(icarusTimestampCounter).WithLabelValues("clamped").Inc()
+	x.Data.Time = bound
+	return true
+}
+
+// SetRejectEmptyKeys picks what happens to samples with an empty label key,
+// which would otherwise render as invalid exposition. By default the label is
+// dropped and the sample kept; with reject the whole sample is refused.
+func (i *Icarus) SetRejectEmptyKeys(reject bool) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.rejectEmptyKeys = reject
+}
+
+// checkKeys drops a label with an empty key, false means the sample should go.
+func (i *Icarus) checkKeys(x *util.Metric) bool {
+	if _, ok := x.Desc[""]; !ok {
+		return true
+	}
+	i.recordMux.RLock()
+	reject := i.rejectEmptyKeys
+	i.recordMux.RUnlock()
+	if reject {
+		i.counterVec(icarusEmptyKeyCounter).WithLabelValues("rejected").Inc()
+		return false
+	}
+	i.counterVec(icarusEmptyKeyCounter).WithLabelValues("dropped").Inc()
+	delete(x.Desc, "")
+	return true
+}
+
+// SetSlowInsert counts samples that take longer than threshold to get through
+// ingest, for catching stalls like a long GC. Zero, the default, counts none.
+// Every sample is timed either way.
+func (i *Icarus) SetSlowInsert(threshold time.Duration) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.slowInsert = threshold
+}
+
+// timed ingests a sample, timing how long it takes.
+func (i *Icarus) timed(x util.Metric) {
+	began := time.Now()
+	i.ingest(x)
+	took := time.Since(began)
+	i.observer(icarusInsertDuration).Observe(took.Seconds())
+	i.recordMux.RLock()
+	threshold := i.slowInsert
+	i.recordMux.RUnlock()
+	if (threshold > 0) && (took > threshold) {
+		i.counter(icarusSlowInsertCounter).Inc()
+	}
+}
+
+// SetTrimValues trims leading and trailing whitespace off label values before
+// they are stored, so "x" and "x " land in the same series. Off by default.
+func (i *Icarus) SetTrimValues(trim bool) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.trimValues = trim
+}
+
+// trim trims the label values if SetTrimValues asked for it.
+func (i *Icarus) trim(desc map[string]string) {
+	i.recordMux.RLock()
+	trim := i.trimValues
+	i.recordMux.RUnlock()
+	if !trim {
+		return
+	}
+	for key, val := range desc {
+		desc[key] = strings.TrimSpace(val)
+	}
+}
+
+// SetValueTransform rewrites the values of one label key before they are
+// stored, e.g. strings.ToLower for method, leaving other keys alone. A nil
+// transform removes it.
+func (i *Icarus) SetValueTransform(key string, transform func(string) string) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	if transform == nil {
+		delete(i.transforms, key)
+		return
+	}
+	i.transforms[key] = transform
+}
+
+// transform applies the value transforms to the labels they are set for.
+func (i *Icarus) transform(desc map[string]string) {
+	i.recordMux.RLock()
+	defer i.recordMux.RUnlock()
+	for key, transform := range i.transforms {
+		if val, ok := desc[key]; ok {
+			desc[key] = transform(val)
+		}
+	}
+}
+
+// ingestTimestamp is the label Snapshot shows the ingest time in, see SetIngestTimestamps.
+const ingestTimestamp = "_ingest_ts"
+
+// SetIngestTimestamps, for debugging slow producers, has Snapshot and the
+// debug endpoints show when each series last went into the store as an
+// _ingest_ts label in epoch millis. It is kept as an annotation, so scrapes
+// never see it. Off by default.
+func (i *Icarus) SetIngestTimestamps(on bool) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.ingestTimestamps = on
+}
+
+// stamp notes when a sample was ingested, if SetIngestTimestamps asked for it.
+func (i *Icarus) stamp(x *util.Metric) {
+	i.recordMux.RLock()
+	on := i.ingestTimestamps
+	i.recordMux.RUnlock()
+	if !on {
+		return
+	}
+	annotate(x, ingestTimestamp, strconv.FormatInt(i.now().UnixNano()/int64(time.Millisecond), 10))
+}
+
+// annotate sets an annotation on a sample.
+func annotate(x *util.Metric, key, val string) {
+	// the annotations may be the caller's, so they are copied first.
+	notes := make(map[string]string, len(x.Annotations)+1)
+	for key, val := range x.Annotations {
+		notes[key] = val
+	}
+	notes[key] = val
+	x.Annotations = notes
+}
+
+// lineageAnnotation is the annotation a sample keeps its name as recorded
+// in, see SetLineage.
+const lineageAnnotation = "lineage"
+
+// SetLineage has every sample remember the name it was recorded under, before
+// the prefix, SetNameLabel and value transforms had their way, in a lineage
+// annotation. Snapshot and the debug endpoints show it, scrapes never do.
+// Off by default.
+func (i *Icarus) SetLineage(on bool) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.lineage = on
+}
+
+// trace notes the name a sample was recorded under, if SetLineage asked for it.
+func (i *Icarus) trace(x *util.Metric, original string) {
+	i.recordMux.RLock()
+	on := i.lineage
+	i.recordMux.RUnlock()
+	if on {
+		annotate(x, lineageAnnotation, original)
+	}
+}
+
+// SetNameLabel picks the label a metric's name is taken from when it has no
+// __name__, for producers that put it somewhere else, e.g. metric. The label
+// is dropped once it has become the name. The default is name.
+func (i *Icarus) SetNameLabel(label string) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.nameLabel = label
+}
+
+func (i *Icarus) nameSource() string {
+	i.recordMux.RLock()
+	defer i.recordMux.RUnlock()
+	return i.nameLabel
+}
+
+// complete says whether a sample has every required label, see NewIcarus.
+func (i *Icarus) complete(desc map[string]string) bool {
+	i.recordMux.RLock()
+	defer i.recordMux.RUnlock()
+	for _, label := range i.required {
+		if desc[label] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultMaxBody is how big an ingest request body may be unless SetMaxBody says otherwise.
+const defaultMaxBody = 10 << 20
+
+// SetMaxBody caps the size of ingest request bodies, bigger ones get a 413.
+func (i *Icarus) SetMaxBody(limit int64) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.maxBody = limit
+}
+
+// IngestHandleFunc records a json list of metrics POSTed to it. A batch
+// racing Close either lands whole or is refused with a 503.
+func (i *Icarus) IngestHandleFunc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "please POST a json list of metrics", http.StatusMethodNotAllowed)
+		return
+	}
+	i.recordMux.RLock()
+	limit := i.maxBody
+	i.recordMux.RUnlock()
+	body, err := util.ReadBody(w, r, limit)
+	if err == util.ErrTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var mets []util.Metric
+	if err == nil {
+		err = json.Unmarshal(body, &mets)
+	}
+	if err != nil {
+		i.countError(errParse)
+		http.Error(w, fmt.Sprintf("invalid metrics, %s", err), http.StatusBadRequest)
+		return
+	}
+	i.recordMux.RLock()
+	policy := i.duplicateKeys
+	i.recordMux.RUnlock()
+	firsts := firstLabels(body)
+	source := ingestSource(r)
+	label := sourceLabels.label(source)
+	i.counterVec(icarusIngestSourceCounter).WithLabelValues(label).Add(float64(len(mets)))
+	if !i.flow.beginBatch() {
+		for _, met := range mets {
+			i.reject(met, dropClosed)
+		}
+		http.Error(w, ErrClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	for ii, met := range mets {
+		if (ii < len(firsts)) && (firsts[ii].duplicates > 0) {
+			i.counterVec(icarusDuplicateKeyCounter).WithLabelValues(policy.String()).Inc()
+			if policy == DuplicateReject {
+				i.reject(met, dropValidation)
+				continue
+			}
+			if policy == DuplicateKeepFirst {
+				met.Desc = firsts[ii].labels
+			}
+		}
+		if met.Annotations == nil {
+			met.Annotations = make(map[string]string)
+		}
+		met.Annotations[sourceAnnotation] = source
+		i.Record(met)
+	}
+	i.flow.endBatch()
+	i.recordMux.RLock()
+	ack := i.ack
+	i.recordMux.RUnlock()
+	if (ack > 0) && !i.flow.waitFor(i.flow.mark(), ack) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "accepted %d metrics, not yet stored", len(mets))
+		return
+	}
+	fmt.Fprintf(w, "recorded %d metrics", len(mets))
+}
+
+// SetIngestAck has IngestHandleFunc wait up to timeout for a batch to get
+// through ingest before answering 200, for producers that need to know. If
+// the timeout runs out it answers 202 instead. Zero, the default, answers as
+// soon as the batch is queued.
+func (i *Icarus) SetIngestAck(timeout time.Duration) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.ack = timeout
+}
+
+// SourceHeader names the producer of an ingest request. Without it the
+// remote address does.
+const SourceHeader = "X-Icarus-Source"
+
+// sourceAnnotation is the annotation ingested samples carry their source in,
+// in full even past maxSources. It is never exposed, so sources cost no cardinality.
+const sourceAnnotation = "source"
+
+// maxSources is how many sources get a source label of their own on the
+// ingest source counters; sources are unbounded, the label must not be.
+const maxSources = 64
+
+// otherSource is the source label the sources past maxSources share.
+const otherSource = "other"
+
+// sources hands out the source labels, the first maxSources sources seen in
+// the process getting their own.
+type sources struct {
+	*sync.Mutex
+	seen map[string]bool
+}
+
+var sourceLabels = sources{&sync.Mutex{}, make(map[string]bool)}
+
+// label is the source label samples from source count under.
+func (s sources) label(source string) string {
+	s.Lock()
+	defer s.Unlock()
+	if s.seen[source] {
+		return source
+	}
+	if len(s.seen) >= maxSources {
+		return otherSource
+	}
+	s.seen[source] = true
+	return source
+}
+
+// ingestSource is who sent an ingest request.
+func ingestSource(r *http.Request) string {
+	if source := r.Header.Get(SourceHeader); source != "" {
+		return source
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Delete drops the series carrying every one of the given label values right
+// away, rather than waiting for them to age out. A __name__ is given without
+// the prefix. It says how many series went; no matchers delete nothing.
+func (i *Icarus) Delete(matchers map[string]string) int {
+	if len(matchers) == 0 {
+		return 0
+	}
+	want := make(map[string]string, len(matchers))
+	for key, val := range matchers {
+		want[key] = val
+	}
+	if name, ok := want["__name__"]; ok {
+		want["__name__"] = i.prefixed(name)
+	}
+	return i.Store.Delete(func(desc map[string]string) bool {
+		for key, val := range want {
+			if desc[key] != val {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// DeleteHandleFunc deletes the series matching a json object of label values
+// POSTed to it, for producers to say their series are gone, see Delete.
+func (i *Icarus) DeleteHandleFunc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "please POST a json object of label values", http.StatusMethodNotAllowed)
+		return
+	}
+	i.recordMux.RLock()
+	limit := i.maxBody
+	i.recordMux.RUnlock()
+	body, err := util.ReadBody(w, r, limit)
+	if err == util.ErrTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var matchers map[string]string
+	if err == nil {
+		err = json.Unmarshal(body, &matchers)
+	}
+	if (err == nil) && (len(matchers) == 0) {
+		err = errNoMatchers
+	}
+	if err != nil {
+		i.countError(errParse)
+		http.Error(w, fmt.Sprintf("invalid matchers, %s", err), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "deleted %d series", i.Delete(matchers))
+}
+
+// PrefixMode decides what happens to names that already start with the prefix.
+type PrefixMode int
+
+const (
+	// PrefixAlways prefixes every name, so ft_x becomes ft_ft_x. This is the default.
+	PrefixAlways PrefixMode = iota
+	// PrefixSkipPresent leaves names that already start with the prefix alone.
+	PrefixSkipPresent
+)
+
+func (p PrefixMode) String() string {
+	if p == PrefixSkipPresent {
+		return "skip_present"
+	}
+	return "always"
+}
+
+// SetPrefixMode picks how names already carrying the prefix are treated.
+func (i *Icarus) SetPrefixMode(mode PrefixMode) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.prefixMode = mode
+}
+
+// prefixed puts the prefix on a name.
+func (i *Icarus) prefixed(name string) string {
+	i.recordMux.RLock()
+	mode := i.prefixMode
+	i.recordMux.RUnlock()
+	if (mode == PrefixSkipPresent) && strings.HasPrefix(name, i.prefix) {
+		return name
+	}
+	return i.prefix + name
+}
@@ -0,0 +1,423 @@
+package icarus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func at(ts int64) util.Metric {
+	return util.Metric{Desc: map[string]string{"__name__": "x"}, Data: util.DataPoint{Val: 1, Time: ts}}
+}
+
+func TestTimestampBounds(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Unix(1000000, 0)
+	i.now = func() time.Time { return now }
+	i.SetTimestampBounds(time.Minute, time.Hour, false)
+
+	rejected := value(icarusTimestampCounter.WithLabelValues("rejected"))
+	met := at(now.Add(time.Hour).Unix())
+	if i.checkTime(&met) {
+		t.Error("far future accepted")
+	}
+	if g := value(icarusTimestampCounter.WithLabelValues("rejected")); g != rejected+1 {
+		t.Error(g)
+	}
+	for _, ts := range []int64{0, now.Unix(), now.Add(30 * time.Second).Unix(), now.Add(-30 * time.Minute).Unix()} {
+		met := at(ts)
+		if !i.checkTime(&met) || met.Data.Time != ts {
+			t.Error(ts, met)
+		}
+	}
+
+	i.SetTimestampBounds(time.Minute, time.Hour, true)
+	clamped := value(icarusTimestampCounter.WithLabelValues("clamped"))
+	met = at(now.Add(-2 * time.Hour).Unix())
+	if !i.checkTime(&met) || met.Data.Time != now.Add(-time.Hour).Unix() {
+		t.Error(met)
+	}
+	if g := value(icarusTimestampCounter.WithLabelValues("clamped")); g != clamped+1 {
+		t.Error(g)
+	}
+}
+
+func TestTimestampBoundsStore(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.EnableDeadLetter(5)
+	i.SetTimestampBounds(time.Minute, 0, false)
+	i.Record(at(time.Now().Add(time.Hour).Unix()))
+	i.Record(at(time.Now().Unix()))
+	eventually(t, func() bool { return len(i.Snapshot()) == 1 && len(i.dead.Dump()) == 1 })
+	if g := i.dead.Dump(); len(g) != 1 || g[0].Reason != errValidation {
+		t.Error(g)
+	}
+}
+
+func TestIngestHandleFunc(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetMaxBody(100)
+	t.Run("under the limit", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		i.IngestHandleFunc(rw, httptest.NewRequest("POST", "/ingest",
+			strings.NewReader(`[{"Desc":{"__name__":"x","a":"b"},"Data":{"Val":2}}]`)))
+		if rw.Code != http.StatusOK {
+			t.Error(rw.Code, rw.Body.String())
+		}
+		eventually(t, func() bool { return len(i.Snapshot()) == 1 })
+	})
+	t.Run("over the limit", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		i.IngestHandleFunc(rw, httptest.NewRequest("POST", "/ingest",
+			strings.NewReader(`[{"Desc":{"__name__":"y","a":"`+strings.Repeat("b", 100)+`"},"Data":{"Val":2}}]`)))
+		if rw.Code != http.StatusRequestEntityTooLarge {
+			t.Error(rw.Code)
+		}
+	})
+	t.Run("not json", func(t *testing.T) {
+		before := value(icarusErrorCounter.WithLabelValues(errParse))
+		rw := httptest.NewRecorder()
+		i.IngestHandleFunc(rw, httptest.NewRequest("POST", "/ingest", strings.NewReader(`[{`)))
+		if rw.Code != http.StatusBadRequest {
+			t.Error(rw.Code)
+		}
+		if g := value(icarusErrorCounter.WithLabelValues(errParse)); g != before+1 {
+			t.Error(g)
+		}
+	})
+	t.Run("not a post", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		i.IngestHandleFunc(rw, httptest.NewRequest("GET", "/ingest", nil))
+		if rw.Code != http.StatusMethodNotAllowed {
+			t.Error(rw.Code)
+		}
+	})
+	if g := len(i.Snapshot()); g != 1 {
+		t.Error(g)
+	}
+}
+
+func TestIngestSource(t *testing.T) {
+	i := NewIcarus("ft_")
+	body := `[{"Desc":{"__name__":"x","a":"b"},"Data":{"Val":2}},{"Desc":{"__name__":"y"},"Data":{"Val":1}}]`
+	fromHeader := value(icarusIngestSourceCounter.WithLabelValues("producer-a"))
+	fromAddr := value(icarusIngestSourceCounter.WithLabelValues("10.0.0.7"))
+	r := httptest.NewRequest("POST", "/ingest", strings.NewReader(body))
+	r.Header.Set(SourceHeader, "producer-a")
+	i.IngestHandleFunc(httptest.NewRecorder(), r)
+	r = httptest.NewRequest("POST", "/ingest", strings.NewReader(`[{"Desc":{"__name__":"z"},"Data":{"Val":1}}]`))
+	r.RemoteAddr = "10.0.0.7:4321"
+	i.IngestHandleFunc(httptest.NewRecorder(), r)
+	if g := value(icarusIngestSourceCounter.WithLabelValues("producer-a")); g != fromHeader+2 {
+		t.Error(g)
+	}
+	if g := value(icarusIngestSourceCounter.WithLabelValues("10.0.0.7")); g != fromAddr+1 {
+		t.Error(g)
+	}
+	eventually(t, func() bool { return len(i.Snapshot()) == 3 })
+	for _, met := range i.Snapshot() {
+		want := "producer-a"
+		if met.Desc["__name__"] == "ft_z" {
+			want = "10.0.0.7"
+		}
+		if met.Annotations[sourceAnnotation] != want {
+			t.Error(met)
+		}
+	}
+	i.rollup()
+	if g := i.servePage().Read(); strings.Contains(g, "producer-a") || strings.Contains(g, "10.0.0.7") {
+		t.Error(g)
+	}
+}
+
+func TestIngestSourceCap(t *testing.T) {
+	saved := sourceLabels.seen
+	sourceLabels.seen = make(map[string]bool)
+	defer func() { sourceLabels.seen = saved }()
+	sourceLabels.label("producer-a")
+	for ii := 1; ii < maxSources; ii++ {
+		sourceLabels.label(fmt.Sprintf("flood-%d", ii))
+	}
+	if g := sourceLabels.label("producer-a"); g != "producer-a" {
+		t.Error(g)
+	}
+	if g := sourceLabels.label("one-too-many"); g != otherSource {
+		t.Error(g)
+	}
+	if g := len(sourceLabels.seen); g != maxSources {
+		t.Error(g)
+	}
+}
+
+func TestTrimValues(t *testing.T) {
+	for _, trim := range []bool{false, true} {
+		i := NewIcarus("ft_")
+		i.SetTrimValues(trim)
+		for _, val := range []string{"x", "x ", " x", "\tx\n"} {
+			i.Record(helper(map[string]string{"__name__": "y", "a": val}, 1))
+		}
+		i.Close()
+		want := 4
+		if trim {
+			want = 1
+		}
+		if g := i.Snapshot(); len(g) != want {
+			t.Error(trim, g)
+		}
+	}
+}
+
+func TestSlowInsert(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetSlowInsert(5 * time.Millisecond)
+	timed, slow := value(icarusInsertDuration), value(icarusSlowInsertCounter)
+	i.Record(helper(map[string]string{"__name__": "fast"}, 1))
+	i.Drain()
+	if g := value(icarusInsertDuration); g != timed+1 {
+		t.Error(g)
+	}
+	if g := value(icarusSlowInsertCounter); g != slow {
+		t.Error(g)
+	}
+	// holding the store up makes the next insert slow.
+	i.Store.Lock()
+	i.Record(helper(map[string]string{"__name__": "slow"}, 1))
+	time.Sleep(20 * time.Millisecond)
+	i.Store.Unlock()
+	i.Drain()
+	if g := value(icarusInsertDuration); g != timed+2 {
+		t.Error(g)
+	}
+	if g := value(icarusSlowInsertCounter); g != slow+1 {
+		t.Error(g)
+	}
+}
+
+func TestValueTransform(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetValueTransform("method", strings.ToLower)
+	for _, method := range []string{"GET", "get", "Get"} {
+		i.Record(helper(map[string]string{"__name__": "x", "method": method, "path": "/Home"}, 1))
+	}
+	i.Drain()
+	g := i.Snapshot()
+	if len(g) != 1 || g[0].Desc["method"] != "get" || g[0].Desc["path"] != "/Home" {
+		t.Error(g)
+	}
+
+	i.SetValueTransform("method", nil)
+	i.Record(helper(map[string]string{"__name__": "y", "method": "PUT"}, 1))
+	i.Drain()
+	for _, met := range i.Snapshot() {
+		if (met.Desc["__name__"] == "ft_y") && (met.Desc["method"] != "PUT") {
+			t.Error(met)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	i := NewIcarus("ft_")
+	for _, pod := range []string{"a", "b"} {
+		i.Record(helper(map[string]string{"__name__": "x", "pod": pod}, 1))
+		i.Record(helper(map[string]string{"__name__": "y", "pod": pod}, 1))
+	}
+	i.Drain()
+	if g := i.Delete(map[string]string{}); g != 0 {
+		t.Error(g)
+	}
+	rw := httptest.NewRecorder()
+	i.DeleteHandleFunc(rw, httptest.NewRequest("POST", "/delete", strings.NewReader(`{"__name__":"x","pod":"a"}`)))
+	if g := rw.Body.String(); (rw.Code != http.StatusOK) || (g != "deleted 1 series") {
+		t.Error(rw.Code, g)
+	}
+	g := i.Snapshot()
+	if len(g) != 3 {
+		t.Error(g)
+	}
+	for _, met := range g {
+		if (met.Desc["__name__"] == "ft_x") && (met.Desc["pod"] == "a") {
+			t.Error(met)
+		}
+	}
+	for _, body := range []string{`{}`, `[`} {
+		rw := httptest.NewRecorder()
+		i.DeleteHandleFunc(rw, httptest.NewRequest("POST", "/delete", strings.NewReader(body)))
+		if rw.Code != http.StatusBadRequest {
+			t.Error(body, rw.Code)
+		}
+	}
+	if g := len(i.Snapshot()); g != 3 {
+		t.Error(g)
+	}
+}
+
+func TestDeleteCountsSeries(t *testing.T) {
+	i := newIcarus("ft_", time.NewTicker(time.Hour), make(chan time.Time))
+	// one series in two windows, another in one.
+	i.Record(helper(map[string]string{"__name__": "x", "pod": "a"}, 1))
+	i.Drain()
+	i.rollStoreBusiness()
+	i.Record(helper(map[string]string{"__name__": "x", "pod": "a"}, 2))
+	i.Record(helper(map[string]string{"__name__": "x", "pod": "b"}, 1))
+	i.Drain()
+	if g := i.Delete(map[string]string{"__name__": "x"}); g != 2 {
+		t.Error(g)
+	}
+	if g := i.Snapshot(); len(g) != 0 {
+		t.Error(g)
+	}
+}
+
+func TestRequiredLabels(t *testing.T) {
+	i := NewIcarus("ft_", "service", "env")
+	missing := value(icarusErrorCounter.WithLabelValues(errMissingLabel))
+	i.Record(helper(map[string]string{"__name__": "x", "service": "api", "env": "prod"}, 1))
+	i.Record(helper(map[string]string{"__name__": "y", "service": "api"}, 1))
+	i.Record(helper(map[string]string{"__name__": "z", "service": "api", "env": ""}, 1))
+	i.Drain()
+	if g := value(icarusErrorCounter.WithLabelValues(errMissingLabel)); g != missing+2 {
+		t.Error(g)
+	}
+	if g := i.Snapshot(); len(g) != 1 || g[0].Desc["__name__"] != "ft_x" {
+		t.Error(g)
+	}
+}
+
+func TestIngestAck(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetIngestAck(time.Second)
+	rw := httptest.NewRecorder()
+	i.IngestHandleFunc(rw, httptest.NewRequest("POST", "/ingest",
+		strings.NewReader(`[{"Desc":{"__name__":"x"},"Data":{"Val":1}},{"Desc":{"__name__":"y"},"Data":{"Val":2}}]`)))
+	if rw.Code != http.StatusOK {
+		t.Error(rw.Code, rw.Body.String())
+	}
+	if g := i.Snapshot(); len(g) != 2 {
+		t.Error(g)
+	}
+
+	// a store held up past the timeout gets the batch accepted but not confirmed.
+	i.SetIngestAck(10 * time.Millisecond)
+	i.Store.Lock()
+	rw = httptest.NewRecorder()
+	i.IngestHandleFunc(rw, httptest.NewRequest("POST", "/ingest",
+		strings.NewReader(`[{"Desc":{"__name__":"z"},"Data":{"Val":1}}]`)))
+	i.Store.Unlock()
+	if rw.Code != http.StatusAccepted {
+		t.Error(rw.Code, rw.Body.String())
+	}
+}
+
+func TestIngestTimestamps(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Unix(1500000000, 250*int64(time.Millisecond))
+	i.now = func() time.Time { return now }
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.Drain()
+	if g := i.Snapshot(); len(g) != 1 || g[0].Desc[ingestTimestamp] != "" {
+		t.Error(g)
+	}
+
+	i.SetIngestTimestamps(true)
+	notes := map[string]string{"a": "b"}
+	i.Record(util.Metric{Desc: map[string]string{"__name__": "x"}, Data: util.DataPoint{Val: 2}, Annotations: notes})
+	i.Drain()
+	g := i.Snapshot()
+	if len(g) != 1 || g[0].Desc[ingestTimestamp] != "1500000000250" || g[0].Annotations["a"] != "b" {
+		t.Error(g)
+	}
+	if len(notes) != 1 {
+		t.Error(notes)
+	}
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_x{} 2\n") || strings.Contains(g, ingestTimestamp) {
+		t.Error(g)
+	}
+}
+
+func TestNameLabel(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetNameLabel("metric")
+	i.Record(helper(map[string]string{"metric": "foo", "a": "b"}, 1))
+	i.Record(helper(map[string]string{"__name__": "bar", "metric": "other"}, 2))
+	i.Record(helper(map[string]string{"name": "baz"}, 3))
+	i.Drain()
+	i.rollup()
+	page := i.servePage().Read()
+	for _, want := range []string{`ft_foo{a="b"} 1`, `ft_bar{metric="other"} 2`, `ft_unnamed_metric{name="baz"} 3`} {
+		if !strings.Contains(page, "\n"+want+"\n") {
+			t.Error(want, page)
+		}
+	}
+}
+
+func TestPrefixMode(t *testing.T) {
+	i := NewIcarus("ft_")
+	if g := i.prefixed("ft_x"); g != "ft_ft_x" {
+		t.Error(g)
+	}
+	i.SetPrefixMode(PrefixSkipPresent)
+	if g := i.prefixed("ft_x"); g != "ft_x" {
+		t.Error(g)
+	}
+	if g := i.prefixed("x"); g != "ft_x" {
+		t.Error(g)
+	}
+	i.Record(helper(map[string]string{"__name__": "ft_y"}, 1))
+	eventually(t, func() bool { return len(i.Snapshot()) == 1 })
+	if g := i.Snapshot()[0].Desc["__name__"]; g != "ft_y" {
+		t.Error(g)
+	}
+}
+
+func TestEmptyKeys(t *testing.T) {
+	i := NewIcarus("ft_")
+	dropped := value(icarusEmptyKeyCounter.WithLabelValues("dropped"))
+	i.Record(helper(map[string]string{"__name__": "x", "": "oops", "a": "b"}, 1))
+	eventually(t, func() bool { return len(i.Snapshot()) == 1 })
+	if g := value(icarusEmptyKeyCounter.WithLabelValues("dropped")); g != dropped+1 {
+		t.Error(g)
+	}
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_x{a=\"b\"} 1\n") || strings.Contains(g, "oops") {
+		t.Error(g)
+	}
+
+	i.SetRejectEmptyKeys(true)
+	rejected := value(icarusEmptyKeyCounter.WithLabelValues("rejected"))
+	i.Record(helper(map[string]string{"__name__": "y", "": "oops"}, 1))
+	eventually(t, func() bool { return value(icarusEmptyKeyCounter.WithLabelValues("rejected")) == rejected+1 })
+	if g := i.Snapshot(); len(g) != 1 {
+		t.Error(g)
+	}
+
+	if g := MetricToProm(helper(map[string]string{"__name__": "z", "": "oops"}, 1)); g != "z{} 1\n" {
+		t.Error(g)
+	}
+}
+
+func TestLineage(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetLineage(true)
+	i.SetNameLabel("metric")
+	i.Record(helper(map[string]string{"metric": "latency", "a": "b"}, 1))
+	i.Drain()
+	g := i.Snapshot()
+	if len(g) != 1 || g[0].Desc["__name__"] != "ft_latency" || g[0].Annotations[lineageAnnotation] != "latency" {
+		t.Error(g)
+	}
+	rw := httptest.NewRecorder()
+	i.SnapshotHandleFunc(rw, httptest.NewRequest("GET", "/snapshot", nil))
+	if g := rw.Body.String(); !strings.Contains(g, `"lineage":"latency"`) {
+		t.Error(g)
+	}
+	i.rollup()
+	if g := i.servePage().Read(); !strings.Contains(g, "\nft_latency{a=\"b\"} 1\n") || strings.Contains(g, lineageAnnotation) {
+		t.Error(g)
+	}
+}
@@ -0,0 +1,199 @@
+package icarus
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// instanceLabel is the label a named instance's self-metrics carry.
+const instanceLabel = "instance"
+
+// A named instance counts its self-metrics in a registry of its own, copies
+// of the package level ones that all carry instance=name, and the default
+// section gathers those registries alongside the default one. The package
+// level self-metrics count the unnamed instances, so adding a family up over
+// its instance label gives the whole process. The store's own metrics, hash
+// collisions and lock waits, and name mismatches, which are found before a
+// sample reaches an instance, stay package level only.
+//
+// splits builds a fresh copy of each package level self-metric that named
+// instances count on their own.
+var splits = map[prometheus.Collector]func() prometheus.Collector{}
+
+func splitCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	c := prometheus.NewCounter(opts)
+	splits[c] = func() prometheus.Collector { return prometheus.NewCounter(opts) }
+	return c
+}
+
+func splitCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(opts, labels)
+	splits[c] = func() prometheus.Collector { return prometheus.NewCounterVec(opts, labels) }
+	return c
+}
+
+func splitGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	c := prometheus.NewGauge(opts)
+	splits[c] = func() prometheus.Collector { return prometheus.NewGauge(opts) }
+	return c
+}
+
+func splitSummary(opts prometheus.SummaryOpts) prometheus.Summary {
+	c := prometheus.NewSummary(opts)
+	splits[c] = func() prometheus.Collector { return prometheus.NewSummary(opts) }
+	return c
+}
+
+func splitSummaryVec(opts prometheus.SummaryOpts, labels []string) *prometheus.SummaryVec {
+	c := prometheus.NewSummaryVec(opts, labels)
+	splits[c] = func() prometheus.Collector { return prometheus.NewSummaryVec(opts, labels) }
+	return c
+}
+
+func splitHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	c := prometheus.NewHistogram(opts)
+	splits[c] = func() prometheus.Collector { return prometheus.NewHistogram(opts) }
+	return c
+}
+
+// instanceMetrics is what a named instance counts its self-metrics in.
+type instanceMetrics struct {
+	name     string
+	registry *prometheus.Registry
+	// copies is the instance's own copy of each package level split.
+	copies map[prometheus.Collector]prometheus.Collector
+	// lastScrape is when a scrape of the instance was last served, or when it
+	// was first named, unix nanoseconds, used atomically.
+	lastScrape int64
+}
+
+// instanceSets are the named instances' metrics by name, shared by
+// instances with the same name.
+type instanceSets struct {
+	*sync.Mutex
+	byName map[string]*instanceMetrics
+}
+
+var instances = instanceSets{&sync.Mutex{}, map[string]*instanceMetrics{}}
+
+// named is the metrics of the instances called name, made the first time.
+func (s instanceSets) named(name string) *instanceMetrics {
+	s.Lock()
+	defer s.Unlock()
+	if m, ok := s.byName[name]; ok {
+		return m
+	}
+	m := &instanceMetrics{
+		name:       name,
+		registry:   prometheus.NewRegistry(),
+		copies:     make(map[prometheus.Collector]prometheus.Collector, len(splits)),
+		lastScrape: time.Now().UnixNano(),
+	}
+	labelled := prometheus.WrapRegistererWith(prometheus.Labels{instanceLabel: name}, m.registry)
+	for shared, build := range splits {
+		own := build()
+		labelled.MustRegister(own)
+		m.copies[shared] = own
+	}
+	labelled.MustRegister(prometheus.NewGaugeFunc(sinceLastScrapeOpts, func() float64 {
+		return time.Since(time.Unix(0, atomic.LoadInt64(&m.lastScrape))).Seconds()
+	}))
+	s.byName[name] = m
+	return m
+}
+
+// all is every named instance's metrics.
+func (s instanceSets) all() []*instanceMetrics {
+	s.Lock()
+	defer s.Unlock()
+	out := make([]*instanceMetrics, 0, len(s.byName))
+	for _, m := range s.byName {
+		out = append(out, m)
+	}
+	return out
+}
+
+// Gather is part of prometheus.Gatherer, gathering every named instance.
+func (s instanceSets) Gather() ([]*dto.MetricFamily, error) {
+	all := s.all()
+	gatherers := make(prometheus.Gatherers, len(all))
+	for ii, m := range all {
+		gatherers[ii] = m.registry
+	}
+	return gatherers.Gather()
+}
+
+// SetInstance names this icarus so its self-metrics count under
+// instance=name rather than in the package level ones, telling apart several
+// instances in one process. Instances sharing a name share the counts and
+// gauges. The empty name, the default, counts in the package level metrics.
+func (i *Icarus) SetInstance(name string) {
+	i.configChanged()
+	var self *instanceMetrics
+	if name != "" {
+		self = instances.named(name)
+	}
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.self = self
+}
+
+// instanceMetrics is what this icarus counts its self-metrics in if it is
+// named, nil if not.
+func (i *Icarus) instanceMetrics() *instanceMetrics {
+	i.recordMux.RLock()
+	defer i.recordMux.RUnlock()
+	return i.self
+}
+
+// own is this icarus's copy of a package level split, c itself if unnamed.
+func (i *Icarus) own(c prometheus.Collector) prometheus.Collector {
+	if self := i.instanceMetrics(); self != nil {
+		return self.copies[c]
+	}
+	return c
+}
+
+// counter is the counter this icarus counts in for c.
+func (i *Icarus) counter(c prometheus.Counter) prometheus.Counter {
+	return i.own(c).(prometheus.Counter)
+}
+
+// counterVec is the counter vec this icarus counts in for c.
+func (i *Icarus) counterVec(c *prometheus.CounterVec) *prometheus.CounterVec {
+	return i.own(c).(*prometheus.CounterVec)
+}
+
+// gauge is the gauge this icarus sets for c.
+func (i *Icarus) gauge(c prometheus.Gauge) prometheus.Gauge {
+	return i.own(c).(prometheus.Gauge)
+}
+
+// observer is the summary or histogram this icarus observes in for c.
+func (i *Icarus) observer(c prometheus.Collector) prometheus.Observer {
+	return i.own(c).(prometheus.Observer)
+}
+
+// summaryVec is the summary vec this icarus observes in for c.
+func (i *Icarus) summaryVec(c *prometheus.SummaryVec) *prometheus.SummaryVec {
+	return i.own(c).(*prometheus.SummaryVec)
+}
+
+// countSample counts a stored sample.
+func (i *Icarus) countSample() {
+	i.counter(icarusSamplesObserved).Inc()
+}
+
+// countError counts an error of the given type, see icarus_error_counter.
+func (i *Icarus) countError(kind string) {
+	i.counterVec(icarusErrorCounter).WithLabelValues(kind).Inc()
+}
+
+// countRequest counts a scrape served.
+func (i *Icarus) countRequest() {
+	i.counter(icarusRequestCounter).Inc()
+}
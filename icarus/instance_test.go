@@ -0,0 +1,111 @@
+package icarus
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestInstance(t *testing.T) {
+	a, b := NewIcarus("ft_"), NewIcarus("ft_")
+	a.SetInstance("a")
+	b.SetInstance("b")
+	shared := value(icarusSamplesObserved)
+	for ii := 0; ii < 2; ii++ {
+		a.Record(helper(map[string]string{"__name__": "x"}, 1))
+	}
+	b.Record(helper(map[string]string{"__name__": "x"}, 1))
+	b.Record(helper(map[string]string{"__name__": "x", "": "oops"}, 1))
+	b.Drain()
+	b.SetRejectEmptyKeys(true)
+	b.Record(helper(map[string]string{"__name__": "y", "": "oops"}, 1))
+	a.Drain()
+	b.Drain()
+	a.HandleFunc(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, tc := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"a samples", value(a.counter(icarusSamplesObserved)), 2},
+		{"b samples", value(b.counter(icarusSamplesObserved)), 2},
+		{"a errors", value(a.counterVec(icarusErrorCounter).WithLabelValues(errValidation)), 0},
+		{"b errors", value(b.counterVec(icarusErrorCounter).WithLabelValues(errValidation)), 1},
+		{"a requests", value(a.counter(icarusRequestCounter)), 1},
+		{"b requests", value(b.counter(icarusRequestCounter)), 0},
+		// named instances count only under their own label.
+		{"shared samples", value(icarusSamplesObserved), shared},
+	} {
+		if tc.got != tc.want {
+			t.Error(tc.name, tc.got)
+		}
+	}
+	w := httptest.NewRecorder()
+	a.HandleFunc(w, httptest.NewRequest("GET", "/metrics", nil))
+	if g := w.Body.String(); !strings.Contains(g, "\nicarus_samples_observed_total{instance=\"a\"} 2\n") {
+		t.Error(g)
+	}
+}
+
+// sinceScrape is icarus_seconds_since_last_scrape for name.
+func sinceScrape(name string) float64 {
+	mfs, _ := instances.Gather()
+	for _, mf := range mfs {
+		if mf.GetName() != "icarus_seconds_since_last_scrape" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == name {
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	return -1
+}
+
+func TestInstanceGauges(t *testing.T) {
+	a, b := NewIcarus("ft_"), NewIcarus("ft_")
+	a.SetInstance("gauges_a")
+	b.SetInstance("gauges_b")
+	shared := value(icarusSeriesHighWater)
+	for ii := 0; ii < 3; ii++ {
+		a.Record(helper(map[string]string{"__name__": "x", "n": strconv.Itoa(ii)}, 1))
+	}
+	b.Record(helper(map[string]string{"__name__": "x"}, 1))
+	b.SetRejectEmptyKeys(true)
+	b.Record(helper(map[string]string{"__name__": "y", "": "oops"}, 1))
+	a.Drain()
+	b.Drain()
+	a.rollStoreBusiness()
+	a.rollup()
+	b.rollup()
+	a.HandleFunc(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	b.SetMinValue("x", 1)
+
+	for _, tc := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"a high water", value(a.gauge(icarusSeriesHighWater)), 3},
+		{"b high water", value(b.gauge(icarusSeriesHighWater)), 1},
+		{"shared high water", value(icarusSeriesHighWater), shared},
+		{"a retained", value(a.gauge(icarusRetainedWindows)), float64(a.Store.Retained())},
+		{"a empty keys", value(a.counterVec(icarusEmptyKeyCounter).WithLabelValues("rejected")), 0},
+		{"b empty keys", value(b.counterVec(icarusEmptyKeyCounter).WithLabelValues("rejected")), 1},
+		{"a config changes", value(a.counter(icarusConfigChanges)), 0},
+		{"b config changes", value(b.counter(icarusConfigChanges)), 1},
+	} {
+		if tc.got != tc.want {
+			t.Error(tc.name, tc.got)
+		}
+	}
+	if g := value(a.gauge(icarusRollupBytes)); int(g) != len(a.servePage().Read()) {
+		t.Error(g)
+	}
+	if got, neverScraped := sinceScrape("gauges_a"), sinceScrape("gauges_b"); (got < 0) || (got >= neverScraped) {
+		t.Error(got, neverScraped)
+	}
+}
@@ -0,0 +1,110 @@
+package icarus
+
+import "github.com/luuphu25/data-sidecar/util"
+
+// labelDict holds one shared copy of each label set in the store, so a
+// series kept in several windows holds its labels once, and of each label
+// name and value, so series with labels in common share the strings.
+type labelDict struct {
+	sets    map[string]map[string]string
+	strings map[string]string
+}
+
+func newLabelDict() *labelDict {
+	return &labelDict{sets: make(map[string]map[string]string), strings: make(map[string]string)}
+}
+
+// intern is the shared copy of the label set desc stored under key. A label
+// set colliding with a different one under the same key is not shared.
+func (d *labelDict) intern(key string, desc map[string]string) map[string]string {
+	if set, ok := d.sets[key]; ok {
+		if sameLabels(set, desc) {
+			return set
+		}
+		return desc
+	}
+	set := make(map[string]string, len(desc))
+	for name, val := range desc {
+		set[d.str(name)] = d.str(val)
+	}
+	d.sets[key] = set
+	return set
+}
+
+// str is the shared copy of s.
+func (d *labelDict) str(s string) string {
+	if shared, ok := d.strings[s]; ok {
+		return shared
+	}
+	d.strings[s] = s
+	return s
+}
+
+// prune forgets the label sets no longer in any of windows, and the strings
+// only they used.
+func (d *labelDict) prune(windows []map[string]util.Metric) {
+	live := make(map[string]map[string]string, len(d.sets))
+	for _, window := range windows {
+		for key := range window {
+			if set, ok := d.sets[key]; ok {
+				live[key] = set
+			}
+		}
+	}
+	strs := make(map[string]string, len(d.strings))
+	for _, set := range live {
+		for name, val := range set {
+			strs[name], strs[val] = name, val
+		}
+	}
+	d.sets, d.strings = live, strs
+}
+
+// SetLabelDictionary has the store keep each label set once, shared by the
+// windows holding the series and built from shared label names and values,
+// which saves memory when series are kept across many windows or have many
+// labels in common. What the store returns is the same either way. It does
+// not speed up comparing label sets: every sample brings a label set of its
+// own, so inserts still check it against the stored one label by label. Off,
+// the default, each window keeps the label set of the sample it was given.
+func (r *IcarusStore) SetLabelDictionary(on bool) {
+	r.lock()
+	defer r.Unlock()
+	if !on {
+		r.dict = nil
+		return
+	}
+	if r.dict != nil {
+		return
+	}
+	r.dict = newLabelDict()
+	for _, window := range r.Metrics {
+		for key, met := range window {
+			met.Desc = r.dict.intern(key, met.Desc)
+			window[key] = met
+		}
+	}
+}
+
+// shared is desc as the store keeps it under key. Callers hold the lock.
+func (r *IcarusStore) shared(key string, desc map[string]string) map[string]string {
+	if r.dict == nil {
+		return desc
+	}
+	return r.dict.intern(key, desc)
+}
+
+// pruneDict drops what the label dictionary holds for series no longer in
+// the store. Deleted series linger until the next roll. Callers hold the lock.
+func (r *IcarusStore) pruneDict() {
+	if r.dict != nil {
+		r.dict.prune(r.Metrics)
+	}
+}
+
+// SetLabelDictionary has the store share one copy of each label set between
+// its windows, see IcarusStore.SetLabelDictionary.
+func (i *Icarus) SetLabelDictionary(on bool) {
+	i.configChanged()
+	i.Store.SetLabelDictionary(on)
+}
@@ -0,0 +1,117 @@
+package icarus
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// repetitive is a fixture of series with most of their labels in common.
+func repetitive(series int, val float64) []util.Metric {
+	out := make([]util.Metric, series)
+	for ii := range out {
+		desc := map[string]string{"__name__": fmt.Sprintf("x%d", ii%5), "series": fmt.Sprint(ii)}
+		for jj := 0; jj < 10; jj++ {
+			desc[fmt.Sprintf("label_%d", jj)] = fmt.Sprintf("shared_value_%d", jj)
+		}
+		out[ii] = helper(desc, val)
+	}
+	return out
+}
+
+func TestLabelDictionary(t *testing.T) {
+	page := func(dict bool) (string, []string) {
+		ticks := make(chan time.Time)
+		i := newIcarus("ft_", time.NewTicker(time.Hour), ticks)
+		i.SetLabelDictionary(dict)
+		for roll := 0; roll < 4; roll++ {
+			for _, met := range repetitive(50+roll*10, float64(roll)) {
+				i.Record(met)
+			}
+			i.Drain()
+			if roll == 1 {
+				i.Delete(map[string]string{"series": "3"})
+			}
+			i.rollStoreBusiness()
+		}
+		i.rollup()
+		var lines []string
+		for _, line := range strings.Split(i.servePage().Read(), "\n") {
+			if strings.HasPrefix(line, "ft_x") {
+				lines = append(lines, line)
+			}
+		}
+		sort.Strings(lines)
+		var snap []string
+		for _, met := range i.Snapshot() {
+			snap = append(snap, fmt.Sprint(util.MapSSToS(met.Desc), met.Data.Val))
+		}
+		sort.Strings(snap)
+		return strings.Join(lines, "\n"), snap
+	}
+	plain, plainSnap := page(false)
+	shared, sharedSnap := page(true)
+	if (plain == "") || (plain != shared) {
+		t.Error(plain, shared)
+	}
+	if fmt.Sprint(plainSnap) != fmt.Sprint(sharedSnap) {
+		t.Error(plainSnap, sharedSnap)
+	}
+}
+
+func TestLabelDictionaryShares(t *testing.T) {
+	store := NewRollingStore(3)
+	store.SetLabelDictionary(true)
+	met := repetitive(1, 1)[0]
+	store.Insert(met)
+	store.Roll()
+	store.Insert(copyMetric(met))
+	first, second := store.Metrics[0][util.MapSSToS(met.Desc)], store.Metrics[1][util.MapSSToS(met.Desc)]
+	// the same map, not an equal one.
+	first.Desc["probe"] = "x"
+	if second.Desc["probe"] != "x" {
+		t.Error(second)
+	}
+	delete(first.Desc, "probe")
+	// gone from every window, gone from the dictionary at the next roll.
+	store.Delete(func(map[string]string) bool { return true })
+	store.Roll()
+	if (len(store.dict.sets) != 0) || (len(store.dict.strings) != 0) {
+		t.Error(store.dict)
+	}
+}
+
+// BenchmarkLabelDictionary reports the heap the store holds for a fixture of
+// series kept in every window and sharing most of their labels.
+func BenchmarkLabelDictionary(b *testing.B) {
+	for _, dict := range []bool{false, true} {
+		b.Run(fmt.Sprintf("dictionary=%v", dict), func(b *testing.B) {
+			b.ReportAllocs()
+			var held int64
+			for n := 0; n < b.N; n++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				store := NewRollingStore(6)
+				store.SetLabelDictionary(dict)
+				for window := 0; window < 6; window++ {
+					for _, met := range repetitive(1000, float64(window)) {
+						store.Insert(met)
+					}
+					store.Roll()
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				// the heap can shrink over a run, so the difference is signed.
+				held += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+				runtime.KeepAlive(store)
+			}
+			b.ReportMetric(float64(held)/float64(b.N), "heap-bytes/op")
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package icarus
+
+import (
+	"regexp"
+	"strings"
+)
+
+// lanes splits series between a fast lane, rendered every rollup, and a slow
+// lane only rendered every so many rollups. Stable metrics can sit in the slow
+// lane to cut churn while the rest stay fresh.
+type lanes struct {
+	every    int
+	patterns []*regexp.Regexp
+	ticks    int
+	// page, rows and count are the slow lane as last rendered.
+	page  string
+	rows  []pageRow
+	count int
+}
+
+// SetSlowLane moves metrics whose names (without the prefix) fully match one
+// of the patterns to a slow lane that is only re-rendered every so many
+// rollups. The page served always carries both lanes.
+func (i *Icarus) SetSlowLane(every int, patterns ...string) error {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for ii, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return err
+		}
+		compiled[ii] = re
+	}
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.lanes = lanes{every: every, patterns: compiled}
+	return nil
+}
+
+// slow says if a name belongs in the slow lane.
+func (l *lanes) slow(name string) bool {
+	for _, re := range l.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// tick moves on a rollup and says if the slow lane is due to be rendered.
+func (l *lanes) tick() bool {
+	l.ticks++
+	return (l.every <= 1) || ((l.ticks-1)%l.every == 0)
+}
+
+// unprefixed takes the prefix back off a stored name.
+func (i *Icarus) unprefixed(name string) string {
+	return strings.TrimPrefix(name, i.prefix)
+}
@@ -0,0 +1,37 @@
+package icarus
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSlowLane(t *testing.T) {
+	i := NewIcarus("ft_")
+	if err := i.SetSlowLane(3, "stable_.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Icarus{}).SetSlowLane(3, "("); err == nil {
+		t.Error("bad pattern accepted")
+	}
+	for tick, slow := range []int{1, 1, 1, 4, 4, 4, 7} {
+		i.Record(helper(map[string]string{"__name__": "busy"}, float64(tick+1)))
+		i.Record(helper(map[string]string{"__name__": "stable_x"}, float64(tick+1)))
+		eventually(t, func() bool {
+			for _, met := range i.Snapshot() {
+				if met.Data.Val != float64(tick+1) {
+					return false
+				}
+			}
+			return true
+		})
+		i.rollup()
+		page := i.servePage().Read()
+		if !strings.Contains(page, "ft_busy{} "+strconv.Itoa(tick+1)+"\n") {
+			t.Error(tick, page)
+		}
+		if !strings.Contains(page, "ft_stable_x{} "+strconv.Itoa(slow)+"\n") {
+			t.Error(tick, page)
+		}
+	}
+}
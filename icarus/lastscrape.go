@@ -0,0 +1,36 @@
+package icarus
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lastScrape is when a HandleFunc of an unnamed icarus last finished, unix
+// nanoseconds, used atomically. It starts at process start.
+var lastScrape = time.Now().UnixNano()
+
+// sinceLastScrapeOpts describe icarus_seconds_since_last_scrape, which a
+// named instance works out from when it was last scraped, or first named.
+var sinceLastScrapeOpts = prometheus.GaugeOpts{
+	Name: "icarus_seconds_since_last_scrape",
+	Help: "How long is it since a scrape of icarus was last served, or since start if never?",
+}
+
+var icarusSinceLastScrape = prometheus.NewGaugeFunc(sinceLastScrapeOpts, func() float64 {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&lastScrape))).Seconds()
+})
+
+func init() {
+	prometheus.MustRegister(icarusSinceLastScrape)
+}
+
+// scraped notes that a scrape was served.
+func (i *Icarus) scraped() {
+	if self := i.instanceMetrics(); self != nil {
+		atomic.StoreInt64(&self.lastScrape, time.Now().UnixNano())
+		return
+	}
+	atomic.StoreInt64(&lastScrape, time.Now().UnixNano())
+}
@@ -0,0 +1,22 @@
+package icarus
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSinceLastScrape(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.HandleFunc(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	first := value(icarusSinceLastScrape)
+	time.Sleep(20 * time.Millisecond)
+	waited := value(icarusSinceLastScrape)
+	if waited < first+0.02 {
+		t.Error(first, waited)
+	}
+	i.HandleFunc(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	if g := value(icarusSinceLastScrape); g >= waited {
+		t.Error(waited, g)
+	}
+}
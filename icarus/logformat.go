@@ -0,0 +1,79 @@
+package icarus
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// LogFields are the field names LogHandleFunc writes each series under.
+type LogFields struct {
+	Name   string
+	Labels string
+	Value  string
+	Time   string
+}
+
+// defaultLogFields are the LogHandleFunc field names unless SetLogFields says otherwise.
+var defaultLogFields = LogFields{"name", "labels", "value", "timestamp"}
+
+// SetLogFields renames the fields LogHandleFunc writes, to suit a log
+// pipeline's schema. Empty names keep their default.
+func (i *Icarus) SetLogFields(fields LogFields) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	if fields.Name == "" {
+		fields.Name = defaultLogFields.Name
+	}
+	if fields.Labels == "" {
+		fields.Labels = defaultLogFields.Labels
+	}
+	if fields.Value == "" {
+		fields.Value = defaultLogFields.Value
+	}
+	if fields.Time == "" {
+		fields.Time = defaultLogFields.Time
+	}
+	i.logFields = fields
+}
+
+// LogHandleFunc writes the Snapshot as one json object a line, with the name,
+// the other labels, the value and the unix timestamp of each series, for log
+// pipelines like promtail to pick up. A series without a timestamp of its own
+// gets the time of the request. Values json cannot hold, like NaN, are strings.
+func (i *Icarus) LogHandleFunc(w http.ResponseWriter, r *http.Request) {
+	i.Lock()
+	fields := i.logFields
+	i.Unlock()
+	now := i.now().Unix()
+	out := bytes.NewBuffer([]byte{})
+	for _, met := range i.Snapshot() {
+		labels := make(map[string]string, len(met.Desc))
+		for key, val := range met.Desc {
+			if key != "__name__" {
+				labels[key] = val
+			}
+		}
+		var val interface{} = met.Data.Val
+		if math.IsNaN(met.Data.Val) || math.IsInf(met.Data.Val, 0) {
+			val = strconv.FormatFloat(met.Data.Val, 'f', -1, 64)
+		}
+		ts := met.Data.Time
+		if ts == 0 {
+			ts = now
+		}
+		line, _ := json.Marshal(map[string]interface{}{
+			fields.Name:   met.Desc["__name__"],
+			fields.Labels: labels,
+			fields.Value:  val,
+			fields.Time:   ts,
+		})
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,50 @@
+package icarus
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestLogHandleFunc(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.now = func() time.Time { return time.Unix(1500000000, 0) }
+	i.Record(helper(map[string]string{"__name__": "x", "a": "b"}, 2))
+	i.Record(util.Metric{Desc: map[string]string{"__name__": "y"}, Data: util.DataPoint{Val: math.NaN(), Time: 1400000000}})
+	i.Drain()
+	scrape := func() map[string]map[string]interface{} {
+		rw := httptest.NewRecorder()
+		i.LogHandleFunc(rw, httptest.NewRequest("GET", "/logs", nil))
+		lines := strings.Split(strings.TrimSuffix(rw.Body.String(), "\n"), "\n")
+		out := make(map[string]map[string]interface{})
+		for _, line := range lines {
+			var fields map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &fields); err != nil {
+				t.Error(err, line)
+			}
+			for _, key := range []string{"name", "msg"} {
+				if name, ok := fields[key].(string); ok {
+					out[name] = fields
+				}
+			}
+		}
+		return out
+	}
+	g := scrape()
+	if x := g["ft_x"]; (len(g) != 2) || (x["value"] != 2.) || (x["timestamp"] != 1500000000.) || (x["labels"].(map[string]interface{})["a"] != "b") {
+		t.Error(g)
+	}
+	if y := g["ft_y"]; (y["value"] != "NaN") || (y["timestamp"] != 1400000000.) {
+		t.Error(y)
+	}
+	i.SetLogFields(LogFields{Name: "msg"})
+	g = scrape()
+	if x := g["ft_x"]; (x["msg"] != "ft_x") || (x["value"] != 2.) || (x["name"] != nil) {
+		t.Error(g)
+	}
+}
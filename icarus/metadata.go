@@ -0,0 +1,62 @@
+package icarus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+var errMetadataType = errors.New("metric type must be counter, gauge, histogram, summary or untyped")
+
+// Metadata describes a metric name for tooling, without any values.
+type Metadata struct {
+	Name string
+	Type string
+	Help string `json:",omitempty"`
+	Unit string `json:",omitempty"`
+}
+
+// RegisterMetadata describes a metric name, given without the prefix, for
+// ManifestHandleFunc. Registering a name again replaces what was there.
+func (i *Icarus) RegisterMetadata(name, kind, help, unit string) error {
+	switch kind {
+	case "counter", "gauge", "histogram", "summary", "untyped":
+	default:
+		return errMetadataType
+	}
+	i.Lock()
+	defer i.Unlock()
+	i.metadata[i.prefix+name] = Metadata{i.prefix + name, kind, help, unit}
+	return nil
+}
+
+// Manifest is every registered metric name plus any other name in the store,
+// the latter untyped, sorted by name.
+func (i *Icarus) Manifest() []Metadata {
+	i.Lock()
+	known := make(map[string]Metadata, len(i.metadata))
+	for name, meta := range i.metadata {
+		known[name] = meta
+	}
+	i.Unlock()
+	for _, met := range i.Store.Dump() {
+		name := met.Desc["__name__"]
+		if _, ok := known[name]; !ok {
+			known[name] = Metadata{Name: name, Type: "untyped"}
+		}
+	}
+	out := make([]Metadata, 0, len(known))
+	for _, meta := range known {
+		out = append(out, meta)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Name < out[b].Name })
+	return out
+}
+
+// ManifestHandleFunc dumps the Manifest as json.
+func (i *Icarus) ManifestHandleFunc(w http.ResponseWriter, r *http.Request) {
+	out, _ := json.Marshal(i.Manifest())
+	fmt.Fprint(w, string(out))
+}
@@ -0,0 +1,46 @@
+package icarus
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestManifest(t *testing.T) {
+	i := NewIcarus("ft_")
+	if err := i.RegisterMetadata("requests", "counter", "How many requests?", "requests"); err != nil {
+		t.Error(err)
+	}
+	if err := i.RegisterMetadata("latency", "gauge", "How slow?", "seconds"); err != nil {
+		t.Error(err)
+	}
+	if err := i.RegisterMetadata("bad", "meter", "", ""); err != errMetadataType {
+		t.Error(err)
+	}
+	i.Record(helper(map[string]string{"__name__": "other"}, 1))
+	eventually(t, func() bool { return len(i.Snapshot()) == 1 })
+
+	g := i.Manifest()
+	want := []Metadata{
+		{"ft_latency", "gauge", "How slow?", "seconds"},
+		{"ft_other", "untyped", "", ""},
+		{"ft_requests", "counter", "How many requests?", "requests"},
+	}
+	if len(g) != len(want) {
+		t.Fatal(g)
+	}
+	for ii := range want {
+		if g[ii] != want[ii] {
+			t.Error(g[ii])
+		}
+	}
+
+	rw := util.NewHTTPResponseWriter()
+	i.ManifestHandleFunc(rw, &http.Request{Form: url.Values{}})
+	if g := rw.String(); !strings.Contains(g, `{"Name":"ft_requests","Type":"counter","Help":"How many requests?","Unit":"requests"}`) {
+		t.Error(g)
+	}
+}
@@ -0,0 +1,58 @@
+package icarus
+
+import (
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// Mirror tees every record to a standby icarus so it stays warm for failover.
+// The standby never holds up the primary: when its channel is full the copy is
+// dropped and counted on the standby. Mirror(nil) stops mirroring.
+func (i *Icarus) Mirror(other *Icarus) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	i.standby = other
+}
+
+// offer hands a record over without waiting.
+func (i *Icarus) offer(x util.Metric) {
+	i.flow.gate.RLock()
+	defer i.flow.gate.RUnlock()
+	if i.flow.shut {
+		i.reject(x, dropClosed)
+		return
+	}
+	size := metricSize(x)
+	if !i.admit(size) {
+		i.reject(x, dropByteBudget)
+		return
+	}
+	x.Admitted = size
+	select {
+	case i.Chan <- x:
+		i.flow.send()
+	default:
+		i.release(size)
+		i.reject(x, dropChannelFull)
+	}
+}
+
+// copyMetric copies the labels, since start rewrites them in place, and the annotations.
+func copyMetric(x util.Metric) util.Metric {
+	if x.Desc == nil {
+		return x
+	}
+	desc := make(map[string]string, len(x.Desc))
+	for key, val := range x.Desc {
+		desc[key] = val
+	}
+	x.Desc = desc
+	if x.Annotations != nil {
+		notes := make(map[string]string, len(x.Annotations))
+		for key, val := range x.Annotations {
+			notes[key] = val
+		}
+		x.Annotations = notes
+	}
+	return x
+}
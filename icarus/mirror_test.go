@@ -0,0 +1,42 @@
+package icarus
+
+import (
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	primary := NewIcarus("ft_")
+	standby := NewIcarus("ft_")
+	primary.Mirror(standby)
+	primary.Record(helper(map[string]string{"__name__": "x", "a": "b"}, 1))
+	eventually(t, func() bool { return len(primary.Snapshot()) == 1 && len(standby.Snapshot()) == 1 })
+	if g := standby.Snapshot()[0]; g.Desc["__name__"] != "ft_x" || g.Desc["a"] != "b" {
+		t.Error(g)
+	}
+	if g := primary.Snapshot()[0]; g.Desc["__name__"] != "ft_x" {
+		t.Error(g)
+	}
+}
+
+func TestMirrorFull(t *testing.T) {
+	primary := NewIcarus("ft_")
+	standby := NewIcarus("ft_")
+	primary.Mirror(standby)
+	before := value(icarusErrorCounter.WithLabelValues(errDropped))
+	// a stuck standby must not hold up the primary.
+	standby.Store.Lock()
+	for _, val := range []string{"1", "2", "3", "4"} {
+		primary.Record(helper(map[string]string{"__name__": "x", "a": val}, 1))
+	}
+	eventually(t, func() bool { return len(primary.Snapshot()) == 4 })
+	standby.Store.Unlock()
+	if g := value(icarusErrorCounter.WithLabelValues(errDropped)); g <= before {
+		t.Error(g)
+	}
+	primary.Mirror(nil)
+	primary.Record(helper(map[string]string{"__name__": "y"}, 1))
+	eventually(t, func() bool { return len(primary.Snapshot()) == 5 })
+	if g := len(standby.Snapshot()); g >= 4 {
+		t.Error(g)
+	}
+}
@@ -0,0 +1,200 @@
+package icarus
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openMetricsType is the Content-Type of an OpenMetrics response.
+const openMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// SetOpenMetrics has HandleFunc serve the OpenMetrics text format to scrapes
+// whose Accept header asks for application/openmetrics-text. Samples come
+// grouped into their metric families, sorted by name, each with its TYPE and
+// any HELP: the default registry's own, those given to RegisterMetadata for
+// icarus series, and unknown for the rest. Every icarus sample is stamped
+// with when the store window of its rollup started, the same for all of a
+// rollup, so scrapers line samples up on window boundaries rather than on
+// when they happened to scrape; the default registry's are not stamped. Off,
+// the default, such scrapes get text and count under
+// icarus_unsupported_accept_counter.
+func (i *Icarus) SetOpenMetrics(on bool) {
+	i.configChanged()
+	i.scrapes.Lock()
+	defer i.scrapes.Unlock()
+	i.scrapes.openMetrics = on
+}
+
+func (i *Icarus) servesOpenMetrics() bool {
+	i.scrapes.Lock()
+	defer i.scrapes.Unlock()
+	return i.scrapes.openMetrics
+}
+
+// openMetricsOutput is the response to a scrape asking for OpenMetrics,
+// leaving out the series not updated for maxAge if it is above zero. It is
+// put together for each scrape, never cached.
+func (i *Icarus) openMetricsOutput(maxAge time.Duration) string {
+	i.counter(icarusScrapeAssemblies).Inc()
+	cut := int64(0)
+	if maxAge > 0 {
+		cut = i.now().Add(-maxAge).Unix()
+	}
+	page, window := i.servePage().readWindow(cut)
+	if !i.isReady() {
+		page += i.notReady()
+		window = i.Store.Current()
+	}
+	defaults := i.defaultSection()
+	families := newOMFamilies()
+	families.describe(defaults)
+	i.Lock()
+	for name, meta := range i.metadata {
+		families.typed(name, meta.Type, escapeHelp(meta.Help))
+	}
+	i.Unlock()
+	families.add(defaults, "\n")
+	families.add(page, " "+strconv.FormatInt(window, 10)+"\n")
+	return families.String()
+}
+
+// omTypes are the OpenMetrics names of the text format's types.
+var omTypes = map[string]string{
+	"counter":   "counter",
+	"gauge":     "gauge",
+	"histogram": "histogram",
+	"summary":   "summary",
+	"untyped":   "unknown",
+}
+
+// omSuffixes are the sample name suffixes a family of each type may use.
+var omSuffixes = map[string][]string{
+	"counter":   {"_total"},
+	"histogram": {"_bucket", "_sum", "_count"},
+	"summary":   {"_sum", "_count"},
+}
+
+// omFamily is a metric family and its samples, in the order they came.
+type omFamily struct {
+	kind  string
+	help  string
+	lines []string
+}
+
+// omFamilies gathers text format samples into OpenMetrics families.
+type omFamilies struct {
+	// types and helps are what is known of each text format family.
+	types, helps map[string]string
+	families     map[string]*omFamily
+}
+
+func newOMFamilies() *omFamilies {
+	return &omFamilies{make(map[string]string), make(map[string]string), make(map[string]*omFamily)}
+}
+
+// typed notes the type and help of the text format family name.
+func (f *omFamilies) typed(name, kind, help string) {
+	if _, ok := omTypes[kind]; ok {
+		f.types[name] = kind
+	}
+	if help != "" {
+		f.helps[name] = help
+	}
+}
+
+// describe reads the TYPE and HELP lines of a text format page.
+func (f *omFamilies) describe(page string) {
+	for _, line := range strings.Split(page, "\n") {
+		fields := strings.SplitN(line, " ", 4)
+		if (len(fields) < 4) || (fields[0] != "#") {
+			continue
+		}
+		switch fields[1] {
+		case "TYPE":
+			f.typed(fields[2], fields[3], "")
+		case "HELP":
+			f.typed(fields[2], "", strings.Replace(fields[3], "\"", "\\\"", -1))
+		}
+	}
+}
+
+// family is the text format family of a sample called name, then its
+// OpenMetrics family and the sample's OpenMetrics name. OpenMetrics counter
+// samples always end _total, so those that do not get it added and the
+// family name never has it. A counter whose family name another family
+// already has, as go_memstats_alloc_bytes_total does, is left unknown.
+func (f *omFamilies) family(name string) (text, family, sample string) {
+	if kind, ok := f.types[name]; ok {
+		if kind == "counter" {
+			family = strings.TrimSuffix(name, "_total")
+			if _, clash := f.types[family]; clash && (family != name) {
+				return "", name, name
+			}
+			return name, family, family + "_total"
+		}
+		return name, name, name
+	}
+	for kind, suffixes := range omSuffixes {
+		for _, suffix := range suffixes {
+			base := strings.TrimSuffix(name, suffix)
+			if (base != name) && (f.types[base] == kind) {
+				return base, base, name
+			}
+		}
+	}
+	return name, name, name
+}
+
+// add files every sample of a text format page under its family, ending
+// each line with end.
+func (f *omFamilies) add(page, end string) {
+	for _, line := range strings.Split(page, "\n") {
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := line
+		if cut := strings.IndexAny(line, "{ "); cut >= 0 {
+			name = line[:cut]
+		}
+		text, family, sample := f.family(name)
+		fam, ok := f.families[family]
+		if !ok {
+			kind := f.types[text]
+			if kind == "" {
+				kind = "untyped"
+			}
+			fam = &omFamily{kind: kind, help: f.helps[text]}
+			f.families[family] = fam
+		}
+		fam.lines = append(fam.lines, sample+line[len(name):]+end)
+	}
+}
+
+// String is the families in the OpenMetrics text format, sorted by name.
+func (f *omFamilies) String() string {
+	names := make([]string, 0, len(f.families))
+	for name := range f.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out strings.Builder
+	for _, name := range names {
+		fam := f.families[name]
+		if fam.help != "" {
+			out.WriteString("# HELP " + name + " " + fam.help + "\n")
+		}
+		out.WriteString("# TYPE " + name + " " + omTypes[fam.kind] + "\n")
+		for _, line := range fam.lines {
+			out.WriteString(line)
+		}
+	}
+	out.WriteString("# EOF\n")
+	return out.String()
+}
+
+// escapeHelp escapes help text for a HELP line.
+func escapeHelp(help string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"").Replace(help)
+}
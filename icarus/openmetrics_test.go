@@ -0,0 +1,185 @@
+package icarus
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsOpenMetrics(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                 false,
+		"*/*":                              false,
+		"application/openmetrics-text":     true,
+		"application/openmetrics-text;q=0": false,
+		"text/plain;q=0.5,application/openmetrics-text;version=1.0.0": true,
+	} {
+		if g := acceptsOpenMetrics(accept); g != want {
+			t.Error(accept, g)
+		}
+	}
+}
+
+var (
+	omSample      = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*)?\})? (\S+)(?: (\S+))?$`)
+	omDescription = regexp.MustCompile(`^# (HELP|TYPE|UNIT) ([a-zA-Z_:][a-zA-Z0-9_:]*)(?: (.*))?$`)
+)
+
+// checkOpenMetrics holds body to the OpenMetrics text format: HELP and TYPE
+// ahead of the samples of their family, each family in one piece with the
+// sample names its type allows, and a # EOF at the end.
+func checkOpenMetrics(t *testing.T, body string) {
+	if !strings.HasSuffix(body, "\n# EOF\n") {
+		t.Error("no # EOF at the end", body)
+	}
+	allowed := map[string][]string{
+		"counter":   {"_total", "_created"},
+		"gauge":     {""},
+		"unknown":   {""},
+		"histogram": {"_bucket", "_sum", "_count", "_created"},
+		"summary":   {"", "_sum", "_count", "_created"},
+	}
+	done := make(map[string]bool)
+	family, kind, sampled := "", "", false
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n# EOF\n"), "\n") {
+		if m := omDescription.FindStringSubmatch(line); m != nil {
+			if m[2] != family {
+				if done[m[2]] {
+					t.Error("family split up:", line)
+				}
+				done[family] = true
+				family, kind, sampled = m[2], "unknown", false
+			}
+			if sampled {
+				t.Error("description after samples:", line)
+			}
+			if m[1] == "TYPE" {
+				if _, ok := allowed[m[3]]; !ok {
+					t.Error("bad type:", line)
+				}
+				kind = m[3]
+			}
+			continue
+		}
+		m := omSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Error("bad line:", line)
+			continue
+		}
+		sampled = true
+		if _, err := strconv.ParseFloat(m[3], 64); err != nil {
+			t.Error("bad value:", line)
+		}
+		if _, err := strconv.ParseFloat(m[4], 64); (m[4] != "") && (err != nil) {
+			t.Error("bad timestamp:", line)
+		}
+		ok := false
+		for _, suffix := range allowed[kind] {
+			ok = ok || (m[1] == family+suffix)
+		}
+		if !ok {
+			t.Error("sample outside its family "+family+":", line)
+		}
+	}
+}
+
+func TestOpenMetricsFamilies(t *testing.T) {
+	i := newIcarus("ft_", time.NewTicker(time.Hour), make(chan time.Time))
+	i.SetOpenMetrics(true)
+	if err := i.RegisterMetadata("requests", "counter", `how many "requests"`, ""); err != nil {
+		t.Error(err)
+	}
+	i.Record(helper(map[string]string{"__name__": "x", "a": "b"}, 1))
+	i.Record(helper(map[string]string{"__name__": "requests", "code": "200"}, 5))
+	i.Record(helper(map[string]string{"__name__": "x", "a": "c"}, 2))
+	i.Record(helper(map[string]string{"__name__": "requests", "code": "500"}, 1))
+	i.Drain()
+	i.rollup()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Accept", "application/openmetrics-text")
+	i.HandleFunc(w, r)
+	body := w.Body.String()
+	checkOpenMetrics(t, body)
+	for _, want := range []string{
+		"\n# HELP ft_requests how many \\\"requests\\\"\n# TYPE ft_requests counter\nft_requests_total{",
+		"\nft_requests_total{code=\"200\"} 5 ",
+		"\nft_requests_total{code=\"500\"} 1 ",
+		"\n# TYPE ft_x unknown\nft_x{",
+		"\nft_x{a=\"b\"} 1 ",
+		"\nft_x{a=\"c\"} 2 ",
+		// the default registry keeps its types.
+		"\n# TYPE icarus_samples_observed counter\nicarus_samples_observed_total ",
+		"\n# TYPE icarus_scrapes_in_progress gauge\nicarus_scrapes_in_progress ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Error(want, body)
+		}
+	}
+}
+
+func TestOpenMetrics(t *testing.T) {
+	i := newIcarus("ft_", time.NewTicker(time.Hour), make(chan time.Time))
+	now := time.Unix(1500000000, 0)
+	i.now = func() time.Time { return now }
+	i.SetOpenMetrics(true)
+	scrape := func(accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Accept", accept)
+		i.HandleFunc(w, r)
+		return w
+	}
+	// every sample of a rollup carries the start of the window it was rolled up in.
+	stamped := func(body, want string) {
+		lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+		if lines[len(lines)-1] != "# EOF" {
+			t.Error(body)
+		}
+		for _, line := range lines[:len(lines)-1] {
+			if strings.HasPrefix(line, "ft_") && !strings.HasSuffix(line, " "+want) {
+				t.Error(line)
+			}
+		}
+		checkOpenMetrics(t, body)
+	}
+
+	i.rollStoreBusiness()
+	i.Record(helper(map[string]string{"__name__": "x", "a": "b"}, 1))
+	i.Record(helper(map[string]string{"__name__": "y"}, 2))
+	i.Drain()
+	// later samples in the window do not move its timestamp.
+	now = now.Add(20 * time.Second)
+	i.rollup()
+	w := scrape("application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	if g := w.Header().Get("Content-Type"); g != openMetricsType {
+		t.Error(g)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"\nft_x{a=\"b\"} 1 1500000000\n", "\nft_y{} 2 1500000000\n"} {
+		if !strings.Contains(body, want) {
+			t.Error(want, body)
+		}
+	}
+	stamped(body, "1500000000")
+
+	now = now.Add(40 * time.Second)
+	i.rollStoreBusiness()
+	i.Record(helper(map[string]string{"__name__": "x", "a": "b"}, 3))
+	i.Drain()
+	i.rollup()
+	body = scrape("application/openmetrics-text").Body.String()
+	if !strings.Contains(body, "\nft_x{a=\"b\"} 3 1500000060\n") {
+		t.Error(body)
+	}
+	stamped(body, "1500000060")
+
+	// scrapers not asking for it still get text.
+	w = scrape("text/plain")
+	if g := w.Header().Get("Content-Type"); !strings.HasPrefix(g, "text/plain") || strings.Contains(w.Body.String(), "1500000060") {
+		t.Error(g, w.Body.String())
+	}
+}
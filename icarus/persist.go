@@ -0,0 +1,201 @@
+package icarus
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// persisted are the self-metric counters SetCounterFile carries across
+// restarts, by name. Named instances' counts are saved under their instance
+// label and restored to the instance of that name.
+var persisted = map[string]prometheus.Collector{
+	"icarus_request_counter":        icarusRequestCounter,
+	"icarus_error_counter":          icarusErrorCounter,
+	"icarus_samples_observed_total": icarusSamplesObserved,
+	"icarus_dropped_total":          icarusDroppedCounter,
+}
+
+// Errors restoring a counter file that does not match the counters.
+var (
+	errNegativeCount = errors.New("counter file holds a negative count")
+	errCounterLabels = errors.New("counter file has labels for an unlabelled counter")
+	errNotCounter    = errors.New("persisted metric is not a counter")
+)
+
+// savedCounter is one series of a persisted counter as written to disk.
+type savedCounter struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// SetCounterFile keeps the self-metric counters in path so they carry on
+// from where they were across restarts. The counts saved there are added
+// back straight away, then saved again after every rollup. If the file
+// cannot be read the counters start from zero and the error is returned;
+// a missing file is not an error. Restore once per process, as restoring
+// again adds the saved counts twice. The empty path, the default, turns
+// saving off.
+func (i *Icarus) SetCounterFile(path string) error {
+	i.configChanged()
+	i.Lock()
+	i.counterFile = path
+	i.Unlock()
+	if path == "" {
+		return nil
+	}
+	err := RestoreCounters(path)
+	if err != nil {
+		i.countError(errPersist)
+		log.Printf("icarus counters not restored from %s, starting from zero: %v", path, err)
+	}
+	return err
+}
+
+// saveCounters writes the counters to the counter file, if there is one.
+// Call with the lock held.
+func (i *Icarus) saveCounters() {
+	if i.counterFile == "" {
+		return
+	}
+	if err := SaveCounters(i.counterFile); err != nil {
+		i.countError(errPersist)
+		log.Printf("icarus counters not saved to %s: %v", i.counterFile, err)
+	}
+}
+
+// SaveCounters writes the current values of the self-metric counters to
+// path. It writes a temporary file alongside and renames it over path, so a
+// crash part way leaves the last good file.
+func SaveCounters(path string) error {
+	saved := make(map[string][]savedCounter, len(persisted))
+	for name, c := range persisted {
+		counts, err := collectCounts(c)
+		if err != nil {
+			return err
+		}
+		for _, self := range instances.all() {
+			own, err := collectCounts(self.copies[c])
+			if err != nil {
+				return err
+			}
+			for ii := range own {
+				if own[ii].Labels == nil {
+					own[ii].Labels = make(map[string]string, 1)
+				}
+				own[ii].Labels[instanceLabel] = self.name
+			}
+			counts = append(counts, own...)
+		}
+		saved[name] = counts
+	}
+	out, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RestoreCounters adds the counts saved in path by SaveCounters to the
+// self-metric counters. Nothing is added unless the whole file is good.
+// Counters missing from the file, or no longer known, are skipped.
+func RestoreCounters(path string) error {
+	in, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := map[string][]savedCounter{}
+	if err := json.Unmarshal(in, &saved); err != nil {
+		return err
+	}
+	var adds []func()
+	for name, counts := range saved {
+		c, ok := persisted[name]
+		if !ok {
+			continue
+		}
+		for _, count := range counts {
+			if count.Value < 0 {
+				return errNegativeCount
+			}
+			counter, err := counterFor(persistedFor(c, count.Labels))
+			if err != nil {
+				return err
+			}
+			value := count.Value
+			adds = append(adds, func() { counter.Add(value) })
+		}
+	}
+	for _, add := range adds {
+		add()
+	}
+	return nil
+}
+
+// collectCounts reads every series of a counter or counter vec.
+func collectCounts(c prometheus.Collector) ([]savedCounter, error) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var counts []savedCounter
+	var err error
+	for m := range ch {
+		var out dto.Metric
+		if writeErr := m.Write(&out); writeErr != nil {
+			err = writeErr
+			continue
+		}
+		count := savedCounter{Value: out.GetCounter().GetValue()}
+		if len(out.Label) > 0 {
+			count.Labels = make(map[string]string, len(out.Label))
+			for _, pair := range out.Label {
+				count.Labels[pair.GetName()] = pair.GetValue()
+			}
+		}
+		counts = append(counts, count)
+	}
+	return counts, err
+}
+
+// persistedFor is the counter saved labels belong to, a named instance's
+// own if they carry its instance label, and the rest of the labels.
+func persistedFor(c prometheus.Collector, labels map[string]string) (prometheus.Collector, map[string]string) {
+	name, ok := labels[instanceLabel]
+	if !ok {
+		return c, labels
+	}
+	rest := make(map[string]string, len(labels)-1)
+	for k, v := range labels {
+		if k != instanceLabel {
+			rest[k] = v
+		}
+	}
+	return instances.named(name).copies[c], rest
+}
+
+// counterFor finds the series of c with the given labels.
+func counterFor(c prometheus.Collector, labels map[string]string) (prometheus.Counter, error) {
+	switch c := c.(type) {
+	case *prometheus.CounterVec:
+		return c.GetMetricWith(labels)
+	case prometheus.Counter:
+		if len(labels) > 0 {
+			return nil, errCounterLabels
+		}
+		return c, nil
+	}
+	return nil, errNotCounter
+}
@@ -0,0 +1,95 @@
+package icarus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCounterFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icarus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "counters.json")
+
+	ticks := make(chan time.Time)
+	i := newIcarus("ft_", time.NewTicker(time.Hour), ticks)
+	if err := i.SetCounterFile(path); err != nil {
+		t.Error(err)
+	}
+	i.countRequest()
+	i.countRequest()
+	i.rollup()
+	saved := value(icarusRequestCounter)
+
+	// a restarted process starts its counters at zero and adds back what was
+	// saved, so here the saved count is added on top of the live one.
+	restarted := newIcarus("ft_", time.NewTicker(time.Hour), ticks)
+	if err := restarted.SetCounterFile(path); err != nil {
+		t.Error(err)
+	}
+	if g := value(icarusRequestCounter); g != 2*saved {
+		t.Error(saved, g)
+	}
+}
+
+func TestCounterFileInstance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icarus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "counters.json")
+
+	ticks := make(chan time.Time)
+	i := newIcarus("ft_", time.NewTicker(time.Hour), ticks)
+	i.SetInstance("persisted")
+	if err := i.SetCounterFile(path); err != nil {
+		t.Error(err)
+	}
+	i.countRequest()
+	i.rollup()
+	saved := value(i.counter(icarusRequestCounter))
+
+	// the count goes back to the instance of the same name.
+	if err := newIcarus("ft_", time.NewTicker(time.Hour), ticks).SetCounterFile(path); err != nil {
+		t.Error(err)
+	}
+	if g := value(i.counter(icarusRequestCounter)); g != 2*saved {
+		t.Error(saved, g)
+	}
+}
+
+func TestCounterFileBad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icarus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "counters.json")
+	ioutil.WriteFile(path, []byte(`{"icarus_request_counter":[{"value":5}],"icarus_dropped_total":[{"value":-1}]}`), 0644)
+
+	ticks := make(chan time.Time)
+	i := newIcarus("ft_", time.NewTicker(time.Hour), ticks)
+	before := value(icarusRequestCounter)
+	failed := value(icarusErrorCounter.WithLabelValues(errPersist))
+	if err := i.SetCounterFile(path); err == nil {
+		t.Error("restored a negative count")
+	}
+	// a bad file restores nothing.
+	if g := value(icarusRequestCounter); g != before {
+		t.Error(before, g)
+	}
+	if g := value(icarusErrorCounter.WithLabelValues(errPersist)); g != failed+1 {
+		t.Error(failed, g)
+	}
+
+	// a missing file is a first start.
+	if err := i.SetCounterFile(filepath.Join(dir, "missing.json")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,117 @@
+package icarus
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// bucket is one cumulative histogram bucket.
+type bucket struct {
+	upper float64
+	count float64
+}
+
+// SetQuantiles makes rollups estimate the given quantiles of the stored
+// <name>_bucket histogram and emit them as <name>_quantile. Names are given
+// without the prefix.
+func (i *Icarus) SetQuantiles(name string, quantiles []float64) {
+	i.configChanged()
+	i.Lock()
+	defer i.Unlock()
+	i.quantiles[i.prefix+name] = quantiles
+}
+
+// histogramQuantiles estimates the configured quantiles from the bucket series
+// in mets, noting each in seen as last updated with its newest bucket.
+func (i *Icarus) histogramQuantiles(mets []util.Metric, seen lastSeen) []util.Metric {
+	type histogram struct {
+		labels  map[string]string
+		buckets []bucket
+		// seen is when the newest bucket was last updated.
+		seen  int64
+		known bool
+	}
+	histograms := make(map[string]*histogram)
+	for _, met := range mets {
+		name := strings.TrimSuffix(met.Desc["__name__"], "_bucket")
+		if _, ok := i.quantiles[name]; !ok || name == met.Desc["__name__"] {
+			continue
+		}
+		upper, err := strconv.ParseFloat(met.Desc["le"], 64)
+		if err != nil {
+			continue
+		}
+		labels := make(map[string]string)
+		for key, val := range met.Desc {
+			if key != "le" {
+				labels[key] = val
+			}
+		}
+		labels["__name__"] = name
+		key := util.MapSSToS(labels)
+		if _, ok := histograms[key]; !ok {
+			histograms[key] = &histogram{labels: labels}
+		}
+		hist := histograms[key]
+		hist.buckets = append(hist.buckets, bucket{upper, met.Data.Val})
+		if at, ok := seen.of(met.Desc); ok && (!hist.known || (at > hist.seen)) {
+			hist.seen, hist.known = at, true
+		}
+	}
+	out := make([]util.Metric, 0)
+	for _, hist := range histograms {
+		sort.Slice(hist.buckets, func(a, b int) bool { return hist.buckets[a].upper < hist.buckets[b].upper })
+		name := hist.labels["__name__"]
+		for _, q := range i.quantiles[name] {
+			desc := make(map[string]string)
+			for key, val := range hist.labels {
+				desc[key] = val
+			}
+			desc["__name__"] = name + "_quantile"
+			desc["quantile"] = strconv.FormatFloat(q, 'f', -1, 64)
+			if hist.known {
+				seen.note(desc, hist.seen)
+			}
+			out = append(out, util.Metric{Desc: desc, Data: util.DataPoint{Val: bucketQuantile(q, hist.buckets)}})
+		}
+	}
+	return out
+}
+
+// bucketQuantile interpolates a quantile out of sorted cumulative buckets the
+// same way prometheus' histogram_quantile does. Without at least two buckets,
+// the last of them +Inf, there is nothing to go on and it is NaN.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	if (len(buckets) < 2) || !math.IsInf(buckets[len(buckets)-1].upper, 1) {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(ii int) bool { return buckets[ii].count >= rank })
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upper
+	}
+	if (b == 0) && (buckets[0].upper <= 0) {
+		return buckets[0].upper
+	}
+	start, end, count := 0., buckets[b].upper, buckets[b].count
+	if b > 0 {
+		start = buckets[b-1].upper
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return start + (end-start)*(rank/count)
+}
@@ -0,0 +1,44 @@
+package icarus
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestBucketQuantile(t *testing.T) {
+	buckets := []bucket{{0.1, 0}, {0.2, 50}, {0.4, 100}, {math.Inf(1), 100}}
+	for q, want := range map[float64]float64{0.25: 0.15, 0.5: 0.2, 0.75: 0.3, 0.99: 0.396} {
+		if g := bucketQuantile(q, buckets); math.Abs(g-want) > 1e-9 {
+			t.Error(q, g)
+		}
+	}
+	if g := bucketQuantile(0.5, buckets[3:]); !math.IsNaN(g) {
+		t.Error(g)
+	}
+	if g := bucketQuantile(0.5, buckets[:3]); !math.IsNaN(g) {
+		t.Error(g)
+	}
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetQuantiles("lat", []float64{0.5, 0.75})
+	i.SetQuantiles("thin", []float64{0.5})
+	for le, count := range map[string]float64{"0.1": 0, "0.2": 50, "0.4": 100, "+Inf": 100} {
+		i.Record(helper(map[string]string{"__name__": "lat_bucket", "le": le, "a": "b"}, count))
+	}
+	i.Record(helper(map[string]string{"__name__": "thin_bucket", "le": "+Inf"}, 3))
+	eventually(t, func() bool { return len(i.Snapshot()) == 5 })
+	i.rollup()
+	page := i.servePage().Read()
+	for _, want := range []string{
+		`ft_lat_quantile{a="b",quantile="0.5"} 0.2`,
+		`ft_lat_quantile{a="b",quantile="0.75"} 0.3`,
+		`ft_thin_quantile{quantile="0.5"} NaN`,
+	} {
+		if !strings.Contains(page, want+"\n") {
+			t.Error(want, page)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package icarus
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// ingestRates counts samples per metric name between rollups.
+type ingestRates struct {
+	*sync.Mutex
+	on     bool
+	counts map[string]int
+	// seen is when a sample was last stored under each name, unix seconds.
+	seen map[string]int64
+	// last is when the counts last started afresh.
+	last time.Time
+	// rates are what the last flush that saw time pass worked out.
+	rates []rate
+}
+
+// rate is the ingest rate of a name and when it last had a sample.
+type rate struct {
+	name string
+	val  float64
+	seen int64
+}
+
+// SetIngestRates turns on a <name>_ingest_rate series for every metric name,
+// the samples per second recorded under it since the last rollup, however long
+// ago that was. A name that goes quiet reports 0 once before it is forgotten.
+func (i *Icarus) SetIngestRates(on bool) {
+	i.configChanged()
+	i.rates.Lock()
+	defer i.rates.Unlock()
+	i.rates.on = on
+	i.rates.counts = make(map[string]int)
+	i.rates.seen = make(map[string]int64)
+	i.rates.last = i.now()
+	i.rates.rates = nil
+}
+
+// count notes a sample stored under name at the given unix second.
+func (r *ingestRates) count(name string, at int64) {
+	r.Lock()
+	defer r.Unlock()
+	if r.on {
+		r.counts[name]++
+		r.seen[name] = at
+	}
+}
+
+// flush turns the counts into rates over the time since the last flush and
+// starts counting afresh. If no time has passed the counts carry on to the
+// next flush and the last rates are given again. Each rate is noted in seen
+// as last updated with the last sample under its name.
+func (r *ingestRates) flush(now time.Time, seen lastSeen) []util.Metric {
+	r.Lock()
+	defer r.Unlock()
+	if !r.on {
+		return nil
+	}
+	if seconds := now.Sub(r.last).Seconds(); seconds > 0 {
+		r.last = now
+		names := make([]string, 0, len(r.counts))
+		for name := range r.counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		r.rates = make([]rate, 0, len(names))
+		for _, name := range names {
+			count := r.counts[name]
+			r.rates = append(r.rates, rate{name, float64(count) / seconds, r.seen[name]})
+			if count == 0 {
+				delete(r.counts, name)
+				delete(r.seen, name)
+			} else {
+				r.counts[name] = 0
+			}
+		}
+	}
+	out := make([]util.Metric, 0, len(r.rates))
+	for _, rate := range r.rates {
+		desc := map[string]string{"__name__": rate.name + "_ingest_rate"}
+		seen.note(desc, rate.seen)
+		out = append(out, util.Metric{Desc: desc, Data: util.DataPoint{Val: rate.val}})
+	}
+	return out
+}
@@ -0,0 +1,88 @@
+package icarus
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIngestRates(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Unix(1500000000, 0)
+	i.now = func() time.Time { return now }
+	i.SetIngestRates(true)
+	now = now.Add(10 * time.Second)
+	for ii := 0; ii < 10; ii++ {
+		i.Record(helper(map[string]string{"__name__": "x"}, float64(ii)))
+	}
+	i.Record(helper(map[string]string{"__name__": "y"}, 1))
+	eventually(t, func() bool {
+		i.rates.Lock()
+		defer i.rates.Unlock()
+		return i.rates.counts["ft_y"] == 1
+	})
+	i.rollup()
+	page := i.servePage().Read()
+	for _, want := range []string{"\nft_x_ingest_rate{} 1\n", "\nft_y_ingest_rate{} 0.1\n"} {
+		if !strings.Contains(page, want) {
+			t.Error(want, page)
+		}
+	}
+	now = now.Add(10 * time.Second)
+	i.rollup()
+	if page := i.servePage().Read(); !strings.Contains(page, "\nft_x_ingest_rate{} 0\n") {
+		t.Error(page)
+	}
+	now = now.Add(10 * time.Second)
+	i.rollup()
+	if page := i.servePage().Read(); strings.Contains(page, "ingest_rate") {
+		t.Error(page)
+	}
+
+	i.SetIngestRates(false)
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.rollup()
+	if page := i.servePage().Read(); strings.Contains(page, "ingest_rate") {
+		t.Error(page)
+	}
+}
+
+func TestIngestRatesElapsed(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Unix(1500000000, 0)
+	i.now = func() time.Time { return now }
+	i.SetIngestRates(true)
+	record := func(n int) {
+		for ii := 0; ii < n; ii++ {
+			i.Record(helper(map[string]string{"__name__": "x"}, float64(ii)))
+		}
+		i.Drain()
+	}
+	// an early rollup divides by the time that passed, not the interval.
+	record(10)
+	now = now.Add(2 * time.Second)
+	i.rollup()
+	if page := i.servePage().Read(); !strings.Contains(page, "\nft_x_ingest_rate{} 5\n") {
+		t.Error(page)
+	}
+	// so does a late one.
+	record(10)
+	now = now.Add(20 * time.Second)
+	i.rollup()
+	if page := i.servePage().Read(); !strings.Contains(page, "\nft_x_ingest_rate{} 0.5\n") {
+		t.Error(page)
+	}
+	// with no time passed the counts wait for the next rollup, and the page
+	// keeps the last rate.
+	record(4)
+	i.rollup()
+	if page := i.servePage().Read(); !strings.Contains(page, "\nft_x_ingest_rate{} 0.5\n") {
+		t.Error(page)
+	}
+	now = now.Add(time.Second)
+	record(4)
+	i.rollup()
+	if page := i.servePage().Read(); !strings.Contains(page, "\nft_x_ingest_rate{} 8\n") {
+		t.Error(page)
+	}
+}
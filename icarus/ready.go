@@ -0,0 +1,39 @@
+package icarus
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// isReady says whether the first page has been rolled up.
+func (i *Icarus) isReady() bool {
+	return atomic.LoadInt32(&i.ready) == 1
+}
+
+// readyMetric is <prefix>ready, 1 once the first page is rolled up.
+func (i *Icarus) readyMetric(ready bool) util.Metric {
+	val := 0.
+	if ready {
+		val = 1
+	}
+	return util.Metric{Desc: map[string]string{"__name__": i.prefix + "ready"}, Data: util.DataPoint{Val: val}}
+}
+
+// notReady is the line scrapes get until the first page is rolled up.
+func (i *Icarus) notReady() string {
+	i.Lock()
+	defer i.Unlock()
+	return "\n" + MetricToProm(i.withEnvLabels(i.readyMetric(false)))
+}
+
+// ReadyzHandleFunc answers 200 once the first page is rolled up and 503 until then.
+func (i *Icarus) ReadyzHandleFunc(w http.ResponseWriter, r *http.Request) {
+	if !i.isReady() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "ready")
+}
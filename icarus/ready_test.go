@@ -0,0 +1,35 @@
+package icarus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReady(t *testing.T) {
+	i := NewIcarus("ft_")
+	scrape := func() string {
+		rw := httptest.NewRecorder()
+		i.HandleFunc(rw, httptest.NewRequest("GET", "/metrics", nil))
+		return rw.Body.String()
+	}
+	readyz := func() int {
+		rw := httptest.NewRecorder()
+		i.ReadyzHandleFunc(rw, httptest.NewRequest("GET", "/readyz", nil))
+		return rw.Code
+	}
+	if g := scrape(); !strings.Contains(g, "\nft_ready{} 0\n") {
+		t.Error(g)
+	}
+	if g := readyz(); g != http.StatusServiceUnavailable {
+		t.Error(g)
+	}
+	i.rollup()
+	if g := scrape(); !strings.Contains(g, "\nft_ready{} 1\n") || strings.Contains(g, "ft_ready{} 0") {
+		t.Error(g)
+	}
+	if g := readyz(); g != http.StatusOK {
+		t.Error(g)
+	}
+}
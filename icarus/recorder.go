@@ -0,0 +1,81 @@
+package icarus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// Recorder coalesces samples of the same series over a short window before
+// recording them into an icarus, for callers too chatty to send each one.
+// It is a util.Recorder.
+type Recorder struct {
+	*sync.Mutex
+	icarus  *Icarus
+	agg     Aggregation
+	pending map[string]storeEntry
+	order   []string
+	stop    chan bool
+	done    chan bool
+	once    *sync.Once
+}
+
+// NewRecorder starts a Recorder that flushes into i every window. Samples of a
+// series within a window combine by agg, AggSum or AggLast say.
+func NewRecorder(i *Icarus, window time.Duration, agg Aggregation) *Recorder {
+	var mux sync.Mutex
+	var once sync.Once
+	r := &Recorder{&mux, i, agg, make(map[string]storeEntry), nil, make(chan bool), make(chan bool), &once}
+	go r.flushEvery(window)
+	return r
+}
+
+// Record keeps a sample until the next flush.
+func (r *Recorder) Record(x util.Metric) {
+	x = copyMetric(x)
+	key := util.MapSSToS(x.Desc)
+	r.Lock()
+	defer r.Unlock()
+	entry, ok := r.pending[key]
+	if !ok {
+		r.pending[key] = storeEntry{x, entryStats{Count: 1}}
+		r.order = append(r.order, key)
+		return
+	}
+	entry.Count++
+	entry.Metric = r.agg.combine(entry.Metric, x, entry.Count)
+	r.pending[key] = entry
+}
+
+// Flush records everything pending, in the order the series first came.
+func (r *Recorder) Flush() {
+	r.Lock()
+	pending, order := r.pending, r.order
+	r.pending, r.order = make(map[string]storeEntry), nil
+	r.Unlock()
+	for _, key := range order {
+		r.icarus.Record(pending[key].Metric)
+	}
+}
+
+// Finish stops flushing after one last flush.
+func (r *Recorder) Finish() {
+	r.once.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+func (r *Recorder) flushEvery(window time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Flush()
+		case <-r.stop:
+			r.Flush()
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package icarus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+// Recorder stands in for an icarus wherever a util.Recorder will do.
+var _ util.Recorder = &Recorder{}
+
+func TestRecorder(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.SetAggregation("x", AggSum)
+	r := NewRecorder(i, time.Hour, AggSum)
+	for ii := 0; ii < 100; ii++ {
+		r.Record(helper(map[string]string{"__name__": "x"}, 1))
+	}
+	r.Record(helper(map[string]string{"__name__": "y"}, 1))
+	r.Record(helper(map[string]string{"__name__": "y"}, 3))
+	i.Drain()
+	if g := i.Snapshot(); len(g) != 0 {
+		t.Error(g)
+	}
+	i.SetInstance("recorder")
+	before := value(i.counter(icarusSamplesObserved))
+	r.Finish()
+	r.Finish()
+	i.Drain()
+	// one insert each, the store sums again only if more come.
+	if g := value(i.counter(icarusSamplesObserved)); g != before+2 {
+		t.Error(g)
+	}
+	for _, met := range i.Snapshot() {
+		if want := map[string]float64{"ft_x": 100, "ft_y": 4}[met.Desc["__name__"]]; met.Data.Val != want {
+			t.Error(met)
+		}
+	}
+}
+
+func TestRecorderFlushes(t *testing.T) {
+	i := NewIcarus("ft_")
+	r := NewRecorder(i, time.Millisecond, AggLast)
+	defer r.Finish()
+	r.Record(helper(map[string]string{"__name__": "x"}, 1))
+	r.Record(helper(map[string]string{"__name__": "x"}, 2))
+	eventually(t, func() bool { g := i.Snapshot(); return len(g) == 1 && g[0].Data.Val == 2 })
+}
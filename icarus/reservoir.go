@@ -0,0 +1,81 @@
+package icarus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxSampledKeys is how many label keys the reservoir keeps values for; keys
+// are unbounded, the reservoir must not be.
+const maxSampledKeys = 256
+
+// reservoir keeps the most recent distinct values seen for each label key.
+type reservoir struct {
+	*sync.Mutex
+	size   int
+	values map[string][]string
+}
+
+// SetLabelSamples keeps, for each label key, the last size distinct values it
+// was ingested with, for LabelSamplesHandleFunc. It shows what is driving
+// cardinality without dumping the store. Only the first maxSampledKeys label
+// keys seen are kept, later keys are left out. Zero, the default, keeps nothing.
+func (i *Icarus) SetLabelSamples(size int) {
+	i.configChanged()
+	i.samples.Lock()
+	defer i.samples.Unlock()
+	i.samples.size = size
+	i.samples.values = make(map[string][]string)
+}
+
+// observe notes the label values of a sample, leaving out keys new past
+// maxSampledKeys.
+func (r *reservoir) observe(desc map[string]string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.size <= 0 {
+		return
+	}
+	for key, val := range desc {
+		if key == "__name__" {
+			continue
+		}
+		if _, ok := r.values[key]; !ok && (len(r.values) >= maxSampledKeys) {
+			continue
+		}
+		r.values[key] = recent(r.values[key], val, r.size)
+	}
+}
+
+// recent moves val to the end of vals, pushing out the oldest past size.
+func recent(vals []string, val string, size int) []string {
+	for ii, old := range vals {
+		if old == val {
+			return append(append(vals[:ii:ii], vals[ii+1:]...), val)
+		}
+	}
+	vals = append(vals, val)
+	if len(vals) > size {
+		vals = vals[len(vals)-size:]
+	}
+	return vals
+}
+
+// dump copies the samples, oldest value first.
+func (r *reservoir) dump() map[string][]string {
+	r.Lock()
+	defer r.Unlock()
+	out := make(map[string][]string, len(r.values))
+	for key, vals := range r.values {
+		out[key] = append([]string{}, vals...)
+	}
+	return out
+}
+
+// LabelSamplesHandleFunc dumps the label value samples as json.
+func (i *Icarus) LabelSamplesHandleFunc(w http.ResponseWriter, r *http.Request) {
+	out, _ := json.Marshal(i.samples.dump())
+	fmt.Fprint(w, string(out))
+}
@@ -0,0 +1,65 @@
+package icarus
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestRecent(t *testing.T) {
+	var vals []string
+	for _, val := range []string{"a", "b", "a", "c", "d"} {
+		vals = recent(vals, val, 3)
+	}
+	if !reflect.DeepEqual(vals, []string{"a", "c", "d"}) {
+		t.Error(vals)
+	}
+}
+
+func TestLabelSamples(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.Record(helper(map[string]string{"__name__": "x", "pod": "p"}, 1))
+	i.Drain()
+	if g := i.samples.dump(); len(g) != 0 {
+		t.Error(g)
+	}
+
+	i.SetLabelSamples(3)
+	for ii := 0; ii < 5; ii++ {
+		i.Record(helper(map[string]string{"__name__": "x", "pod": fmt.Sprintf("p%v", ii), "env": "prod"}, 1))
+	}
+	i.Drain()
+	g := i.samples.dump()
+	if !reflect.DeepEqual(g, map[string][]string{"pod": {"p2", "p3", "p4"}, "env": {"prod"}}) {
+		t.Error(g)
+	}
+	rw := util.NewHTTPResponseWriter()
+	i.LabelSamplesHandleFunc(rw, &http.Request{Form: url.Values{}})
+	if g := rw.String(); g != `{"env":["prod"],"pod":["p2","p3","p4"]}` {
+		t.Error(g)
+	}
+}
+
+func TestLabelSamplesKeys(t *testing.T) {
+	r := reservoir{&sync.Mutex{}, 2, make(map[string][]string)}
+	for ii := 0; ii < maxSampledKeys+10; ii++ {
+		r.observe(map[string]string{fmt.Sprintf("k%v", ii): "v"})
+	}
+	// keys already kept still take new values past the cap.
+	r.observe(map[string]string{"k0": "w"})
+	g := r.dump()
+	if len(g) != maxSampledKeys {
+		t.Error(len(g))
+	}
+	if _, ok := g[fmt.Sprintf("k%v", maxSampledKeys)]; ok {
+		t.Error("kept a key past the cap")
+	}
+	if !reflect.DeepEqual(g["k0"], []string{"v", "w"}) {
+		t.Error(g["k0"])
+	}
+}
@@ -0,0 +1,104 @@
+package icarus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var icarusScrapeAssemblies = splitCounter(prometheus.CounterOpts{
+	Name: "icarus_scrape_assemblies_total",
+	Help: "How many times was a scrape response put together?",
+})
+
+func init() {
+	prometheus.MustRegister(icarusScrapeAssemblies)
+}
+
+// scrapeCache holds an assembled scrape response for scrapes that come close together.
+type scrapeCache struct {
+	*sync.Mutex
+	ttl    time.Duration
+	output string
+	at     time.Time
+	// maxAge is the freshness cut, see SetScrapeMaxAge.
+	maxAge time.Duration
+	// openMetrics serves OpenMetrics to scrapes asking for it, see SetOpenMetrics.
+	openMetrics bool
+	// building is closed once the response being put together for the cache
+	// is ready, nil when none is.
+	building chan bool
+	// pages counts expireScrapes, so a response put together from an
+	// older page is not cached.
+	pages uint64
+}
+
+// SetScrapeCache has scrapes within ttl of each other share one assembled
+// response, so a storm of scrapers does the work once. Each rollup starts a
+// fresh one. Zero, the default, assembles the response for every scrape.
+func (i *Icarus) SetScrapeCache(ttl time.Duration) {
+	i.configChanged()
+	i.scrapes.Lock()
+	defer i.scrapes.Unlock()
+	i.scrapes.ttl = ttl
+	i.scrapes.output = ""
+	i.scrapes.at = time.Time{}
+	i.scrapes.pages++
+}
+
+// scrapeOutput is the response to a scrape, cached if SetScrapeCache asked.
+// Without the cache every scrape puts its own together. With it, scrapes
+// arriving while the cached one is being put together wait for it.
+func (i *Icarus) scrapeOutput() string {
+	i.scrapes.Lock()
+	if i.scrapes.ttl <= 0 {
+		i.scrapes.Unlock()
+		return i.assembleScrape()
+	}
+	for {
+		if !i.scrapes.at.IsZero() && (i.now().Sub(i.scrapes.at) < i.scrapes.ttl) {
+			output := i.scrapes.output
+			i.scrapes.Unlock()
+			return output
+		}
+		if i.scrapes.building == nil {
+			break
+		}
+		building := i.scrapes.building
+		i.scrapes.Unlock()
+		<-building
+		i.scrapes.Lock()
+	}
+	building, pages := make(chan bool), i.scrapes.pages
+	i.scrapes.building = building
+	i.scrapes.Unlock()
+	output := i.assembleScrape()
+	i.scrapes.Lock()
+	if (i.scrapes.ttl > 0) && (i.scrapes.pages == pages) {
+		i.scrapes.output, i.scrapes.at = output, i.now()
+	}
+	i.scrapes.building = nil
+	close(building)
+	i.scrapes.Unlock()
+	return output
+}
+
+// assembleScrape puts a scrape response together.
+func (i *Icarus) assembleScrape() string {
+	i.counter(icarusScrapeAssemblies).Inc()
+	output := i.defaultSection() + i.servePage().Read()
+	if !i.isReady() {
+		output += i.notReady()
+	}
+	return output
+}
+
+// expireScrapes drops a cached scrape response, once there is a new page.
+func (i *Icarus) expireScrapes() {
+	i.scrapes.Lock()
+	defer i.scrapes.Unlock()
+	i.scrapes.output = ""
+	i.scrapes.at = time.Time{}
+	i.scrapes.pages++
+}
@@ -0,0 +1,81 @@
+package icarus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestScrapeCache(t *testing.T) {
+	i := NewIcarus("ft_")
+	now := time.Unix(1500000000, 0)
+	i.now = func() time.Time { return now }
+	i.SetScrapeCache(time.Second)
+	i.Record(helper(map[string]string{"__name__": "x"}, 1))
+	i.Drain()
+	i.rollup()
+	scrape := func() string {
+		rw := httptest.NewRecorder()
+		i.HandleFunc(rw, httptest.NewRequest("GET", "/metrics", nil))
+		return rw.Body.String()
+	}
+	before := value(icarusScrapeAssemblies)
+	var wg sync.WaitGroup
+	for ii := 0; ii < 20; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if g := scrape(); !strings.Contains(g, "\nft_x{} 1\n") {
+				t.Error(g)
+			}
+		}()
+	}
+	wg.Wait()
+	if g := value(icarusScrapeAssemblies); g != before+1 {
+		t.Error(g)
+	}
+	// a rollup starts over.
+	i.Record(helper(map[string]string{"__name__": "x"}, 2))
+	i.Drain()
+	i.rollup()
+	if g := scrape(); !strings.Contains(g, "\nft_x{} 2\n") {
+		t.Error(g)
+	}
+	if g := value(icarusScrapeAssemblies); g != before+2 {
+		t.Error(g)
+	}
+	now = now.Add(time.Second)
+	scrape()
+	if g := value(icarusScrapeAssemblies); g != before+3 {
+		t.Error(g)
+	}
+}
+
+func TestScrapeWithoutCache(t *testing.T) {
+	defer func(g prometheus.Gatherer) { gatherer = g }(gatherer)
+	release := make(chan bool)
+	inside := blockGathers(release)
+	i := NewIcarus("ft_")
+	var wg sync.WaitGroup
+	for ii := 0; ii < 2; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i.HandleFunc(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+		}()
+	}
+	// without the cache, neither scrape waits for the other.
+	for ii := 0; ii < 2; ii++ {
+		select {
+		case <-inside:
+		case <-time.After(time.Second):
+			t.Error("scrapes waited for each other")
+		}
+	}
+	close(release)
+	wg.Wait()
+}
@@ -0,0 +1,64 @@
+package icarus
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// subscribe hands back a channel that holds the latest page a rollup wrote
+// that the subscriber has not taken yet.
+func (i *Icarus) subscribe() chan string {
+	i.Lock()
+	defer i.Unlock()
+	pages := make(chan string, 1)
+	i.subscribers[pages] = true
+	return pages
+}
+
+func (i *Icarus) unsubscribe(pages chan string) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.subscribers, pages)
+}
+
+// notify passes a page to subscribers. A subscriber still busy with the last
+// one has the page waiting for it swapped for this one, so it always gets the
+// latest next. Callers hold the icarus lock.
+func (i *Icarus) notify(page string) {
+	for pages := range i.subscribers {
+		select {
+		case <-pages:
+		default:
+		}
+		// only notify sends, so the slot just emptied is still free.
+		pages <- page
+	}
+}
+
+// SSEHandleFunc streams each new page as a server-sent event until the client goes away.
+func (i *Icarus) SSEHandleFunc(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	pages := i.subscribe()
+	defer i.unsubscribe(pages)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case page := <-pages:
+			fmt.Fprint(w, "event: rollup\n")
+			for _, line := range strings.Split(strings.TrimRight(page, "\n"), "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+		}
+	}
+}
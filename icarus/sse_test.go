@@ -0,0 +1,66 @@
+package icarus
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func subscribers(i *Icarus) int {
+	i.Lock()
+	defer i.Unlock()
+	return len(i.subscribers)
+}
+
+func TestSSE(t *testing.T) {
+	i := NewIcarus("ft_")
+	i.Record(helper(map[string]string{"__name__": "x", "a": "b"}, 1))
+	eventually(t, func() bool { return len(i.Store.Dump()) == 1 })
+	server := httptest.NewServer(http.HandlerFunc(i.SSEHandleFunc))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := resp.Header.Get("Content-Type"); g != "text/event-stream" {
+		t.Error(g)
+	}
+	eventually(t, func() bool { return subscribers(i) == 1 })
+	i.rollup()
+
+	reader := bufio.NewReader(resp.Body)
+	event := ""
+	for !strings.Contains(event, `ft_x{a="b"} 1`) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(event, err)
+		}
+		event += line
+	}
+	if !strings.HasPrefix(event, "event: rollup\n") {
+		t.Error(event)
+	}
+	resp.Body.Close()
+	eventually(t, func() bool { return subscribers(i) == 0 })
+}
+
+func TestNotifyLatest(t *testing.T) {
+	i := NewIcarus("ft_")
+	pages := i.subscribe()
+	defer i.unsubscribe(pages)
+	i.Lock()
+	i.notify("a")
+	i.notify("b")
+	i.Unlock()
+	if g := <-pages; g != "b" {
+		t.Error(g)
+	}
+	select {
+	case g := <-pages:
+		t.Error("more than the latest:", g)
+	default:
+	}
+}
@@ -0,0 +1,60 @@
+package icarus
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// NameSummary is an overview of every series under one metric name.
+type NameSummary struct {
+	Name   string
+	Series int
+	Sum    float64
+	Min    float64
+	Max    float64
+	Avg    float64
+}
+
+// Summary sums up the store by metric name, sorted by name, for clients that
+// cannot take every series. NaN values are counted as series but left out of
+// the arithmetic; a name with only NaNs gets zeros.
+func (i *Icarus) Summary() []NameSummary {
+	byName := make(map[string]*NameSummary)
+	values := make(map[string]int)
+	for _, met := range i.Store.Dump() {
+		name := met.Desc["__name__"]
+		sum, ok := byName[name]
+		if !ok {
+			sum = &NameSummary{Name: name, Min: math.Inf(1), Max: math.Inf(-1)}
+			byName[name] = sum
+		}
+		sum.Series++
+		if math.IsNaN(met.Data.Val) {
+			continue
+		}
+		values[name]++
+		sum.Sum += met.Data.Val
+		sum.Min = math.Min(sum.Min, met.Data.Val)
+		sum.Max = math.Max(sum.Max, met.Data.Val)
+	}
+	out := make([]NameSummary, 0, len(byName))
+	for name, sum := range byName {
+		if values[name] == 0 {
+			sum.Min, sum.Max = 0, 0
+		} else {
+			sum.Avg = sum.Sum / float64(values[name])
+		}
+		out = append(out, *sum)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Name < out[b].Name })
+	return out
+}
+
+// SummaryHandleFunc dumps the Summary as json.
+func (i *Icarus) SummaryHandleFunc(w http.ResponseWriter, r *http.Request) {
+	out, _ := json.Marshal(i.Summary())
+	fmt.Fprint(w, string(out))
+}
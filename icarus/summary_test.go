@@ -0,0 +1,41 @@
+package icarus
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestSummary(t *testing.T) {
+	i := NewIcarus("ft_")
+	for ii, val := range []float64{1, 2, 6} {
+		i.Record(helper(map[string]string{"__name__": "x", "pod": string('a' + rune(ii))}, val))
+	}
+	i.Record(helper(map[string]string{"__name__": "y"}, -3))
+	i.Record(helper(map[string]string{"__name__": "z"}, math.NaN()))
+	i.Drain()
+	g := i.Summary()
+	want := []NameSummary{
+		{"ft_x", 3, 9, 1, 6, 3},
+		{"ft_y", 1, -3, -3, -3, -3},
+		{"ft_z", 1, 0, 0, 0, 0},
+	}
+	if len(g) != len(want) {
+		t.Fatal(g)
+	}
+	for ii := range want {
+		if g[ii] != want[ii] {
+			t.Error(g[ii])
+		}
+	}
+
+	rw := util.NewHTTPResponseWriter()
+	i.SummaryHandleFunc(rw, &http.Request{Form: url.Values{}})
+	if g := rw.String(); !strings.Contains(g, `{"Name":"ft_x","Series":3,"Sum":9,"Min":1,"Max":6,"Avg":3}`) {
+		t.Error(g)
+	}
+}
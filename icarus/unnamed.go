@@ -0,0 +1,79 @@
+package icarus
+
+import (
+	"github.com/luuphu25/data-sidecar/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var icarusUnnamedCounter = splitCounterVec(prometheus.CounterOpts{
+	Name: "icarus_unnamed_metric_counter",
+	Help: "How many samples came in without a name, and what happened to them?",
+}, []string{"action"})
+
+func init() {
+	prometheus.MustRegister(icarusUnnamedCounter)
+}
+
+// UnnamedMode decides what ingest does with a sample that has neither a
+// __name__ nor a name label, which with no prefix would be served as a bare
+// unnamed_metric.
+type UnnamedMode int
+
+const (
+	// UnnamedDefault names the sample the default name, unnamed_metric unless
+	// SetUnnamed says otherwise. This is the default.
+	UnnamedDefault UnnamedMode = iota
+	// UnnamedDrop drops the sample.
+	UnnamedDrop
+	// UnnamedTagSource names the sample the default name and adds a source
+	// label saying who sent it, unknown if it did not come over http.
+	UnnamedTagSource
+)
+
+func (m UnnamedMode) String() string {
+	switch m {
+	case UnnamedDrop:
+		return "dropped"
+	case UnnamedTagSource:
+		return "tagged"
+	}
+	return "named"
+}
+
+// defaultUnnamed is the name an unnamed sample gets unless SetUnnamed says otherwise.
+const defaultUnnamed = "unnamed_metric"
+
+// SetUnnamed picks what happens to samples without a name, and the name they
+// get if they are kept. An empty name keeps unnamed_metric.
+func (i *Icarus) SetUnnamed(mode UnnamedMode, name string) {
+	i.configChanged()
+	i.recordMux.Lock()
+	defer i.recordMux.Unlock()
+	if name == "" {
+		name = defaultUnnamed
+	}
+	i.unnamed, i.unnamedName = mode, name
+}
+
+// named gives a sample without a name one, false means the sample should go.
+func (i *Icarus) named(x *util.Metric) bool {
+	i.recordMux.RLock()
+	label, mode, name := i.nameLabel, i.unnamed, i.unnamedName
+	i.recordMux.RUnlock()
+	if (x.Desc["__name__"] != "") || (x.Desc[label] != "") {
+		return true
+	}
+	i.counterVec(icarusUnnamedCounter).WithLabelValues(mode.String()).Inc()
+	switch mode {
+	case UnnamedDrop:
+		return false
+	case UnnamedTagSource:
+		source := x.Annotations[sourceAnnotation]
+		if source == "" {
+			source = "unknown"
+		}
+		x.Desc[sourceAnnotation] = source
+	}
+	x.Desc["__name__"] = name
+	return true
+}
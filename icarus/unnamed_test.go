@@ -0,0 +1,48 @@
+package icarus
+
+import (
+	"testing"
+
+	"github.com/luuphu25/data-sidecar/util"
+)
+
+func TestUnnamed(t *testing.T) {
+	for _, test := range []struct {
+		mode UnnamedMode
+		name string
+		want map[string]string
+	}{
+		{UnnamedDefault, "", map[string]string{"__name__": "unnamed_metric", "a": "b"}},
+		{UnnamedDefault, "orphan", map[string]string{"__name__": "orphan", "a": "b"}},
+		{UnnamedTagSource, "", map[string]string{"__name__": "unnamed_metric", "a": "b", "source": "10.0.0.1"}},
+		{UnnamedDrop, "", nil},
+	} {
+		i := NewIcarus("")
+		i.SetUnnamed(test.mode, test.name)
+		before := value(icarusUnnamedCounter.WithLabelValues(test.mode.String()))
+		i.Record(util.Metric{Desc: map[string]string{"a": "b"}, Annotations: map[string]string{sourceAnnotation: "10.0.0.1"}})
+		// named ones are left alone.
+		i.Record(helper(map[string]string{"__name__": "x"}, 1))
+		i.Drain()
+		got := map[string]string(nil)
+		for _, met := range i.Snapshot() {
+			if met.Desc["__name__"] != "x" {
+				got = met.Desc
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Error(test.mode, got)
+		}
+		for key, val := range test.want {
+			if got[key] != val {
+				t.Error(test.mode, got)
+			}
+		}
+		if g := value(icarusUnnamedCounter.WithLabelValues(test.mode.String())); g != before+1 {
+			t.Error(test.mode, g)
+		}
+		if g := len(i.Snapshot()); (test.want == nil) != (g == 1) {
+			t.Error(test.mode, g)
+		}
+	}
+}
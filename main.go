@@ -7,15 +7,19 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"time"
 
 	"github.com/luuphu25/data-sidecar/icarus"
+	"github.com/luuphu25/data-sidecar/icarus/icaruspb"
 	"github.com/luuphu25/data-sidecar/prom"
 	"github.com/luuphu25/data-sidecar/scoring"
 	"github.com/luuphu25/data-sidecar/storage"
+	"github.com/luuphu25/data-sidecar/util"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
 )
 
 var (
@@ -35,13 +39,26 @@ var (
 	logFatal = log.Fatal
 	// flags
 
-	port       = flag.Int("port", 8077, "port on which to expose metrics")
-	cleanup    = flag.Int("cleanup", 300, "time after which a missing series may be garbage collected (seconds)")
-	p8s        = flag.String("prom", "http://querier/api/prom/", "which prometheus to scrape")
-	resolution = flag.Int("resolution", 10, "range query resolution (seconds)")
-	lookback   = flag.Int("lookback", 60, "empirical lookback window (minutes)")
-	prefix     = flag.String("pfx", "ft_", "export prefix for metrics")
-	version    = "undefined"
+	port         = flag.Int("port", 8077, "port on which to expose metrics")
+	cleanup      = flag.Int("cleanup", 300, "time after which a missing series may be garbage collected (seconds)")
+	p8s          = flag.String("prom", "http://querier/api/prom/", "which prometheus to scrape")
+	resolution   = flag.Int("resolution", 10, "range query resolution (seconds)")
+	lookback     = flag.Int("lookback", 60, "empirical lookback window (minutes)")
+	prefix       = flag.String("pfx", "ft_", "export prefix for metrics")
+	maxBody      = flag.Int64("maxbody", 10<<20, "largest request body accepted by /ingest and /score (bytes)")
+	ingest       = flag.Bool("ingest", false, "accept json metrics POSTed to /ingest")
+	deletes      = flag.Bool("delete", false, "let POSTs to /delete remove series from the store")
+	debug        = flag.Bool("debug", false, "show the store on /snapshot, /manifest, /summary and /logs")
+	federate     = flag.Bool("federate", false, "serve series picked by match[] on /federate")
+	sse          = flag.Bool("sse", false, "stream each new metrics page as server-sent events on /events")
+	openMetrics  = flag.Bool("openmetrics", false, "serve OpenMetrics stamped with window starts on /metrics to scrapers asking for it")
+	grpcPort     = flag.Int("grpc", 0, "port on which to stream the store over gRPC on each rollup (0 is off)")
+	deadLetter   = flag.Int("deadletter", 0, "how many rejected samples to keep for /deadletter (0 is off)")
+	labelSamples = flag.Int("labelsamples", 0, "how many recent values of each label key to keep for /labels (0 is off)")
+	debugValves  = flag.Bool("valves", false, "show recent safety valve trips on /valves")
+	hashKeys     = flag.Bool("hashkeys", false, "key series in the store by their _hash label, counting collisions in icarus_hash_collisions_total")
+	counterFile  = flag.String("counterfile", "", "file to keep icarus self-metric counters in across restarts (empty is off)")
+	version      = "undefined"
 )
 
 func init() {
@@ -81,9 +98,53 @@ func main() {
 	mux.HandleFunc("/dump", Monitor(seriesCollection.DumpHandleFunc))
 	remote := icarus.NewIcarus(*prefix)
 	mux.HandleFunc("/metrics", Monitor(remote.HandleFunc))
+	remote.SetMaxBody(*maxBody)
+	remote.SetCounterFile(*counterFile)
+	remote.SetOpenMetrics(*openMetrics)
+	remote.SetHashKeys(*hashKeys, *debug)
+	mux.HandleFunc("/readyz", remote.ReadyzHandleFunc)
+	if *ingest {
+		mux.HandleFunc("/ingest", Monitor(remote.IngestHandleFunc))
+	}
+	if *deletes {
+		mux.HandleFunc("/delete", Monitor(remote.DeleteHandleFunc))
+	}
+	if *debug {
+		mux.HandleFunc("/snapshot", Monitor(remote.SnapshotHandleFunc))
+		mux.HandleFunc("/manifest", Monitor(remote.ManifestHandleFunc))
+		mux.HandleFunc("/summary", Monitor(remote.SummaryHandleFunc))
+		mux.HandleFunc("/logs", Monitor(remote.LogHandleFunc))
+	}
+	if *federate {
+		mux.HandleFunc("/federate", Monitor(remote.FederateHandleFunc))
+	}
+	if *labelSamples > 0 {
+		remote.SetLabelSamples(*labelSamples)
+		mux.HandleFunc("/labels", Monitor(remote.LabelSamplesHandleFunc))
+	}
+	if *sse {
+		mux.HandleFunc("/events", remote.SSEHandleFunc)
+	}
+	if *grpcPort > 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%v", *grpcPort))
+		if err != nil {
+			logFatal(err)
+		}
+		streams := grpc.NewServer()
+		icaruspb.RegisterMetricsServer(streams, remote.MetricsServer())
+		log.Println("streaming the store over gRPC on port", *grpcPort)
+		go func() { logFatal(streams.Serve(listener)) }()
+	}
+	if *deadLetter > 0 {
+		remote.EnableDeadLetter(*deadLetter)
+		mux.HandleFunc("/deadletter", Monitor(remote.DeadLetterHandleFunc))
+	}
+	if *debugValves {
+		mux.HandleFunc("/valves", Monitor(remote.ValvesHandleFunc))
+	}
 	scorer := scoring.NewScorer(seriesCollection, remote)
 
-	mux.HandleFunc("/score", Monitor(scorer.ScoreHandleFunc))
+	mux.HandleFunc("/score", Monitor(util.LimitBody(*maxBody, scorer.ScoreHandleFunc)))
 
 	promClient := prom.NewClient(*p8s, *resolution, *lookback, scorer)
 	log.Println(promClient.Status())
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"errors"
+)
+
+var (
+	errNoName     = errors.New("metric has no name")
+	errEmptyLabel = errors.New("metric has a label with no name")
+	errNameLabel  = errors.New("metric name is set with NewMetric, not WithLabel")
+)
+
+// MetricBuilder puts a Metric together a piece at a time, so __name__ can't be forgotten.
+type MetricBuilder struct {
+	desc map[string]string
+	data DataPoint
+	err  error
+}
+
+// NewMetric starts building a metric called name.
+func NewMetric(name string) *MetricBuilder {
+	b := MetricBuilder{desc: map[string]string{"__name__": name}}
+	if name == "" {
+		b.err = errNoName
+	}
+	return &b
+}
+
+// WithLabel adds a label.
+func (b *MetricBuilder) WithLabel(key, val string) *MetricBuilder {
+	switch key {
+	case "":
+		b.err = errEmptyLabel
+	case "__name__":
+		b.err = errNameLabel
+	default:
+		b.desc[key] = val
+	}
+	return b
+}
+
+// WithValue sets the value.
+func (b *MetricBuilder) WithValue(val float64) *MetricBuilder {
+	b.data.Val = val
+	return b
+}
+
+// WithTime sets the timestamp.
+func (b *MetricBuilder) WithTime(t int64) *MetricBuilder {
+	b.data.Time = t
+	return b
+}
+
+// Build hands back the metric, or the first thing that was wrong with it.
+func (b *MetricBuilder) Build() (Metric, error) {
+	if b.err != nil {
+		return Metric{}, b.err
+	}
+	desc := make(map[string]string, len(b.desc))
+	for key, val := range b.desc {
+		desc[key] = val
+	}
+	return Metric{Desc: desc, Data: b.data}, nil
+}
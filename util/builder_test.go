@@ -0,0 +1,29 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	g, err := NewMetric("x").WithLabel("a", "b").WithValue(2).WithTime(5).Build()
+	want := Metric{Desc: map[string]string{"__name__": "x", "a": "b"}, Data: DataPoint{Val: 2, Time: 5}}
+	if (err != nil) || !reflect.DeepEqual(g, want) {
+		t.Error(g, err)
+	}
+	if _, err := NewMetric("").WithValue(1).Build(); err != errNoName {
+		t.Error(err)
+	}
+	if _, err := NewMetric("x").WithLabel("", "b").Build(); err != errEmptyLabel {
+		t.Error(err)
+	}
+	if _, err := NewMetric("x").WithLabel("__name__", "y").Build(); err != errNameLabel {
+		t.Error(err)
+	}
+	b := NewMetric("x")
+	first, _ := b.Build()
+	b.WithLabel("a", "b")
+	if _, ok := first.Desc["a"]; ok {
+		t.Error(first)
+	}
+}
@@ -1,11 +1,17 @@
 package util
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"time"
 )
 
+// ErrTooLarge is what ReadBody says when a request body is over its limit.
+var ErrTooLarge = errors.New("request body too large")
+
 // SingleConnNoKeepAliveTransporter returns a transporter with no keep alives and a max of 1 idle connection
 func SingleConnNoKeepAliveTransporter() *http.Transport {
 	return &http.Transport{
@@ -16,3 +22,39 @@ func SingleConnNoKeepAliveTransporter() *http.Transport {
 		TLSHandshakeTimeout: 5 * time.Second,
 	}
 }
+
+// ReadBody reads a request body as long as it is no more than limit bytes.
+// Past the limit it stops reading and has the server close the connection
+// rather than read the rest, see http.MaxBytesReader.
+func ReadBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil {
+		return []byte{}, nil
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	body, err := ioutil.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, ErrTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// LimitBody answers 413 to requests with a body over limit bytes instead of passing them on.
+func LimitBody(limit int64, f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ReadBody(w, r, limit)
+		if err == ErrTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		f(w, r)
+	})
+}
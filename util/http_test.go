@@ -0,0 +1,54 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitBody(t *testing.T) {
+	echo := LimitBody(5, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, string(body))
+	})
+	rw := httptest.NewRecorder()
+	echo(rw, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+	if (rw.Code != http.StatusOK) || (rw.Body.String() != "hello") {
+		t.Error(rw.Code, rw.Body.String())
+	}
+	rw = httptest.NewRecorder()
+	echo(rw, httptest.NewRequest("POST", "/", strings.NewReader("hello!")))
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Error(rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	echo(rw, &http.Request{})
+	if rw.Code != http.StatusOK {
+		t.Error(rw.Code)
+	}
+}
+
+// endless is a body that never ends, counting what was read of it.
+type endless struct{ read int }
+
+func (e *endless) Read(p []byte) (int, error) {
+	for ii := range p {
+		p[ii] = 'x'
+	}
+	e.read += len(p)
+	return len(p), nil
+}
+
+func TestReadBodyStops(t *testing.T) {
+	body := &endless{}
+	rw := httptest.NewRecorder()
+	if _, err := ReadBody(rw, httptest.NewRequest("POST", "/", body), 5); err != ErrTooLarge {
+		t.Error(err)
+	}
+	if body.read > 6 {
+		t.Error(body.read)
+	}
+}
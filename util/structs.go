@@ -4,6 +4,15 @@ package util
 type Metric struct {
 	Desc map[string]string
 	Data DataPoint
+	// OneShot metrics are served once and then forgotten, like an event.
+	// Those that can never be served, NaN or below a minimum, are forgotten
+	// at the next rollup.
+	OneShot bool `json:",omitempty"`
+	// Annotations ride along for debugging and are never exposed to prometheus.
+	Annotations map[string]string `json:",omitempty"`
+	// Admitted is how many bytes of an ingest budget the sample holds on its
+	// way to the store. It is never written out.
+	Admitted int64 `json:"-"`
 }
 
 // DataPoint holds a time-value pair.